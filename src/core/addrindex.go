@@ -0,0 +1,242 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/boltdb/bolt"
+)
+
+// 地址索引，记录主链上每笔交易对地址余额的影响
+// key 为 地址中的hash（公钥hash或者脚本hash）+ 4字节大端序的区块高度 + 交易ID，value 为8字节大端序的余额变化（转入为正，转出为负）
+// 同一地址的记录按高度排列，可以按前缀遍历
+// 区块接入主链时随 chainstate 一起写入，断开时根据撤销数据删除
+const addrIndexBucket = "addrindex"
+
+// 每个地址在地址索引中的记录数，key 为地址中的hash，value 为8字节大端序的记录数
+// 分页查询时用它得到总数，不需要遍历地址的全部记录
+const addrCountBucket = "addrcount"
+
+// 地址的一条交易记录
+type AddressTx struct {
+	TxID   []byte
+	Height int
+	// 交易使地址余额增加（正）或减少（负）的数量
+	Delta int
+}
+
+func addrIndexKey(pubKeyHash []byte, height int, txid []byte) []byte {
+	key := make([]byte, len(pubKeyHash)+4+len(txid))
+	copy(key, pubKeyHash)
+	binary.BigEndian.PutUint32(key[len(pubKeyHash):], uint32(height))
+	copy(key[len(pubKeyHash)+4:], txid)
+	return key
+}
+
+// 把地址的记录数加上 n，减到0时删除
+func addAddressCount(tx *bolt.Tx, pubKeyHash []byte, n int) error {
+	b := tx.Bucket([]byte(addrCountBucket))
+	count := n
+	if v := b.Get(pubKeyHash); v != nil {
+		count += int(binary.BigEndian.Uint64(v))
+	}
+	if count <= 0 {
+		return b.Delete(pubKeyHash)
+	}
+	value := make([]byte, 8)
+	binary.BigEndian.PutUint64(value, uint64(count))
+	return b.Put(pubKeyHash, value)
+}
+
+// 交易对各个地址余额的影响
+type addressDelta struct {
+	pubKeyHash []byte
+	txid       []byte
+	delta      int
+}
+
+// 计算区块中每笔交易对每个地址的余额变化
+// undo 中按花费顺序记录了被花费的输出，和区块中非奖励交易的输入一一对应
+func blockAddressDeltas(block *Block, undo BlockUndo) ([]addressDelta, error) {
+	var deltas []addressDelta
+	spent := undo.Spent
+
+	for _, transaction := range block.Transactions {
+		var txDeltas []addressDelta
+		// 只索引标准脚本，非标准脚本没有对应的地址
+		add := func(pubKeyHash []byte, value int) {
+			if pubKeyHash == nil {
+				return
+			}
+			for i := range txDeltas {
+				if bytes.Equal(txDeltas[i].pubKeyHash, pubKeyHash) {
+					txDeltas[i].delta += value
+					return
+				}
+			}
+			txDeltas = append(txDeltas, addressDelta{pubKeyHash, transaction.ID, value})
+		}
+
+		if transaction.IsRewardTx() == false {
+			for range transaction.Vin {
+				if len(spent) == 0 {
+					return nil, fmt.Errorf("undo data of block %x does not match its inputs", block.Hash)
+				}
+				add(scriptAddressHash(spent[0].Out.ScriptPubKey), -spent[0].Out.Value)
+				spent = spent[1:]
+			}
+		}
+		for _, out := range transaction.Vout {
+			add(scriptAddressHash(out.ScriptPubKey), out.Value)
+		}
+
+		deltas = append(deltas, txDeltas...)
+	}
+
+	return deltas, nil
+}
+
+// 把区块中的交易写入地址索引，数据库中还没有地址索引时什么也不做
+func indexBlockAddresses(tx *bolt.Tx, block *Block, undo BlockUndo) error {
+	b := tx.Bucket([]byte(addrIndexBucket))
+	if b == nil {
+		return nil
+	}
+
+	deltas, err := blockAddressDeltas(block, undo)
+	if err != nil {
+		return err
+	}
+	for _, d := range deltas {
+		key := addrIndexKey(d.pubKeyHash, block.Height, d.txid)
+		if b.Get(key) == nil {
+			if err := addAddressCount(tx, d.pubKeyHash, 1); err != nil {
+				return err
+			}
+		}
+		value := make([]byte, 8)
+		binary.BigEndian.PutUint64(value, uint64(int64(d.delta)))
+		if err := b.Put(key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 区块从主链断开时删除它写入的地址索引
+func unindexBlockAddresses(tx *bolt.Tx, block *Block, undo BlockUndo) error {
+	b := tx.Bucket([]byte(addrIndexBucket))
+	if b == nil {
+		return nil
+	}
+
+	deltas, err := blockAddressDeltas(block, undo)
+	if err != nil {
+		return err
+	}
+	for _, d := range deltas {
+		key := addrIndexKey(d.pubKeyHash, block.Height, d.txid)
+		if b.Get(key) == nil {
+			continue
+		}
+		if err := b.Delete(key); err != nil {
+			return err
+		}
+		if err := addAddressCount(tx, d.pubKeyHash, -1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 从创世区块开始按主链重建地址索引
+// 旧的撤销数据可能已经被删除，所以通过 replayMainChain 得到每个输入花费的输出
+func buildAddrIndex(tx *bolt.Tx) error {
+	for _, bucket := range []string{addrIndexBucket, addrCountBucket} {
+		err := tx.DeleteBucket([]byte(bucket))
+		if err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+		if _, err := tx.CreateBucket([]byte(bucket)); err != nil {
+			return err
+		}
+	}
+
+	return replayMainChain(tx, func(block *Block, undo BlockUndo) error {
+		return indexBlockAddresses(tx, block, undo)
+	})
+}
+
+// 旧版本创建的数据库没有地址索引或者没有记录数，打开时补建
+func ensureAddrIndex(tx *bolt.Tx) error {
+	if tx.Bucket([]byte(addrIndexBucket)) != nil && tx.Bucket([]byte(addrCountBucket)) != nil {
+		return nil
+	}
+	return buildAddrIndex(tx)
+}
+
+// 查询地址的交易记录，按高度从新到旧排列
+// 跳过最新的 skip 条，最多返回 limit 条，limit 不大于0时返回全部；total 为记录总数，用于分页
+// 从地址的最后一条记录向前移动游标，只解码需要返回的记录
+func (bc *Blockchain) AddressHistory(pubKeyHash []byte, skip, limit int) (history []AddressTx, total int, err error) {
+	err = bc.Db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(addrIndexBucket))
+		if b == nil {
+			return nil
+		}
+		if v := tx.Bucket([]byte(addrCountBucket)).Get(pubKeyHash); v != nil {
+			total = int(binary.BigEndian.Uint64(v))
+		}
+
+		c := b.Cursor()
+		k, v := seekLastWithPrefix(c, pubKeyHash)
+		for i := 0; i < skip && k != nil; i++ {
+			k, v = c.Prev()
+		}
+		for ; k != nil && bytes.HasPrefix(k, pubKeyHash); k, v = c.Prev() {
+			if limit > 0 && len(history) >= limit {
+				break
+			}
+			rest := k[len(pubKeyHash):]
+			if len(rest) < 4 || len(v) != 8 {
+				return fmt.Errorf("invalid address index entry %x", k)
+			}
+			history = append(history, AddressTx{
+				TxID:   append([]byte{}, rest[4:]...),
+				Height: int(binary.BigEndian.Uint32(rest[:4])),
+				Delta:  int(int64(binary.BigEndian.Uint64(v))),
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return history, total, nil
+}
+
+// 把游标移动到以 prefix 开头的最后一个 key，没有这样的 key 时返回 nil
+func seekLastWithPrefix(c *bolt.Cursor, prefix []byte) ([]byte, []byte) {
+	// 比 prefix 开头的所有 key 都大的最小前缀：去掉末尾的 0xff 之后把最后一个字节加1
+	end := append([]byte{}, prefix...)
+	for len(end) > 0 && end[len(end)-1] == 0xff {
+		end = end[:len(end)-1]
+	}
+
+	var k, v []byte
+	if len(end) == 0 {
+		k, v = c.Last()
+	} else {
+		end[len(end)-1]++
+		if k, _ = c.Seek(end); k == nil {
+			k, v = c.Last()
+		} else {
+			k, v = c.Prev()
+		}
+	}
+	if k == nil || !bytes.HasPrefix(k, prefix) {
+		return nil, nil
+	}
+	return k, v
+}
@@ -0,0 +1,63 @@
+package core
+
+import (
+	"testing"
+)
+
+// 分页从最新的记录开始，总数来自记录数，区块断开后记录和总数一起减少
+func TestAddressHistoryPaging(t *testing.T) {
+	bc, alice := newTestChain(t)
+	bob := newTestWallet(t)
+	bobHash := HashPubKey(bob.PublicKey)
+
+	for i := 0; i < 5; i++ {
+		tx, err := NewTransaction(alice, testAddress(bc.Params, bob), 1, 0, 0, &UTXOSet{bc})
+		if err != nil {
+			t.Fatal(err)
+		}
+		mineTestBlock(t, bc, tx)
+	}
+
+	for _, test := range []struct {
+		skip, limit int
+		heights     []int
+	}{
+		{0, 2, []int{6, 5}},
+		{2, 2, []int{4, 3}},
+		{4, 2, []int{2}},
+		{5, 2, nil},
+		{1, 0, []int{5, 4, 3, 2}},
+	} {
+		history, total, err := bc.AddressHistory(bobHash, test.skip, test.limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if total != 5 {
+			t.Fatalf("total = %d, want 5", total)
+		}
+		if len(history) != len(test.heights) {
+			t.Fatalf("skip %d limit %d: got %d records, want %d", test.skip, test.limit, len(history), len(test.heights))
+		}
+		for i, item := range history {
+			if item.Height != test.heights[i] || item.Delta != 1 {
+				t.Fatalf("skip %d limit %d: record %d = %+v, want +1 at height %d", test.skip, test.limit, i, item, test.heights[i])
+			}
+		}
+	}
+
+	if _, err := bc.InvalidateBlock(bc.getLastHash()); err != nil {
+		t.Fatal(err)
+	}
+	history, total, err := bc.AddressHistory(bobHash, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 4 || len(history) != 1 || history[0].Height != 5 {
+		t.Fatalf("after invalidating the tip: total = %d, history = %+v, want 4 records starting at height 5", total, history)
+	}
+
+	// 没有记录的地址
+	if history, total, err := bc.AddressHistory(HashPubKey(newTestWallet(t).PublicKey), 0, 10); err != nil || total != 0 || len(history) != 0 {
+		t.Fatalf("unknown address: total = %d, history = %+v, err = %v", total, history, err)
+	}
+}
@@ -2,6 +2,7 @@ package core
 
 import (
 	"bytes"
+	"fmt"
 	"math/big"
 )
 
@@ -23,7 +24,7 @@ func Base58Encode(input []byte) []byte {
 	}
 
 	// https://en.bitcoin.it/wiki/Base58Check_encoding#Version_bytes
-	if input[0] == 0x00 {
+	if len(input) > 0 && input[0] == 0x00 {
 		result = append(result, b58Alphabet[0])
 	}
 
@@ -33,11 +34,18 @@ func Base58Encode(input []byte) []byte {
 }
 
 // Base58Decode decodes Base58-encoded data
-func Base58Decode(input []byte) []byte {
+// 输入为空或者包含 Base58 字母表以外的字符时返回错误
+func Base58Decode(input []byte) ([]byte, error) {
+	if len(input) == 0 {
+		return nil, fmt.Errorf("empty base58 string")
+	}
 	result := big.NewInt(0)
 
 	for _, b := range input {
 		charIndex := bytes.IndexByte(b58Alphabet, b)
+		if charIndex < 0 {
+			return nil, fmt.Errorf("invalid base58 character %q", b)
+		}
 		result.Mul(result, big.NewInt(58))
 		result.Add(result, big.NewInt(int64(charIndex)))
 	}
@@ -48,7 +56,7 @@ func Base58Decode(input []byte) []byte {
 		decoded = append([]byte{0x00}, decoded...)
 	}
 
-	return decoded
+	return decoded, nil
 }
 
 // ReverseBytes reverses a byte array
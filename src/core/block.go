@@ -2,93 +2,106 @@ package core
 
 import (
 	"bytes"
-	"crypto/sha256"
-	"encoding/gob"
-	"log"
-	"time"
+	"context"
+	"fmt"
 )
 
 type Block struct {
-	// 创建时间戳
-	Timestamp int64
+	// 区块头，见 block_header.go
+	BlockHeader
 	// 区块数据（这里指的是交易信息）
 	Transactions []*Transaction
-	// 前一个区块hash
-	PreHash []byte
-	// 当前区块hash，用于校验区块数据有效性
-	Hash []byte
-	// 工作量
-	Nonce int
 }
 
-// 创建block
-func NewBlock(transactions []*Transaction, preHash []byte) *Block {
-	block := &Block{time.Now().Unix(), transactions, preHash, []byte{}, 0}
-
-	// 挖矿过程，计算一个特殊的满足要求的数值
-	pow := NewProofOfWork(block)
-	nonce, hash := pow.Run()
-
-	block.Hash = hash[:]
-	block.Nonce = nonce
+// 创建还没有封装的区块，Hash、Nonce 等字段由共识引擎的 Seal 填充
+func newUnminedBlock(timestamp int64, transactions []*Transaction, preHash []byte, height int, bits uint32) *Block {
+	block := &Block{BlockHeader{timestamp, nil, nil, preHash, []byte{}, 0, height, bits, nil}, transactions}
+	block.setTxCommitments()
 	return block
 }
 
-// 创世纪区块
-func NewGenesisBlock(genesis *Transaction) *Block {
-	return NewBlock([]*Transaction{genesis}, []byte{})
+// 创世纪区块，由共识引擎封装
+func NewGenesisBlock(genesis *Transaction, timestamp int64, engine ConsensusEngine) (*Block, error) {
+	bits, err := engine.CalcDifficulty(nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	block := newUnminedBlock(timestamp, []*Transaction{genesis}, []byte{}, 0, bits)
+	if err := engine.Seal(context.Background(), nil, block); err != nil {
+		return nil, err
+	}
+	return block, nil
 }
 
 // block序列化
-// 选择 encoding/gob，是因为简单，而且也是go标准库的一部分
+// 使用规范的二进制编码，格式见 encoding.go
 func (block *Block) SerializeBlock() []byte {
-	// 定义一个 buffer 存储序列化之后的数据
-	var result bytes.Buffer
-	encoder := gob.NewEncoder(&result)
-
-	// 序列化区块到buffer中
-	err := encoder.Encode(block)
-	if err != nil {
-		log.Panic(err)
-	}
-	return result.Bytes()
+	var e encoder
+	e.version()
+	block.encode(&e)
+	return e.buf.Bytes()
 }
 
 // 反序列化block
-func DeserializeBlock(data []byte) *Block {
-	reader := bytes.NewReader(data)
-	decoder := gob.NewDecoder(reader)
-
-	// 反序列化到block
+func DeserializeBlock(data []byte) (*Block, error) {
 	var block Block
-	err := decoder.Decode(&block)
-	if err != nil {
-		log.Panic(err)
+	d := decoder{data: data}
+	d.version()
+	block.decode(&d)
+	if err := d.finish(); err != nil {
+		return nil, fmt.Errorf("decode block: %w", err)
 	}
-	return &block
+	return &block, nil
 }
 
-// 序列化交易列表
+// 序列化交易列表：交易个数 + 交易
 func (block *Block) SerializeTransactions() []byte {
-	// 定义一个 buffer 存储序列化之后的数据
-	var result bytes.Buffer
-	encoder := gob.NewEncoder(&result)
-
-	// 序列化区块到buffer中
-	err := encoder.Encode(block.Transactions)
-	if err != nil {
-		log.Panic(err)
+	var e encoder
+	e.version()
+	e.uvarint(uint64(len(block.Transactions)))
+	for _, tx := range block.Transactions {
+		tx.encode(&e)
 	}
-	return result.Bytes()
+	return e.buf.Bytes()
 }
 
-// 对交易ID的集合进行sha256
-func (b *Block) HashTransactions() []byte {
+// 区块中交易ID构成的 Merkle 树
+func (b *Block) MerkleTree() *MerkleTree {
 	var txHashes [][]byte
 
 	for _, tx := range b.Transactions {
 		txHashes = append(txHashes, tx.ID)
 	}
-	txHash := sha256.Sum256(bytes.Join(txHashes, []byte{}))
-	return txHash[:]
+	return NewMerkleTree(txHashes)
+}
+
+// 交易的 Merkle 根，作为交易摘要参与工作量证明
+func (b *Block) HashTransactions() []byte {
+	return b.MerkleTree().Root()
+}
+
+// 交易完整序列化的 Merkle 根，叶子节点是每笔交易的 WitnessHash
+func (b *Block) HashWitnesses() []byte {
+	var hashes [][]byte
+
+	for _, tx := range b.Transactions {
+		hashes = append(hashes, tx.WitnessHash())
+	}
+	return NewMerkleTree(hashes).Root()
+}
+
+// 交易变化后重新计算区块头中的两个 Merkle 根
+func (b *Block) setTxCommitments() {
+	b.TxHash = b.HashTransactions()
+	b.WitnessHash = b.HashWitnesses()
+}
+
+// 交易在区块中的位置，区块中没有这笔交易时返回 -1
+func (b *Block) TransactionIndex(ID []byte) int {
+	for i, tx := range b.Transactions {
+		if bytes.Equal(tx.ID, ID) {
+			return i
+		}
+	}
+	return -1
 }
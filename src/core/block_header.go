@@ -0,0 +1,150 @@
+package core
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/boltdb/bolt"
+)
+
+// 区块头单独保存在这个 bucket 中，遍历链、计算难度和同步时只需要读取区块头，不必解码交易
+const headersBucket = "headers"
+
+// 区块头，包含参与工作量证明的全部字段
+type BlockHeader struct {
+	// 创建时间戳
+	Timestamp int64
+	// 交易的 Merkle 根，参与工作量证明的计算，校验时必须和 Transactions 一致
+	TxHash []byte
+	// 交易完整序列化的 Merkle 根，同样参与工作量证明
+	// 交易ID不包含 ScriptSig，只有 TxHash 时区块没有承诺交易的签名，转发区块的节点可以替换签名而不改变区块hash
+	WitnessHash []byte
+	// 前一个区块hash
+	PreHash []byte
+	// 当前区块hash，用于校验区块数据有效性
+	Hash []byte
+	// 工作量
+	Nonce int
+	// 区块高度，创世区块为0，节点间同步时用于比较链的长短
+	Height int
+	// 紧凑格式的难度目标，由共识规则根据前面区块的时间戳计算
+	Bits uint32
+	// PoA 共识下出块者对 Hash 的签名，工作量证明下为空
+	Signature []byte
+}
+
+// 计算区块 hash 使用的数据
+func (h *BlockHeader) hashData(nonce int) []byte {
+	return bytes.Join(
+		[][]byte{
+			h.PreHash,
+			h.TxHash,
+			h.WitnessHash,
+			Int2Hex(h.Timestamp),
+			Int2Hex(int64(h.Bits)),
+			Int2Hex(int64(nonce)),
+		}, []byte{},
+	)
+}
+
+// 区块头序列化
+func (h *BlockHeader) Serialize() []byte {
+	var e encoder
+	e.version()
+	h.encode(&e)
+	return e.buf.Bytes()
+}
+
+// 反序列化区块头
+func DeserializeBlockHeader(data []byte) (*BlockHeader, error) {
+	var header BlockHeader
+	d := decoder{data: data}
+	d.version()
+	header.decode(&d)
+	if err := d.finish(); err != nil {
+		return nil, fmt.Errorf("decode block header: %w", err)
+	}
+	return &header, nil
+}
+
+// 根据hash获取区块头
+func (bc *Blockchain) GetBlockHeader(hash []byte) (*BlockHeader, error) {
+	var header *BlockHeader
+
+	err := bc.Db.View(func(tx *bolt.Tx) error {
+		var err error
+		header, err = getBlockHeader(tx, hash)
+		return err
+	})
+
+	return header, err
+}
+
+// 在数据库事务 tx 中读取区块头，不存在时返回 ErrBlockNotFound
+func getBlockHeader(tx *bolt.Tx, hash []byte) (*BlockHeader, error) {
+	data := tx.Bucket([]byte(headersBucket)).Get(hash)
+	if data == nil {
+		return nil, fmt.Errorf("%w: %x", ErrBlockNotFound, hash)
+	}
+	return DeserializeBlockHeader(data)
+}
+
+// 保存区块，同时把区块头写入 headers bucket
+func putBlock(tx *bolt.Tx, block *Block) error {
+	if err := tx.Bucket([]byte(blocksBucket)).Put(block.Hash, block.SerializeBlock()); err != nil {
+		return err
+	}
+	return tx.Bucket([]byte(headersBucket)).Put(block.Hash, block.BlockHeader.Serialize())
+}
+
+// 旧版本创建的数据库没有 headers bucket，打开时从已保存的区块中补建
+func ensureBlockHeaders(tx *bolt.Tx) error {
+	if tx.Bucket([]byte(headersBucket)) != nil {
+		return nil
+	}
+	headers, err := tx.CreateBucket([]byte(headersBucket))
+	if err != nil {
+		return err
+	}
+
+	return tx.Bucket([]byte(blocksBucket)).ForEach(func(k, v []byte) error {
+		if bytes.Equal(k, []byte("last")) {
+			return nil
+		}
+		block, err := DeserializeBlock(v)
+		if err != nil {
+			return err
+		}
+		return headers.Put(k, block.BlockHeader.Serialize())
+	})
+}
+
+// 只遍历区块头的迭代器，从 tip 开始向创世区块方向迭代
+type HeaderIterator struct {
+	currentHash []byte
+	db          *bolt.DB
+}
+
+func (bc *Blockchain) HeaderIterator() *HeaderIterator {
+	return &HeaderIterator{bc.tip, bc.Db}
+}
+
+// 返回链中下一个区块头，已经到达创世区块之前时返回 nil
+func (i *HeaderIterator) Next() (*BlockHeader, error) {
+	if len(i.currentHash) == 0 {
+		return nil, nil
+	}
+
+	var header *BlockHeader
+	err := i.db.View(func(tx *bolt.Tx) error {
+		var err error
+		header, err = getBlockHeader(tx, i.currentHash)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	i.currentHash = header.PreHash
+	return header, nil
+}
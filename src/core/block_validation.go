@@ -0,0 +1,369 @@
+package core
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	// 区块时间戳最多比本地时间超前2小时
+	maxFutureBlockTime = 2 * 60 * 60
+	// 区块时间戳必须大于前面这么多个区块时间戳的中位数
+	medianTimeBlocks = 11
+)
+
+// 每条共识规则对应一个错误，都包装了 ErrInvalidBlock，可以用 errors.Is 区分具体的失败原因
+var (
+	// 第一笔交易不是奖励交易，或者区块中有多笔奖励交易
+	ErrBadRewardTx = fmt.Errorf("%w: reward transaction must be the first and only one", ErrInvalidBlock)
+	// 奖励交易的金额超过了区块奖励加手续费
+	ErrBadRewardAmount = fmt.Errorf("%w: reward exceeds subsidy plus fees", ErrInvalidBlock)
+	// 区块内的多笔交易花费了同一个输出
+	ErrDoubleSpend = fmt.Errorf("%w: output is spent twice in the block", ErrInvalidBlock)
+	// 输入引用的输出不存在或已经被花费
+	ErrMissingInput = fmt.Errorf("%w: input refers to a missing or spent output", ErrInvalidBlock)
+	// 交易的输出总额大于输入总额
+	ErrInsufficientInput = fmt.Errorf("%w: outputs exceed inputs", ErrInvalidBlock)
+	// 金额为负数或者超过 MaxMoney
+	ErrBadValue = fmt.Errorf("%w: value out of range", ErrInvalidBlock)
+	// 交易签名无效
+	ErrBadSignature = fmt.Errorf("%w: invalid transaction signature", ErrInvalidBlock)
+	// 交易的锁定时间或者输入的相对锁定还没有到期
+	ErrNonFinalTx = fmt.Errorf("%w: transaction is not final", ErrInvalidBlock)
+	// 区块高度和父区块不连续
+	ErrBadHeight = fmt.Errorf("%w: height does not follow parent", ErrInvalidBlock)
+	// 时间戳不晚于前面区块的中位时间，或者超前本地时间太多
+	ErrBadTimestamp = fmt.Errorf("%w: timestamp out of bounds", ErrInvalidBlock)
+	// 区块头中的交易摘要和区块中的交易不一致
+	ErrBadTxCommitment = fmt.Errorf("%w: transaction commitment mismatch", ErrInvalidBlock)
+	// 交易ID和交易内容不一致
+	ErrBadTxID = fmt.Errorf("%w: transaction id does not match its content", ErrInvalidBlock)
+	// 工作量证明不满足共识规则要求的目标
+	ErrBadProofOfWork = fmt.Errorf("%w: proof of work does not meet the target", ErrInvalidBlock)
+)
+
+// ValidateBlock 按共识规则校验区块
+// 区块头相关的规则（父区块、高度、时间戳、共识引擎的封装）和区块内部的规则对任何区块都会检查；
+// 输入是否未花费依赖 UTXO 集，只有区块接在当前 tip 之后时才能检查，分叉上的区块在重组连接前检查
+func (bc *Blockchain) ValidateBlock(block *Block) error {
+	return bc.Db.View(func(tx *bolt.Tx) error {
+		if err := bc.checkBlockHeader(tx, block); err != nil {
+			return err
+		}
+		if err := checkBlockSanity(block); err != nil {
+			return err
+		}
+
+		tip := tx.Bucket([]byte(blocksBucket)).Get([]byte("last"))
+		if !bytes.Equal(block.PreHash, tip) {
+			return nil
+		}
+		return bc.checkBlockTransactions(tx, block)
+	})
+}
+
+// 检查区块头：父区块已知且有效，高度连续，时间戳在允许范围内，封装满足共识引擎的规则
+func (bc *Blockchain) checkBlockHeader(tx *bolt.Tx, block *Block) error {
+	index := tx.Bucket([]byte(blockIndexBucket))
+
+	parentData := index.Get(block.PreHash)
+	if parentData == nil {
+		return ErrOrphanBlock
+	}
+	parent, err := deserializeBlockIndex(parentData)
+	if err != nil {
+		return err
+	}
+	if parent.Invalid {
+		return fmt.Errorf("%w: parent block %x is invalid", ErrInvalidBlock, block.PreHash)
+	}
+	if block.Height != parent.Height+1 {
+		return fmt.Errorf("%w: height %d, parent height %d", ErrBadHeight, block.Height, parent.Height)
+	}
+
+	medianTime, err := calcPastMedianTime(tx, block.PreHash)
+	if err != nil {
+		return err
+	}
+	if block.Timestamp <= medianTime {
+		return fmt.Errorf("%w: %d is not after median time %d", ErrBadTimestamp, block.Timestamp, medianTime)
+	}
+	if maxTime := time.Now().Unix() + maxFutureBlockTime; block.Timestamp > maxTime {
+		return fmt.Errorf("%w: %d is too far in the future", ErrBadTimestamp, block.Timestamp)
+	}
+
+	return bc.Engine.VerifySeal(txHeaderReader{tx}, &block.BlockHeader)
+}
+
+// 不依赖链上状态的检查：奖励交易的位置、交易摘要、区块内的重复花费
+func checkBlockSanity(block *Block) error {
+	if len(block.Transactions) == 0 || !block.Transactions[0].IsRewardTx() {
+		return fmt.Errorf("%w: first transaction is not a reward transaction", ErrBadRewardTx)
+	}
+
+	if !bytes.Equal(block.TxHash, block.HashTransactions()) {
+		return fmt.Errorf("%w: block %x", ErrBadTxCommitment, block.Hash)
+	}
+	if !bytes.Equal(block.WitnessHash, block.HashWitnesses()) {
+		return fmt.Errorf("%w: witness root of block %x", ErrBadTxCommitment, block.Hash)
+	}
+
+	for _, transaction := range block.Transactions {
+		if !bytes.Equal(transaction.ID, transaction.Hash()) {
+			return fmt.Errorf("%w: %x", ErrBadTxID, transaction.ID)
+		}
+	}
+
+	spent := make(map[string]bool)
+	for _, transaction := range block.Transactions[1:] {
+		if transaction.IsRewardTx() {
+			return fmt.Errorf("%w: %x is an extra reward transaction", ErrBadRewardTx, transaction.ID)
+		}
+
+		for _, vin := range transaction.Vin {
+			key := string(outpointKey(vin.Txid, vin.Vout))
+			if spent[key] {
+				return fmt.Errorf("%w: %x:%d", ErrDoubleSpend, vin.Txid, vin.Vout)
+			}
+			spent[key] = true
+		}
+	}
+
+	return nil
+}
+
+// 检查区块中的交易，要求 UTXO 集正好处于父区块之后的状态
+// 输入必须引用 UTXO 集中或者区块内前面交易产生的输出，签名有效，输出总额不超过输入总额，
+// 交易的锁定时间和输入的相对锁定已经到期，
+// 奖励交易的金额不超过区块奖励加上所有交易的手续费
+func (bc *Blockchain) checkBlockTransactions(tx *bolt.Tx, block *Block) error {
+	b := tx.Bucket([]byte(utxoBucket))
+	// 区块内前面的交易，后面的交易可以花费它们的输出
+	blockTXs := make(map[string]Transaction)
+
+	medianTime, err := calcPastMedianTime(tx, block.PreHash)
+	if err != nil {
+		return err
+	}
+	for _, transaction := range block.Transactions {
+		if err := transaction.checkLockTime(block.Height, medianTime); err != nil {
+			return fmt.Errorf("%w: %x: %v", ErrNonFinalTx, transaction.ID, err)
+		}
+	}
+
+	fees := 0
+	for _, transaction := range block.Transactions[1:] {
+		// 输入花费的输出直接从 UTXO 集的记录中读取金额和锁定脚本，不需要回溯区块查找完整的交易
+		var prevOuts []TXOutput
+		var prevHeights []int
+		in := 0
+
+		for _, vin := range transaction.Vin {
+			var out TXOutput
+			if prevTX, ok := blockTXs[hex.EncodeToString(vin.Txid)]; ok && vin.Vout >= 0 && vin.Vout < len(prevTX.Vout) {
+				out = prevTX.Vout[vin.Vout]
+				prevHeights = append(prevHeights, block.Height)
+			} else {
+				outBytes := b.Get(outpointKey(vin.Txid, vin.Vout))
+				if outBytes == nil {
+					return fmt.Errorf("%w: %x spends %x:%d", ErrMissingInput, transaction.ID, vin.Txid, vin.Vout)
+				}
+				entry, err := DeserializeUTXOEntry(outBytes)
+				if err != nil {
+					return err
+				}
+				out = entry.Out
+				prevHeights = append(prevHeights, entry.Height)
+			}
+			prevOuts = append(prevOuts, out)
+
+			in += out.Value
+			if !MoneyRange(out.Value) || !MoneyRange(in) {
+				return fmt.Errorf("%w: %x has inputs of more than %d", ErrBadValue, transaction.ID, MaxMoney)
+			}
+		}
+
+		if err := transaction.checkSequenceLocks(prevHeights, block.Height); err != nil {
+			return fmt.Errorf("%w: %x: %v", ErrNonFinalTx, transaction.ID, err)
+		}
+		if err := transaction.verifyInputs(prevOuts); err != nil {
+			return fmt.Errorf("%w: transaction %x: %v", ErrBadSignature, transaction.ID, err)
+		}
+
+		out := 0
+		for _, vout := range transaction.Vout {
+			if !MoneyRange(vout.Value) {
+				return fmt.Errorf("%w: %x has an output of %d", ErrBadValue, transaction.ID, vout.Value)
+			}
+			out += vout.Value
+			if !MoneyRange(out) {
+				return fmt.Errorf("%w: %x has outputs of more than %d", ErrBadValue, transaction.ID, MaxMoney)
+			}
+		}
+		if out > in {
+			return fmt.Errorf("%w: %x spends %d but only has %d", ErrInsufficientInput, transaction.ID, out, in)
+		}
+		fees += in - out
+		if !MoneyRange(fees) {
+			return fmt.Errorf("%w: fees of more than %d", ErrBadValue, MaxMoney)
+		}
+
+		blockTXs[hex.EncodeToString(transaction.ID)] = *transaction
+	}
+
+	claimed := 0
+	for _, out := range block.Transactions[0].Vout {
+		if !MoneyRange(out.Value) {
+			return fmt.Errorf("%w: reward output of %d", ErrBadRewardAmount, out.Value)
+		}
+		claimed += out.Value
+		if !MoneyRange(claimed) {
+			return fmt.Errorf("%w: claims more than %d", ErrBadRewardAmount, MaxMoney)
+		}
+	}
+	if allowed := bc.Params.BlockSubsidy(block.Height) + fees; claimed > allowed {
+		return fmt.Errorf("%w: claims %d, allowed %d", ErrBadRewardAmount, claimed, allowed)
+	}
+
+	return nil
+}
+
+// 检查接在 tip 之后、还没有封装的区块，使用 ProcessBlock 对区块内部和区块内交易的规则
+// 区块头的工作量证明或签名在封装之后才有，由 ProcessBlock 检查
+func (bc *Blockchain) checkBlockTemplate(block *Block) error {
+	if err := checkBlockSanity(block); err != nil {
+		return err
+	}
+	return bc.Db.View(func(tx *bolt.Tx) error {
+		return bc.checkBlockTransactions(tx, block)
+	})
+}
+
+// 按 ProcessBlock 对区块内交易的规则，从 transactions 中选出可以一起打包进接在 tip 之后的区块的交易
+// 整体通过校验时全部保留，否则按顺序逐笔加入，丢弃加入后不能通过校验的交易
+// 交易之间有依赖时，被依赖的交易需要排在前面
+func (bc *Blockchain) selectValidTransactions(transactions []*Transaction) (valid, invalid []*Transaction, err error) {
+	// 只用来占据区块第一笔交易位置的奖励交易，没有输出
+	reward := &Transaction{Vin: []TXInput{NewRewardTxin("template")}}
+	reward.SetID()
+
+	err = bc.Db.View(func(tx *bolt.Tx) error {
+		tip := tx.Bucket([]byte(blocksBucket)).Get([]byte("last"))
+		parent, err := getBlockHeader(tx, tip)
+		if err != nil {
+			return err
+		}
+		check := func(txs []*Transaction) error {
+			block := &Block{BlockHeader: BlockHeader{PreHash: tip, Height: parent.Height + 1}}
+			block.Transactions = append([]*Transaction{reward}, txs...)
+			block.setTxCommitments()
+			if err := checkBlockSanity(block); err != nil {
+				return err
+			}
+			return bc.checkBlockTransactions(tx, block)
+		}
+
+		err = check(transactions)
+		if err == nil || !errors.Is(err, ErrInvalidBlock) {
+			valid = transactions
+			return err
+		}
+		for _, transaction := range transactions {
+			err := check(append(valid[:len(valid):len(valid)], transaction))
+			if err != nil && !errors.Is(err, ErrInvalidBlock) {
+				return err
+			}
+			if err != nil {
+				invalid = append(invalid, transaction)
+				continue
+			}
+			valid = append(valid, transaction)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return valid, invalid, nil
+}
+
+// 计算 hash 对应区块及其之前共 medianTimeBlocks 个区块时间戳的中位数
+func calcPastMedianTime(tx *bolt.Tx, hash []byte) (int64, error) {
+	var timestamps []int64
+	for len(hash) > 0 && len(timestamps) < medianTimeBlocks {
+		header, err := getBlockHeader(tx, hash)
+		if err != nil {
+			return 0, err
+		}
+		timestamps = append(timestamps, header.Timestamp)
+		hash = header.PreHash
+	}
+
+	sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+	return timestamps[len(timestamps)/2], nil
+}
+
+// 用来回滚 VerifyChain 的事务
+var errVerifyRollback = errors.New("rollback")
+
+// VerifyChain 从创世区块开始按当前的共识规则重新校验主链上的所有区块，返回第一个不通过的区块的错误
+// 在事务中从空的 UTXO 集开始依次连接区块，最后回滚事务，不修改数据库
+// 创世区块由链参数确定，只检查区块内部的规则
+func (bc *Blockchain) VerifyChain() error {
+	err := bc.Db.Update(func(tx *bolt.Tx) error {
+		err := tx.DeleteBucket([]byte(utxoBucket))
+		if err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+		if _, err := tx.CreateBucket([]byte(utxoBucket)); err != nil {
+			return err
+		}
+
+		var mainChain [][]byte
+		for hash := tx.Bucket([]byte(blocksBucket)).Get([]byte("last")); len(hash) > 0; {
+			header, err := getBlockHeader(tx, hash)
+			if err != nil {
+				return err
+			}
+			mainChain = append(mainChain, header.Hash)
+			hash = header.PreHash
+		}
+
+		for i := len(mainChain) - 1; i >= 0; i-- {
+			block, err := getBlock(tx, mainChain[i])
+			if err != nil {
+				return err
+			}
+			genesis := i == len(mainChain)-1
+			if !genesis {
+				if err := bc.checkBlockHeader(tx, block); err != nil {
+					return fmt.Errorf("block %x at height %d: %w", block.Hash, block.Height, err)
+				}
+			}
+			if err := checkBlockSanity(block); err != nil {
+				return fmt.Errorf("block %x at height %d: %w", block.Hash, block.Height, err)
+			}
+			if !genesis {
+				if err := bc.checkBlockTransactions(tx, block); err != nil {
+					return fmt.Errorf("block %x at height %d: %w", block.Hash, block.Height, err)
+				}
+			}
+			if err := (UTXOSet{bc}).connectBlock(tx, block); err != nil {
+				return fmt.Errorf("block %x at height %d: %w", block.Hash, block.Height, err)
+			}
+		}
+
+		return errVerifyRollback
+	})
+	if err == errVerifyRollback {
+		return nil
+	}
+	return err
+}
@@ -2,22 +2,27 @@ package core
 
 import (
 	"bytes"
+	"context"
 	"crypto/ecdsa"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"github.com/boltdb/bolt"
-	"log"
 	"os"
+	"time"
 )
 
-const dbFile = "blockchain.db"
+// 数据库文件由链参数决定，同一台机器上运行多个节点时，每个节点使用独立的数据库文件，见 chain_params.go
 const blocksBucket = "blocks"
-const genesisData = "genesis"
 
-// 挖出新块的奖励金。在比特币中，实际并没有存储这个数字，而是基于区块总数进行计算而得
-// 挖出创世块的奖励是 50 BTC，每挖出 210000 个块后，奖励减半
-const subsidy = 10
+var (
+	// 数据库中没有这个区块
+	ErrBlockNotFound = errors.New("block is not found")
+	// 链上没有这笔交易
+	ErrTxNotFound = errors.New("transaction is not found")
+	// 还没有创建区块链
+	ErrNoChain = errors.New("no existing blockchain found, create one first")
+)
 
 type Blockchain struct {
 	// 不在里面存储所有的区块了，而是仅存储区块链的 tip
@@ -25,40 +30,191 @@ type Blockchain struct {
 	tip []byte
 	// 存储数据库连接，一旦打开，就要一直运行到程序结束
 	Db *bolt.DB
+	// 链参数，决定区块奖励、最低难度、地址前缀等，见 chain_params.go
+	Params *ChainParams
+	// 链使用的共识引擎，创建链时选定，见 consensus.go
+	Engine ConsensusEngine
 }
 
 // 添加数据到链条
-func (bc *Blockchain) AddBlock(transactions []*Transaction) *Block {
+// 封装前按 ProcessBlock 的规则检查区块内容，transactions 的第一笔必须是奖励交易，有交易不能打包时返回错误，
+// 区块由共识引擎封装后写入数据库，同时更新 UTXO 集
+func (bc *Blockchain) AddBlock(transactions []*Transaction) (*Block, error) {
+	preHash, height, bits, timestamp, err := bc.nextBlockParams()
+	if err != nil {
+		return nil, err
+	}
+	newBlock := newUnminedBlock(timestamp, transactions, preHash, height, bits)
+	if err := bc.checkBlockTemplate(newBlock); err != nil {
+		return nil, err
+	}
+	if err := bc.Engine.Seal(context.Background(), bc, newBlock); err != nil {
+		return nil, err
+	}
+	if err := bc.putBlock2Db(newBlock); err != nil {
+		return nil, err
+	}
+	return newBlock, nil
+}
+
+// 在当前 tip 之后创建区块模板：奖励交易加上 transactions，还没有进行工作量证明
+// fees 是 transactions 的手续费总额，和区块奖励一起支付给 rewardAddress
+func (bc *Blockchain) NewBlockTemplate(rewardAddress string, transactions []*Transaction, fees int) (*Block, error) {
+	preHash, height, bits, timestamp, err := bc.nextBlockParams()
+	if err != nil {
+		return nil, err
+	}
+	rewardTx, err := NewRewardTX(bc.Params, rewardAddress, "", bc.Params.BlockSubsidy(height)+fees)
+	if err != nil {
+		return nil, err
+	}
+
+	return newUnminedBlock(timestamp, append([]*Transaction{rewardTx}, transactions...), preHash, height, bits), nil
+}
+
+// 接在 tip 之后的区块需要的参数，在同一个数据库事务中读取，避免其他 goroutine 同时修改 tip
+// 时间戳必须晚于前面区块的中位时间，本地时间落后时使用中位时间加1秒
+func (bc *Blockchain) nextBlockParams() (preHash []byte, height int, bits uint32, timestamp int64, err error) {
+	timestamp = time.Now().Unix()
+	err = bc.Db.View(func(tx *bolt.Tx) error {
+		preHash = append([]byte{}, tx.Bucket([]byte(blocksBucket)).Get([]byte("last"))...)
+		parent, err := getBlockHeader(tx, preHash)
+		if err != nil {
+			return err
+		}
+		height = parent.Height + 1
+		if bits, err = bc.Engine.CalcDifficulty(txHeaderReader{tx}, preHash); err != nil {
+			return err
+		}
+		medianTime, err := calcPastMedianTime(tx, preHash)
+		if err != nil {
+			return err
+		}
+		if timestamp <= medianTime {
+			timestamp = medianTime + 1
+		}
+		return nil
+	})
+
+	return
+}
+
+// 判断区块是否已经存在于数据库中
+func (bc *Blockchain) HasBlock(hash []byte) bool {
+	var exists bool
+	_ = bc.Db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(blocksBucket))
+		exists = b.Get(hash) != nil
+		return nil
+	})
+
+	return exists
+}
+
+// 根据hash获取区块，区块可以在分叉上
+func (bc *Blockchain) GetBlockByHash(hash []byte) (*Block, error) {
+	var block *Block
+
+	err := bc.Db.View(func(tx *bolt.Tx) error {
+		var err error
+		block, err = getBlock(tx, hash)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return block, nil
+}
+
+// 返回 fromHash 之后直到tip的所有区块hash，按从旧到新的顺序排列
+// 如果 fromHash 不在链上，则从创世区块开始返回
+func (bc *Blockchain) GetBlockHashes(fromHash []byte) ([][]byte, error) {
+	var hashes [][]byte
+	hi := bc.HeaderIterator()
+
+	for {
+		header, err := hi.Next()
+		if err != nil {
+			return nil, err
+		}
+		if header == nil || bytes.Equal(header.Hash, fromHash) {
+			break
+		}
+		hashes = append(hashes, header.Hash)
+	}
+
+	for i, j := 0, len(hashes)-1; i < j; i, j = i+1, j-1 {
+		hashes[i], hashes[j] = hashes[j], hashes[i]
+	}
+
+	return hashes, nil
+}
+
+// 交易的手续费，即输入总额减去输出总额
+func (bc *Blockchain) CalcTxFee(tx *Transaction) (int, error) {
+	if tx.IsRewardTx() {
+		return 0, nil
+	}
+
+	prevTXs, err := bc.findPrevTransactions(tx)
+	if err != nil {
+		return 0, err
+	}
+
+	return tx.Fee(prevTXs)
+}
 
+// 挖出包含 transactions 的下一个区块可以获得的奖励：区块奖励加上所有交易的手续费
+func (bc *Blockchain) MinerReward(transactions []*Transaction) (int, error) {
+	height, err := bc.Height()
+	if err != nil {
+		return 0, err
+	}
+
+	reward := bc.Params.BlockSubsidy(height + 1)
 	for _, tx := range transactions {
-		if bc.VerifyTransaction(tx) != true {
-			log.Panic("ERROR: Invalid transaction")
+		fee, err := bc.CalcTxFee(tx)
+		if err != nil {
+			return 0, err
 		}
+		reward += fee
 	}
 
-	lastHash := bc.getLastHash()
-	newBlock := NewBlock(transactions, lastHash)
-	bc.putBlock2Db(newBlock)
-	return newBlock
+	return reward, nil
 }
 
 // VerifyTransaction verifies transaction input signatures
-func (bc *Blockchain) VerifyTransaction(tx *Transaction) bool {
+// 签名无效时返回包装了 ErrInvalidTx 的错误
+func (bc *Blockchain) VerifyTransaction(tx *Transaction) error {
 	if tx.IsRewardTx() {
-		return true
+		return nil
+	}
+
+	prevTXs, err := bc.findPrevTransactions(tx)
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Verify(prevTXs); err != nil {
+		return fmt.Errorf("%w: transaction %x: %v", ErrInvalidTx, tx.ID, err)
 	}
+	return nil
+}
 
+// 查找交易的所有输入引用的交易，key 为交易ID的十六进制
+func (bc *Blockchain) findPrevTransactions(tx *Transaction) (map[string]Transaction, error) {
 	prevTXs := make(map[string]Transaction)
 
 	for _, vin := range tx.Vin {
 		prevTX, err := bc.FindTransaction(vin.Txid)
 		if err != nil {
-			log.Panic(err)
+			return nil, err
 		}
 		prevTXs[hex.EncodeToString(prevTX.ID)] = prevTX
 	}
 
-	return tx.Verify(prevTXs)
+	return prevTXs, nil
 }
 
 // 获取数据库中最后一个区块的hash
@@ -66,81 +222,237 @@ func (bc *Blockchain) getLastHash() []byte {
 	var lastHash []byte
 	_ = bc.Db.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(blocksBucket))
-		lastHash = b.Get([]byte("last"))
+		// bolt 返回的数据只在事务内有效，需要复制出来
+		lastHash = append([]byte{}, b.Get([]byte("last"))...)
 		return nil
 	})
 
 	return lastHash
 }
 
-func (bc *Blockchain) putBlock2Db(newBlock *Block) {
-	_ = bc.Db.Update(func(tx *bolt.Tx) error {
+// 把接在 tip 之后的新区块接入主链
+// 区块写入、tip 的移动、各个索引和 UTXO 集的更新在同一个数据库事务中完成，中途失败不会留下不一致的数据
+func (bc *Blockchain) putBlock2Db(newBlock *Block) error {
+	err := bc.Db.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(blocksBucket))
-		_ = b.Put(newBlock.Hash, newBlock.SerializeBlock())
-		_ = b.Put([]byte("last"), newBlock.Hash)
-		bc.tip = newBlock.Hash
-		return nil
+		if err := putBlock(tx, newBlock); err != nil {
+			return err
+		}
+		if err := b.Put([]byte("last"), newBlock.Hash); err != nil {
+			return err
+		}
+		if err := putBlockIndex(tx, bc.Engine, newBlock); err != nil {
+			return err
+		}
+		if err := putMainChainHeight(tx, newBlock); err != nil {
+			return err
+		}
+		if err := indexBlockTransactions(tx, newBlock); err != nil {
+			return err
+		}
+		return (UTXOSet{bc}).connectBlock(tx, newBlock)
 	})
+	if err != nil {
+		return err
+	}
+
+	// 事务提交成功之后才更新内存中的 tip，失败回滚时 tip 仍然和数据库一致
+	bc.tip = newBlock.Hash
+	return nil
 }
 
-// 创建一个新的区块链条
+// 创建一个新的区块链条，链已经存在时直接打开
 // 数据库选择，BoltDB。理由：简单、go实现、不需要单独运行服务、keyvalue形式的字节数据存储
-func NewBlockchain(address string) *Blockchain {
+// consensus 决定链使用的共识引擎，记录在创世区块中，之后不能修改
+func NewBlockchain(params *ChainParams, address, nodeID string, consensus ConsensusConfig) (*Blockchain, error) {
+	engine, err := NewConsensusEngine(params, consensus)
+	if err != nil {
+		return nil, err
+	}
+
 	var tip []byte
+	created := false
 	// 打开一个数据库文件
-	db, _ := bolt.Open(dbFile, 0600, nil)
+	db, err := bolt.Open(params.dbFileName(nodeID), 0600, nil)
+	if err != nil {
+		return nil, err
+	}
 
 	// 数据库操作通过一个事务（transaction）进行操作。有两种类型的事务：只读（read-only）和读写（read-write）
 	// 打开一个读写事务（db.Update(...)），因为我们可能会向数据库中添加创世块
-	_ = db.Update(func(tx *bolt.Tx) error {
+	err = db.Update(func(tx *bolt.Tx) error {
 
 		// 读取存储区块的bucket
 		b := tx.Bucket([]byte(blocksBucket))
 
-		if b == nil {
-			// 创建存储区块的bucket，并将创世块保存进去
-			gtx := NewRewardTX(address, genesisData)
-			genesis := NewGenesisBlock(gtx)
-			b, _ := tx.CreateBucket([]byte(blocksBucket))
-			_ = b.Put(genesis.Hash, genesis.SerializeBlock())
-			// last键存储链最后一个区块的hash，用于快捷获取PreHash
-			_ = b.Put([]byte("last"), genesis.Hash)
-			tip = genesis.Hash
-		} else {
-			tip = b.Get([]byte("last"))
+		if b != nil {
+			tip = append([]byte{}, b.Get([]byte("last"))...)
+			if err := checkEncoding(tx); err != nil {
+				return err
+			}
+			// 链已经存在，沿用链上记录的共识
+			if err := checkChainParams(tx, params); err != nil {
+				return err
+			}
+			engine, err = loadConsensusEngine(tx, params)
+			return err
 		}
 
-		return nil
+		// 创建存储区块的bucket，并将创世块保存进去
+		genesis, err := newGenesisBlock(params, address, consensus, engine)
+		if err != nil {
+			return err
+		}
+		created = true
+
+		for _, bucket := range []string{blocksBucket, headersBucket, blockIndexBucket, heightIndexBucket} {
+			if _, err := tx.CreateBucket([]byte(bucket)); err != nil {
+				return err
+			}
+		}
+		if err := putBlock(tx, genesis); err != nil {
+			return err
+		}
+		// last键存储链最后一个区块的hash，用于快捷获取PreHash
+		if err := tx.Bucket([]byte(blocksBucket)).Put([]byte("last"), genesis.Hash); err != nil {
+			return err
+		}
+		if err := putBlockIndex(tx, engine, genesis); err != nil {
+			return err
+		}
+		if err := putMainChainHeight(tx, genesis); err != nil {
+			return err
+		}
+		if err := putConsensusConfig(tx, consensus); err != nil {
+			return err
+		}
+		if err := putEncodingVersion(tx); err != nil {
+			return err
+		}
+		meta, err := tx.CreateBucketIfNotExists([]byte(metaBucket))
+		if err != nil {
+			return err
+		}
+		tip = genesis.Hash
+		if err := meta.Put([]byte(genesisKey), genesis.Hash); err != nil {
+			return err
+		}
+		return meta.Put([]byte(networkKey), []byte(params.Name))
 	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	bc := &Blockchain{tip: tip, Db: db, Params: params, Engine: engine}
+
+	// 固定的创世区块的奖励无法花费，address 得到接在创世区块之后的第一个区块的奖励
+	if created && params.GenesisHash != "" {
+		if err := bc.mineFirstBlock(address); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+
+	return bc, nil
+}
+
+// 新链的创世区块，链参数指定了创世区块 hash 时使用固定的创世区块，只支持工作量证明
+// 否则奖励发给 address，共识配置记录在奖励交易中
+func newGenesisBlock(params *ChainParams, address string, consensus ConsensusConfig, engine ConsensusEngine) (*Block, error) {
+	if params.GenesisHash != "" {
+		if consensus.Engine != ConsensusPoW {
+			return nil, fmt.Errorf("network %s has a fixed %s genesis block, use a chain params file without genesisHash for %s", params.Name, ConsensusPoW, consensus.Engine)
+		}
+		return params.genesisBlock(engine)
+	}
 
-	bc := &Blockchain{tip, db}
+	data, err := genesisRewardData(params, consensus)
+	if err != nil {
+		return nil, err
+	}
+	gtx, err := NewRewardTX(params, address, data, params.BlockSubsidy(0))
+	if err != nil {
+		return nil, err
+	}
+	return NewGenesisBlock(gtx, time.Now().Unix(), engine)
+}
+
+// 在创世区块之后挖出第一个区块，奖励发给 address
+func (bc *Blockchain) mineFirstBlock(address string) error {
+	if err := (UTXOSet{bc}).Reindex(); err != nil {
+		return err
+	}
+	reward, err := NewRewardTX(bc.Params, address, "", bc.Params.BlockSubsidy(1))
+	if err != nil {
+		return err
+	}
+	_, err = bc.AddBlock([]*Transaction{reward})
+	return err
+}
 
-	return bc
+// 打开已有的链，数据库必须是用同一个网络的参数创建的，数据库不存在时返回 ErrNoChain
+func GetBlockchain(params *ChainParams, nodeID string) (*Blockchain, error) {
+	return openBlockchain(params, params.dbFileName(nodeID))
 }
 
-func GetBlockchain() *Blockchain {
+// 打开数据库文件 dbFile 中的链，补建旧版本没有的索引
+func openBlockchain(params *ChainParams, dbFile string) (*Blockchain, error) {
 	if dbExists(dbFile) == false {
-		fmt.Println("No existing blockchain found. Create one first.")
-		os.Exit(1)
+		return nil, ErrNoChain
 	}
 
 	var tip []byte
+	var engine ConsensusEngine
 	db, err := bolt.Open(dbFile, 0600, nil)
 	if err != nil {
-		log.Panic(err)
+		return nil, err
 	}
 
 	err = db.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(blocksBucket))
-		tip = b.Get([]byte("last"))
-		return nil
+		if b == nil {
+			return ErrNoChain
+		}
+		tip = append([]byte{}, b.Get([]byte("last"))...)
+		if err := checkEncoding(tx); err != nil {
+			return err
+		}
+		if err := ensureBlockHeaders(tx); err != nil {
+			return err
+		}
+		if err := checkChainParams(tx, params); err != nil {
+			return err
+		}
+		var err error
+		if engine, err = loadConsensusEngine(tx, params); err != nil {
+			return err
+		}
+		if err := ensureBlockIndex(tx, engine); err != nil {
+			return err
+		}
+		if err := ensureHeightIndex(tx); err != nil {
+			return err
+		}
+		return ensureAddrIndex(tx)
 	})
-
 	if err != nil {
-		log.Panic(err)
+		db.Close()
+		return nil, err
+	}
+
+	bc := Blockchain{tip: tip, Db: db, Params: params, Engine: engine}
+	// 旧版本的 chainstate 格式需要从区块重建
+	if err := (UTXOSet{&bc}).Migrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	// chainstate 和 tip 不一致时（旧版本分两个事务写入区块和更新 UTXO，中途退出会出现这种情况）从区块重建
+	if err := (UTXOSet{&bc}).Recover(); err != nil {
+		db.Close()
+		return nil, err
 	}
-	bc := Blockchain{tip, db}
-	return &bc
+	return &bc, nil
 }
 
 func dbExists(dbFile string) bool {
@@ -151,81 +463,77 @@ func dbExists(dbFile string) bool {
 }
 
 // FindUTXO finds all unspent transaction outputs and returns transactions with spent outputs removed
-func (bc *Blockchain) FindUTXO() map[string]TXOutputs {
+// 从创世区块开始向前重放主链：先删除输入花费的输出，再加入交易产生的输出
+func (bc *Blockchain) FindUTXO() (map[string]TXOutputs, error) {
 	UTXO := make(map[string]TXOutputs)
-	spentTXOs := make(map[string][]int)
-	bci := bc.Iterator()
-
-	for {
-		block := bci.Next()
+	bci := bc.ForwardIterator(0)
 
+	for block, ok := bci.Next(); ok; block, ok = bci.Next() {
 		for _, tx := range block.Transactions {
-			txID := hex.EncodeToString(tx.ID)
-
-		Outputs:
-			for outIdx, out := range tx.Vout {
-				// Was the output spent?
-				if spentTXOs[txID] != nil {
-					for _, spentOutIdx := range spentTXOs[txID] {
-						if spentOutIdx == outIdx {
-							continue Outputs
-						}
-					}
-				}
-
-				outs := UTXO[txID]
-				outs.Outputs = append(outs.Outputs, out)
-				UTXO[txID] = outs
-			}
-
 			if tx.IsRewardTx() == false {
 				for _, in := range tx.Vin {
 					inTxID := hex.EncodeToString(in.Txid)
-					spentTXOs[inTxID] = append(spentTXOs[inTxID], in.Vout)
+					if outs, ok := UTXO[inTxID]; ok {
+						delete(outs.Outputs, in.Vout)
+						if len(outs.Outputs) == 0 {
+							delete(UTXO, inTxID)
+						}
+					}
 				}
 			}
-		}
 
-		if len(block.PreHash) == 0 {
-			break
+			outs := TXOutputs{make(map[int]TXOutput), block.Height}
+			for outIdx, out := range tx.Vout {
+				outs.Outputs[outIdx] = out
+			}
+			UTXO[hex.EncodeToString(tx.ID)] = outs
 		}
 	}
+	if err := bci.Err(); err != nil {
+		return nil, err
+	}
 
-	return UTXO
+	return UTXO, nil
 }
 
 // SignTransaction signs inputs of a Transaction
-func (bc *Blockchain) SignTransaction(tx *Transaction, privKey ecdsa.PrivateKey) {
-	prevTXs := make(map[string]Transaction)
-
-	for _, vin := range tx.Vin {
-		prevTX, err := bc.FindTransaction(vin.Txid)
-		if err != nil {
-			log.Panic(err)
-		}
-		prevTXs[hex.EncodeToString(prevTX.ID)] = prevTX
+func (bc *Blockchain) SignTransaction(tx *Transaction, privKey ecdsa.PrivateKey) error {
+	prevTXs, err := bc.findPrevTransactions(tx)
+	if err != nil {
+		return err
 	}
 
-	tx.Sign(privKey, prevTXs)
+	return tx.Sign(privKey, prevTXs)
 }
 
 // FindTransaction finds a transaction by its ID
+// 启用了交易索引时直接从索引定位，否则从 tip 开始遍历整条链
 func (bc *Blockchain) FindTransaction(ID []byte) (Transaction, error) {
-	bci := bc.Iterator()
-
-	for {
-		block := bci.Next()
-
-		for _, tx := range block.Transactions {
-			if bytes.Compare(tx.ID, ID) == 0 {
-				return *tx, nil
-			}
-		}
+	var transaction Transaction
+	var indexed bool
+	err := bc.Db.View(func(tx *bolt.Tx) error {
+		var err error
+		transaction, indexed, err = lookupTransaction(tx, ID)
+		return err
+	})
+	if indexed {
+		return transaction, err
+	}
+	if err != nil {
+		return Transaction{}, err
+	}
 
-		if len(block.PreHash) == 0 {
-			break
-		}
+	bci := bc.RangeIterator(BlockRange{
+		To:      -1,
+		Reverse: true,
+		Filter:  func(block *Block) bool { return block.TransactionIndex(ID) >= 0 },
+	})
+	if block, ok := bci.Next(); ok {
+		return *block.Transactions[block.TransactionIndex(ID)], nil
+	}
+	if err := bci.Err(); err != nil {
+		return Transaction{}, err
 	}
 
-	return Transaction{}, errors.New("Transaction is not found")
+	return Transaction{}, fmt.Errorf("%w: %x", ErrTxNotFound, ID)
 }
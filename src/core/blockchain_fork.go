@@ -0,0 +1,341 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+
+	"github.com/boltdb/bolt"
+)
+
+// 区块索引，所有收到的区块（包括分叉上的区块）都会记录在这里
+const blockIndexBucket = "blockindex"
+
+var (
+	// 父区块未知，需要先从对方同步缺失的区块
+	ErrOrphanBlock = errors.New("orphan block")
+	// 区块没有通过校验
+	ErrInvalidBlock = errors.New("invalid block")
+)
+
+// 区块在索引中的信息
+type blockIndex struct {
+	Height int
+	// 从创世区块到该区块的累计工作量（big.Int 的字节表示），主链是累计工作量最大的链
+	ChainWork []byte
+	// 被 invalidateblock 标记为无效的区块，它和它的后代都不会再被连接到主链
+	Invalid bool
+}
+
+// 序列化，格式见 encoding.go
+func (idx blockIndex) serialize() []byte {
+	var e encoder
+	e.version()
+	idx.encode(&e)
+	return e.buf.Bytes()
+}
+
+func deserializeBlockIndex(data []byte) (blockIndex, error) {
+	var idx blockIndex
+
+	d := decoder{data: data}
+	d.version()
+	idx.decode(&d)
+	if err := d.finish(); err != nil {
+		return idx, fmt.Errorf("decode block index: %w", err)
+	}
+
+	return idx, nil
+}
+
+// 在数据库事务 tx 中读取区块索引，不存在时返回 ErrBlockNotFound
+func getBlockIndex(tx *bolt.Tx, hash []byte) (blockIndex, error) {
+	data := tx.Bucket([]byte(blockIndexBucket)).Get(hash)
+	if data == nil {
+		return blockIndex{}, fmt.Errorf("%w: %x", ErrBlockNotFound, hash)
+	}
+	return deserializeBlockIndex(data)
+}
+
+// 在数据库事务 tx 中读取区块，不存在时返回 ErrBlockNotFound
+func getBlock(tx *bolt.Tx, hash []byte) (*Block, error) {
+	data := tx.Bucket([]byte(blocksBucket)).Get(hash)
+	if data == nil {
+		return nil, fmt.Errorf("%w: %x", ErrBlockNotFound, hash)
+	}
+	return DeserializeBlock(data)
+}
+
+func (idx blockIndex) chainWork() *big.Int {
+	return new(big.Int).SetBytes(idx.ChainWork)
+}
+
+// 处理区块之后主链发生的变化
+type ChainChange struct {
+	// 新接入主链的区块，按高度从低到高排列
+	Connected []*Block
+	// 从主链上断开的区块，按高度从高到低排列
+	Disconnected []*Block
+}
+
+// 处理其他节点发来的区块
+// 区块先保存到数据库并记入索引，如果它所在分支的累计工作量超过当前主链，就切换到这条分支：
+// 断开主链上分叉点之后的区块，再依次连接新分支上的区块。
+// 区块写入、UTXO 集的回滚和重放以及 tip 的移动在同一个数据库事务中完成，任何一步失败都会整体回滚
+func (bc *Blockchain) ProcessBlock(block *Block) (*ChainChange, error) {
+	change := &ChainChange{}
+
+	err := bc.Db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(blocksBucket))
+		index := tx.Bucket([]byte(blockIndexBucket))
+
+		if b.Get(block.Hash) != nil {
+			return nil
+		}
+
+		if err := bc.checkBlockHeader(tx, block); err != nil {
+			return err
+		}
+		if err := checkBlockSanity(block); err != nil {
+			return err
+		}
+
+		parent, err := getBlockIndex(tx, block.PreHash)
+		if err != nil {
+			return err
+		}
+		chainWork := new(big.Int).Add(parent.chainWork(), bc.Engine.Work(&block.BlockHeader))
+		if err := putBlock(tx, block); err != nil {
+			return err
+		}
+		if err := index.Put(block.Hash, blockIndex{block.Height, chainWork.Bytes(), false}.serialize()); err != nil {
+			return err
+		}
+
+		tip := append([]byte{}, b.Get([]byte("last"))...)
+		tipIndex, err := getBlockIndex(tx, tip)
+		if err != nil {
+			return err
+		}
+		if chainWork.Cmp(tipIndex.chainWork()) <= 0 {
+			// 工作量没有超过主链，作为分叉保存下来
+			return nil
+		}
+
+		return bc.reorganize(tx, tip, block, change)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(change.Connected) > 0 {
+		bc.tip = change.Connected[len(change.Connected)-1].Hash
+	}
+	return change, nil
+}
+
+// 把主链从 tipHash 切换到以 newTip 结尾的分支
+// 新区块直接接在 tip 之后时，分叉点就是 tip，只需要连接这一个区块
+func (bc *Blockchain) reorganize(tx *bolt.Tx, tipHash []byte, newTip *Block, change *ChainChange) error {
+	b := tx.Bucket([]byte(blocksBucket))
+
+	// 从两端向前回溯，直到找到共同的祖先区块
+	var detach, attach []*Block
+	mainBlock, err := getBlock(tx, tipHash)
+	if err != nil {
+		return err
+	}
+	sideBlock := newTip
+	// 新分支上的区块都要检查是否已经被标记为无效，在断开主链上的任何区块之前返回错误
+	attachSide := func() error {
+		idx, err := getBlockIndex(tx, sideBlock.Hash)
+		if err != nil {
+			return err
+		}
+		if idx.Invalid {
+			return fmt.Errorf("%w: block %x is invalid", ErrInvalidBlock, sideBlock.Hash)
+		}
+		attach = append(attach, sideBlock)
+		sideBlock, err = getBlock(tx, sideBlock.PreHash)
+		return err
+	}
+	for mainBlock.Height > sideBlock.Height {
+		detach = append(detach, mainBlock)
+		if mainBlock, err = getBlock(tx, mainBlock.PreHash); err != nil {
+			return err
+		}
+	}
+	for sideBlock.Height > mainBlock.Height {
+		if err := attachSide(); err != nil {
+			return err
+		}
+	}
+	for !bytes.Equal(mainBlock.Hash, sideBlock.Hash) {
+		detach = append(detach, mainBlock)
+		if mainBlock, err = getBlock(tx, mainBlock.PreHash); err != nil {
+			return err
+		}
+		if err := attachSide(); err != nil {
+			return err
+		}
+	}
+
+	UTXOSet := UTXOSet{bc}
+	for _, block := range detach {
+		if err := UTXOSet.disconnectBlock(tx, block); err != nil {
+			return err
+		}
+		if err := deleteMainChainHeight(tx, block); err != nil {
+			return err
+		}
+		if err := unindexBlockTransactions(tx, block); err != nil {
+			return err
+		}
+	}
+
+	for i := len(attach) - 1; i >= 0; i-- {
+		block := attach[i]
+		if err := bc.checkBlockTransactions(tx, block); err != nil {
+			return err
+		}
+		if err := UTXOSet.connectBlock(tx, block); err != nil {
+			return err
+		}
+		if err := putMainChainHeight(tx, block); err != nil {
+			return err
+		}
+		if err := indexBlockTransactions(tx, block); err != nil {
+			return err
+		}
+		change.Connected = append(change.Connected, block)
+	}
+	change.Disconnected = detach
+
+	if len(detach) > 0 {
+		log.Printf("Reorganize: disconnected %d blocks, connected %d blocks, new tip %x\n", len(detach), len(attach), newTip.Hash)
+	}
+
+	return b.Put([]byte("last"), newTip.Hash)
+}
+
+// 把区块标记为无效，如果它在主链上，就把它和它之后的区块从主链上断开，tip 回退到它的父区块
+// 断开区块时使用撤销数据恢复 UTXO 集，所有修改在同一个数据库事务中完成
+func (bc *Blockchain) InvalidateBlock(hash []byte) (*ChainChange, error) {
+	change := &ChainChange{}
+	var newTip []byte
+
+	err := bc.Db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(blocksBucket))
+		index := tx.Bucket([]byte(blockIndexBucket))
+
+		idx, err := getBlockIndex(tx, hash)
+		if err != nil {
+			return err
+		}
+		if idx.Height == 0 {
+			return errors.New("Genesis block can not be invalidated")
+		}
+		idx.Invalid = true
+		if err := index.Put(hash, idx.serialize()); err != nil {
+			return err
+		}
+
+		// 从 tip 向前找到同一高度的区块，判断要作废的区块是否在主链上
+		var detach []*Block
+		block, err := getBlock(tx, b.Get([]byte("last")))
+		if err != nil {
+			return err
+		}
+		for block.Height > idx.Height {
+			detach = append(detach, block)
+			if block, err = getBlock(tx, block.PreHash); err != nil {
+				return err
+			}
+		}
+		if !bytes.Equal(block.Hash, hash) {
+			return nil
+		}
+		detach = append(detach, block)
+
+		UTXOSet := UTXOSet{bc}
+		for _, block := range detach {
+			if err := UTXOSet.disconnectBlock(tx, block); err != nil {
+				return err
+			}
+			if err := deleteMainChainHeight(tx, block); err != nil {
+				return err
+			}
+			if err := unindexBlockTransactions(tx, block); err != nil {
+				return err
+			}
+		}
+		change.Disconnected = detach
+
+		newTip = append([]byte{}, block.PreHash...)
+		return b.Put([]byte("last"), newTip)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if newTip != nil {
+		bc.tip = newTip
+	}
+	return change, nil
+}
+
+// 记录新区块的索引，累计工作量等于父区块的累计工作量加上该区块的工作量
+func putBlockIndex(tx *bolt.Tx, engine ConsensusEngine, block *Block) error {
+	index := tx.Bucket([]byte(blockIndexBucket))
+
+	chainWork := engine.Work(&block.BlockHeader)
+	if parentData := index.Get(block.PreHash); parentData != nil {
+		parent, err := deserializeBlockIndex(parentData)
+		if err != nil {
+			return err
+		}
+		chainWork.Add(chainWork, parent.chainWork())
+	}
+
+	return index.Put(block.Hash, blockIndex{block.Height, chainWork.Bytes(), false}.serialize())
+}
+
+// 旧版本创建的数据库没有区块索引，打开时按主链从创世区块开始补建
+// 最早的区块没有高度字段，解码后 Height 都是0，所以高度按 PreHash 到创世区块的距离计算，
+// 和计算结果不一致的区块连同区块头一起改写，之后的新区块按父区块的高度加1
+func ensureBlockIndex(tx *bolt.Tx, engine ConsensusEngine) error {
+	if tx.Bucket([]byte(blockIndexBucket)) != nil {
+		return nil
+	}
+	if _, err := tx.CreateBucket([]byte(blockIndexBucket)); err != nil {
+		return err
+	}
+
+	b := tx.Bucket([]byte(blocksBucket))
+	var mainChain []*Block
+	for hash := b.Get([]byte("last")); len(hash) > 0; {
+		block, err := getBlock(tx, hash)
+		if err != nil {
+			return err
+		}
+		mainChain = append(mainChain, block)
+		hash = block.PreHash
+	}
+
+	for i := len(mainChain) - 1; i >= 0; i-- {
+		block := mainChain[i]
+		if height := len(mainChain) - 1 - i; block.Height != height {
+			block.Height = height
+			if err := putBlock(tx, block); err != nil {
+				return err
+			}
+		}
+		if err := putBlockIndex(tx, engine, block); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
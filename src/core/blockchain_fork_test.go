@@ -0,0 +1,158 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// 创建并封装接在 parent 之后的区块，用于构造分叉，不写入数据库
+func sealTestBlockOn(t *testing.T, bc *Blockchain, parent *Block, transactions ...*Transaction) *Block {
+	t.Helper()
+
+	reward, err := NewRewardTX(bc.Params, testAddress(bc.Params, newTestWallet(t)), "", bc.Params.Subsidy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bits, err := bc.Engine.CalcDifficulty(bc, parent.Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	timestamp := time.Now().Unix()
+	if timestamp <= parent.Timestamp {
+		timestamp = parent.Timestamp + 1
+	}
+	block := newUnminedBlock(timestamp, append([]*Transaction{reward}, transactions...), parent.Hash, parent.Height+1, bits)
+	if err := bc.Engine.Seal(context.Background(), bc, block); err != nil {
+		t.Fatal(err)
+	}
+	return block
+}
+
+func processTestBlock(t *testing.T, bc *Blockchain, block *Block) *ChainChange {
+	t.Helper()
+
+	change, err := bc.ProcessBlock(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return change
+}
+
+func testBalance(t *testing.T, bc *Blockchain, wallet *Wallet) int {
+	t.Helper()
+
+	outputs, err := (UTXOSet{bc}).FindUTXO(NewP2PKHScript(HashPubKey(wallet.PublicKey)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	balance := 0
+	for _, out := range outputs {
+		balance += out.Value
+	}
+	return balance
+}
+
+// 分叉的累计工作量超过主链后切换过去，断开的区块中的交易从 UTXO 集中撤销
+func TestReorganize(t *testing.T) {
+	bc, alice := newTestChain(t)
+	bob := newTestWallet(t)
+	fork, err := bc.GetBlockByHash(bc.getLastHash())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tx, err := NewTransaction(alice, testAddress(bc.Params, bob), 3, 0, 0, &UTXOSet{bc})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a2 := mineTestBlock(t, bc, tx)
+	if balance := testBalance(t, bc, bob); balance != 3 {
+		t.Fatalf("bob's balance = %d, want 3", balance)
+	}
+
+	// 和主链工作量相同的分叉只保存下来，不切换
+	b2 := sealTestBlockOn(t, bc, fork)
+	if change := processTestBlock(t, bc, b2); len(change.Connected) != 0 || len(change.Disconnected) != 0 {
+		t.Fatalf("side block changed the main chain: %+v", change)
+	}
+	if !bytes.Equal(bc.getLastHash(), a2.Hash) {
+		t.Fatalf("tip is %x, want %x", bc.getLastHash(), a2.Hash)
+	}
+
+	b3 := sealTestBlockOn(t, bc, b2)
+	change := processTestBlock(t, bc, b3)
+	if len(change.Disconnected) != 1 || !bytes.Equal(change.Disconnected[0].Hash, a2.Hash) {
+		t.Fatalf("disconnected %d blocks, want only %x", len(change.Disconnected), a2.Hash)
+	}
+	if len(change.Connected) != 2 || !bytes.Equal(change.Connected[0].Hash, b2.Hash) || !bytes.Equal(change.Connected[1].Hash, b3.Hash) {
+		t.Fatalf("connected %d blocks, want %x and %x", len(change.Connected), b2.Hash, b3.Hash)
+	}
+	if !bytes.Equal(bc.getLastHash(), b3.Hash) {
+		t.Fatalf("tip is %x, want %x", bc.getLastHash(), b3.Hash)
+	}
+	block, err := bc.GetBlockByHeight(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(block.Hash, b2.Hash) {
+		t.Fatalf("block at height 2 is %x, want %x", block.Hash, b2.Hash)
+	}
+
+	// 断开的区块中的转账撤销，alice 的输出恢复
+	if balance := testBalance(t, bc, bob); balance != 0 {
+		t.Fatalf("bob's balance = %d, want 0", balance)
+	}
+	if balance := testBalance(t, bc, alice); balance != bc.Params.Subsidy {
+		t.Fatalf("alice's balance = %d, want %d", balance, bc.Params.Subsidy)
+	}
+}
+
+// 分叉中间的区块被标记为无效时，即使分叉的工作量超过主链也不切换，主链保持不变
+func TestReorganizeInvalidBranch(t *testing.T) {
+	bc, alice := newTestChain(t)
+	bob := newTestWallet(t)
+	fork, err := bc.GetBlockByHash(bc.getLastHash())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tx, err := NewTransaction(alice, testAddress(bc.Params, bob), 3, 0, 0, &UTXOSet{bc})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mineTestBlock(t, bc, tx)
+	a3 := mineTestBlock(t, bc)
+
+	b2 := sealTestBlockOn(t, bc, fork)
+	processTestBlock(t, bc, b2)
+	b3 := sealTestBlockOn(t, bc, b2)
+	processTestBlock(t, bc, b3)
+	if change, err := bc.InvalidateBlock(b2.Hash); err != nil || len(change.Disconnected) != 0 {
+		t.Fatalf("invalidating a side block: change = %+v, err = %v", change, err)
+	}
+
+	// b4 的父区块没有被标记，b2 在回溯到和主链相同高度之后才遇到
+	b4 := sealTestBlockOn(t, bc, b3)
+	if _, err := bc.ProcessBlock(b4); !errors.Is(err, ErrInvalidBlock) {
+		t.Fatalf("err = %v, want ErrInvalidBlock", err)
+	}
+	if !bytes.Equal(bc.getLastHash(), a3.Hash) {
+		t.Fatalf("tip is %x, want %x", bc.getLastHash(), a3.Hash)
+	}
+	if bc.HasBlock(b4.Hash) {
+		t.Fatal("block on the invalid branch is stored")
+	}
+	if balance := testBalance(t, bc, bob); balance != 3 {
+		t.Fatalf("bob's balance = %d, want 3", balance)
+	}
+	height, err := bc.Height()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if height != 3 {
+		t.Fatalf("height = %d, want 3", height)
+	}
+}
@@ -1,33 +1,170 @@
 package core
 
-import "github.com/boltdb/bolt"
+import (
+	"errors"
 
-// 对数据库区块进行顺序迭代并打印
+	"github.com/boltdb/bolt"
+)
+
+// 迭代的高度范围和条件
+type BlockRange struct {
+	// 最低高度（含）
+	From int
+	// 最高高度（含），小于0或者超过 tip 时为创建迭代器时 tip 的高度
+	To int
+	// 为 true 时从高到低迭代，否则从低到高
+	Reverse bool
+	// 不为空时只返回 Filter 返回 true 的区块
+	Filter func(*Block) bool
+}
+
+// 按高度迭代主链的位置，BlockchainIterator 和 HeaderRangeIterator 共用
+type heightCursor struct {
+	// 下一个要读取的高度
+	next int
+	// 迭代结束的高度（含）
+	end     int
+	reverse bool
+}
+
+// 按 BlockRange 的高度范围和方向创建位置，Filter 由迭代器自己处理
+func (bc *Blockchain) newHeightCursor(r BlockRange) (heightCursor, error) {
+	height, err := bc.Height()
+	if err != nil {
+		return heightCursor{}, err
+	}
+	to := r.To
+	if to < 0 || to > height {
+		to = height
+	}
+	from := r.From
+	if from < 0 {
+		from = 0
+	}
+
+	if r.Reverse {
+		return heightCursor{next: to, end: from, reverse: true}, nil
+	}
+	return heightCursor{next: from, end: to}, nil
+}
+
+// 返回下一个高度并移动位置，超出范围时 ok 为 false
+func (c *heightCursor) advance() (height int, ok bool) {
+	if c.reverse && c.next < c.end || !c.reverse && c.next > c.end {
+		return 0, false
+	}
+	height = c.next
+	if c.reverse {
+		c.next--
+	} else {
+		c.next++
+	}
+	return height, true
+}
+
+// 按高度迭代主链上的区块，通过高度索引定位，不需要沿 PreHash 回溯
+// 用法：
+//
+//	for block, ok := bci.Next(); ok; block, ok = bci.Next() { ... }
+//	if err := bci.Err(); err != nil { ... }
 type BlockchainIterator struct {
-	currentHash []byte
-	db          *bolt.DB
+	db     *bolt.DB
+	cursor heightCursor
+	filter func(*Block) bool
+	err    error
 }
 
-// 为Blockchain创建一个迭代器，里面存储了当前迭代的块哈希（currentHash）和数据库的连接（db）
-// 迭代器的初始状态为链中的 tip，因此区块将从尾到头迭代
+// 创建按高度范围迭代的迭代器
+func (bc *Blockchain) RangeIterator(r BlockRange) *BlockchainIterator {
+	cursor, err := bc.newHeightCursor(r)
+	return &BlockchainIterator{db: bc.Db, cursor: cursor, filter: r.Filter, err: err}
+}
+
+// 从 tip 向创世区块方向迭代整条主链
 func (bc *Blockchain) Iterator() *BlockchainIterator {
-	bci := &BlockchainIterator{bc.tip, bc.Db}
-	return bci
+	return bc.RangeIterator(BlockRange{To: -1, Reverse: true})
+}
+
+// 从 height 开始向 tip 方向迭代，height 为0时从创世区块开始
+func (bc *Blockchain) ForwardIterator(height int) *BlockchainIterator {
+	return bc.RangeIterator(BlockRange{From: height, To: -1})
 }
 
-// 返回链中下一个块
-func (i *BlockchainIterator) Next() *Block {
-	var block *Block
+// 返回下一个区块，超出范围或者出错时 ok 为 false，出错的原因通过 Err 获取
+func (i *BlockchainIterator) Next() (block *Block, ok bool) {
+	for i.err == nil {
+		height, ok := i.cursor.advance()
+		if !ok {
+			break
+		}
 
-	_ = i.db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(blocksBucket))
-		encodedBlock := b.Get(i.currentHash)
-		block = DeserializeBlock(encodedBlock)
+		i.err = i.db.View(func(tx *bolt.Tx) error {
+			hash, err := getMainChainHash(tx, height)
+			if err != nil {
+				return err
+			}
+			block, err = getBlock(tx, hash)
+			return err
+		})
+		if i.err != nil {
+			return nil, false
+		}
 
-		return nil
-	})
+		if i.filter == nil || i.filter(block) {
+			return block, true
+		}
+	}
+
+	return nil, false
+}
 
-	i.currentHash = block.PreHash
+// 迭代过程中遇到的错误，正常结束时为 nil
+func (i *BlockchainIterator) Err() error {
+	return i.err
+}
+
+// 按高度迭代主链上的区块头，同样通过高度索引定位，只读取 headers bucket，不解码区块中的交易
+// 用法和 BlockchainIterator 相同，BlockRange 的 Filter 作用于完整的区块，这里必须为空
+type HeaderRangeIterator struct {
+	db     *bolt.DB
+	cursor heightCursor
+	err    error
+}
+
+// 创建按高度范围迭代区块头的迭代器
+func (bc *Blockchain) HeaderRangeIterator(r BlockRange) *HeaderRangeIterator {
+	if r.Filter != nil {
+		return &HeaderRangeIterator{err: errors.New("header iterator does not support block filters")}
+	}
+	cursor, err := bc.newHeightCursor(r)
+	return &HeaderRangeIterator{db: bc.Db, cursor: cursor, err: err}
+}
+
+// 返回下一个区块头，超出范围或者出错时 ok 为 false，出错的原因通过 Err 获取
+func (i *HeaderRangeIterator) Next() (header *BlockHeader, ok bool) {
+	if i.err != nil {
+		return nil, false
+	}
+	height, ok := i.cursor.advance()
+	if !ok {
+		return nil, false
+	}
+
+	i.err = i.db.View(func(tx *bolt.Tx) error {
+		hash, err := getMainChainHash(tx, height)
+		if err != nil {
+			return err
+		}
+		header, err = getBlockHeader(tx, hash)
+		return err
+	})
+	if i.err != nil {
+		return nil, false
+	}
+	return header, true
+}
 
-	return block
+// 迭代过程中遇到的错误，正常结束时为 nil
+func (i *HeaderRangeIterator) Err() error {
+	return i.err
 }
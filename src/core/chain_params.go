@@ -0,0 +1,269 @@
+package core
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"strings"
+
+	"github.com/boltdb/bolt"
+)
+
+// 链参数，不同网络（主网、测试网、回归测试网）使用不同的参数，数据库和钱包文件也互相独立
+// 除了预置的网络，也可以从 JSON 文件加载，文件中没有给出的字段使用主网的值
+type ChainParams struct {
+	// 网络名称，创建链时记录在数据库中，打开数据库时必须一致
+	Name string `json:"name"`
+	// 创世区块奖励交易中附带的数据
+	GenesisData string `json:"genesisData"`
+	// 创世区块的 hash（十六进制），不为空时打开数据库会检查链的创世区块是否是它
+	// 不为空时创世区块是固定的（见 genesisBlock），为空时由 createchain 生成，奖励发给 createchain 指定的地址
+	GenesisHash string `json:"genesisHash,omitempty"`
+	// 固定的创世区块的时间戳
+	GenesisTime int64 `json:"genesisTime,omitempty"`
+
+	// 初始的区块奖励
+	Subsidy int `json:"subsidy"`
+	// 奖励减半的间隔区块数
+	SubsidyHalvingInterval int `json:"subsidyHalvingInterval"`
+
+	// 最低难度（数字越小哈希的前置0越少），创世区块使用这个难度
+	TargetBits uint `json:"targetBits"`
+	// 每隔多少个区块调整一次难度
+	RetargetInterval int `json:"retargetInterval"`
+	// 期望的出块间隔（秒）
+	TargetSpacing int64 `json:"targetSpacing"`
+	// 不调整难度，始终使用最低难度
+	NoRetargeting bool `json:"noRetargeting,omitempty"`
+
+	// 地址的版本前缀，不同网络的地址不能混用
+	AddressVersion byte `json:"addressVersion"`
+	// 脚本hash（P2SH）地址的版本前缀，必须和 AddressVersion 不同
+	ScriptAddressVersion byte `json:"scriptAddressVersion"`
+
+	// 数据库文件和钱包文件，指定 NODE_ID 时在扩展名前加上 _NODE_ID
+	DbFile     string `json:"dbFile"`
+	WalletFile string `json:"walletFile"`
+}
+
+// 主网参数，和之前版本的默认值一致，旧的数据库和钱包可以继续使用
+// 之前版本创建的链各有自己的创世区块，所以主网不固定创世区块
+var MainNetParams = ChainParams{
+	Name:                   "mainnet",
+	GenesisData:            "genesis",
+	Subsidy:                10,
+	SubsidyHalvingInterval: 210000,
+	TargetBits:             10,
+	RetargetInterval:       10,
+	TargetSpacing:          10,
+	AddressVersion:         0x00,
+	ScriptAddressVersion:   0x05,
+	DbFile:                 "blockchain.db",
+	WalletFile:             "wallet.dat",
+}
+
+// 测试网参数，地址前缀和比特币测试网一致
+var TestNetParams = ChainParams{
+	Name:                   "testnet",
+	GenesisData:            "testnet genesis",
+	GenesisHash:            "00009f1e9b16be3b0514acfa7f8cfae670fdad631de872e96659425bfc2e2edb",
+	GenesisTime:            1700000000,
+	Subsidy:                10,
+	SubsidyHalvingInterval: 210000,
+	TargetBits:             8,
+	RetargetInterval:       10,
+	TargetSpacing:          10,
+	AddressVersion:         0x6f,
+	ScriptAddressVersion:   0xc4,
+	DbFile:                 "testnet_blockchain.db",
+	WalletFile:             "testnet_wallet.dat",
+}
+
+// 回归测试网参数，难度最低且不调整，奖励很快减半，用于本地测试
+var RegTestParams = ChainParams{
+	Name:                   "regtest",
+	GenesisData:            "regtest genesis",
+	GenesisHash:            "762f699600fcf2b2f31b2164fadccb56b41ac3efd444dc46c312f2858e5deaaf",
+	GenesisTime:            1700000000,
+	Subsidy:                10,
+	SubsidyHalvingInterval: 150,
+	TargetBits:             1,
+	RetargetInterval:       10,
+	TargetSpacing:          10,
+	NoRetargeting:          true,
+	AddressVersion:         0x6f,
+	ScriptAddressVersion:   0xc4,
+	DbFile:                 "regtest_blockchain.db",
+	WalletFile:             "regtest_wallet.dat",
+}
+
+// 预置的网络
+var chainParamsPresets = map[string]*ChainParams{
+	MainNetParams.Name: &MainNetParams,
+	TestNetParams.Name: &TestNetParams,
+	RegTestParams.Name: &RegTestParams,
+}
+
+// 根据名称选择预置的网络，不是预置网络的名称时当作 JSON 文件路径加载，为空时使用主网
+func LoadChainParams(nameOrPath string) (*ChainParams, error) {
+	if nameOrPath == "" {
+		return &MainNetParams, nil
+	}
+	if params, ok := chainParamsPresets[nameOrPath]; ok {
+		return params, nil
+	}
+
+	data, err := ioutil.ReadFile(nameOrPath)
+	if err != nil {
+		return nil, fmt.Errorf("unknown network %q: %v", nameOrPath, err)
+	}
+
+	params := MainNetParams
+	params.GenesisHash = ""
+	if err := json.Unmarshal(data, &params); err != nil {
+		return nil, fmt.Errorf("invalid chain params %s: %v", nameOrPath, err)
+	}
+	if err := params.validate(); err != nil {
+		return nil, fmt.Errorf("invalid chain params %s: %v", nameOrPath, err)
+	}
+	return &params, nil
+}
+
+func (p *ChainParams) validate() error {
+	if p.Name == "" {
+		return errors.New("name is empty")
+	}
+	if p.GenesisHash != "" {
+		if _, err := hex.DecodeString(p.GenesisHash); err != nil {
+			return fmt.Errorf("genesisHash: %v", err)
+		}
+	}
+	if !MoneyRange(p.Subsidy) || p.SubsidyHalvingInterval <= 0 {
+		return fmt.Errorf("subsidy must be between 0 and %d and subsidyHalvingInterval must be positive", MaxMoney)
+	}
+	if p.TargetBits == 0 || p.TargetBits >= 256 {
+		return errors.New("targetBits must be between 1 and 255")
+	}
+	if p.RetargetInterval <= 0 || p.TargetSpacing <= 0 {
+		return errors.New("retargetInterval and targetSpacing must be positive")
+	}
+	if p.AddressVersion == p.ScriptAddressVersion {
+		return errors.New("addressVersion and scriptAddressVersion must differ")
+	}
+	if p.DbFile == "" || p.WalletFile == "" {
+		return errors.New("dbFile and walletFile must be set")
+	}
+	return nil
+}
+
+// 固定的创世区块：时间戳为 GenesisTime，使用工作量证明，奖励发给没有人持有私钥的全0公钥hash，无法花费
+// 和比特币一样，同一个网络的节点各自创建的链从同一个创世区块开始
+func (p *ChainParams) genesisBlock(engine ConsensusEngine) (*Block, error) {
+	data, err := genesisRewardData(p, DefaultConsensusConfig)
+	if err != nil {
+		return nil, err
+	}
+	gtx := Transaction{nil, []TXInput{NewRewardTxin(data)}, []TXOutput{{p.BlockSubsidy(0), NewP2PKHScript(make([]byte, 20))}}, 0}
+	gtx.SetID()
+
+	genesis, err := NewGenesisBlock(&gtx, p.GenesisTime, engine)
+	if err != nil {
+		return nil, err
+	}
+	if hash := hex.EncodeToString(genesis.Hash); hash != p.GenesisHash {
+		return nil, fmt.Errorf("genesis block is %s, expected %s", hash, p.GenesisHash)
+	}
+	return genesis, nil
+}
+
+// 指定高度的区块奖励，每经过 SubsidyHalvingInterval 个区块减半，直到为0
+// 挖出创世块的奖励是 50 BTC，每挖出 210000 个块后，奖励减半
+func (p *ChainParams) BlockSubsidy(height int) int {
+	halvings := height / p.SubsidyHalvingInterval
+	if halvings >= 64 {
+		return 0
+	}
+	return p.Subsidy >> uint(halvings)
+}
+
+// 允许的最大目标值（最低难度）
+func (p *ChainParams) PowLimit() *big.Int {
+	return new(big.Int).Lsh(big.NewInt(1), 256-p.TargetBits)
+}
+
+// 最低难度对应的 Bits
+func (p *ChainParams) PowLimitBits() uint32 {
+	return BigToCompact(p.PowLimit())
+}
+
+// 一个难度调整周期期望花费的时间
+func (p *ChainParams) targetTimespan() int64 {
+	return int64(p.RetargetInterval) * p.TargetSpacing
+}
+
+// 节点对应的数据库文件，未指定节点时使用默认文件
+func (p *ChainParams) dbFileName(nodeID string) string {
+	return nodeFileName(p.DbFile, nodeID)
+}
+
+// 节点对应的钱包文件，未指定节点时使用默认文件
+func (p *ChainParams) walletFileName(nodeID string) string {
+	return nodeFileName(p.WalletFile, nodeID)
+}
+
+// 在文件扩展名前加上节点ID，例如 blockchain.db 变为 blockchain_3000.db
+func nodeFileName(file, nodeID string) string {
+	if nodeID == "" {
+		return file
+	}
+	ext := filepath.Ext(file)
+	return fmt.Sprintf("%s_%s%s", strings.TrimSuffix(file, ext), nodeID, ext)
+}
+
+// 数据库中记录网络名称和创世区块 hash 的 key，位于 meta bucket
+const (
+	networkKey = "network"
+	genesisKey = "genesis"
+)
+
+// 数据库不属于当前选择的网络
+var ErrNetworkMismatch = errors.New("database belongs to a different network")
+
+// 打开已有的数据库时检查它和链参数是否一致：网络名称相同，指定了创世区块 hash 时创世区块必须是它
+// 创世区块 hash 在创建链时记录，不需要每次打开都从 tip 回溯
+// 旧版本创建的数据库没有记录网络名称和创世区块，补记为当前网络和链上的创世区块
+func checkChainParams(tx *bolt.Tx, params *ChainParams) error {
+	meta, err := tx.CreateBucketIfNotExists([]byte(metaBucket))
+	if err != nil {
+		return err
+	}
+
+	if network := meta.Get([]byte(networkKey)); network == nil {
+		if err := meta.Put([]byte(networkKey), []byte(params.Name)); err != nil {
+			return err
+		}
+	} else if string(network) != params.Name {
+		return fmt.Errorf("%w: database is %s, selected %s", ErrNetworkMismatch, network, params.Name)
+	}
+
+	hash := meta.Get([]byte(genesisKey))
+	if hash == nil {
+		if hash, err = genesisHash(tx); err != nil {
+			return err
+		}
+		if err := meta.Put([]byte(genesisKey), hash); err != nil {
+			return err
+		}
+	}
+	if params.GenesisHash != "" {
+		if genesis := hex.EncodeToString(hash); genesis != params.GenesisHash {
+			return fmt.Errorf("%w: genesis block is %s, expected %s", ErrNetworkMismatch, genesis, params.GenesisHash)
+		}
+	}
+
+	return nil
+}
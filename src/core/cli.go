@@ -1,19 +1,36 @@
 package core
 
 import (
+	"bufio"
+	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"math"
 	"os"
 	"strconv"
+	"strings"
 )
 
 type CLI struct {
+	// 当前网络的链参数
+	params *ChainParams
 }
 
 func (cli *CLI) Run() {
 	cli.validateArgs()
 
+	// 同一台机器上运行多个节点时，通过环境变量 NODE_ID 区分，节点监听 localhost:NODE_ID
+	nodeID := os.Getenv("NODE_ID")
+
+	// 通过环境变量 NETWORK 选择网络：mainnet（默认）、testnet、regtest，或者链参数 JSON 文件的路径
+	params, err := LoadChainParams(os.Getenv("NETWORK"))
+	if err != nil {
+		cli.exit(err)
+	}
+	cli.params = params
+
 	// 使用标准库里面的 flag 包来解析命令行参数
 	cleanCmd := flag.NewFlagSet("clean", flag.ExitOnError)
 	createChainCmd := flag.NewFlagSet("createchain", flag.ExitOnError)
@@ -22,13 +39,63 @@ func (cli *CLI) Run() {
 	listAddrCmd := flag.NewFlagSet("listaddr", flag.ExitOnError)
 	transferCmd := flag.NewFlagSet("transfer", flag.ExitOnError)
 	balanceCmd := flag.NewFlagSet("balance", flag.ExitOnError)
+	startNodeCmd := flag.NewFlagSet("startnode", flag.ExitOnError)
+	invalidateBlockCmd := flag.NewFlagSet("invalidateblock", flag.ExitOnError)
+	proveTxCmd := flag.NewFlagSet("proveTx", flag.ExitOnError)
+	mineCmd := flag.NewFlagSet("mine", flag.ExitOnError)
+	reindexTxCmd := flag.NewFlagSet("reindex-tx", flag.ExitOnError)
+	historyCmd := flag.NewFlagSet("history", flag.ExitOnError)
+	migrateDbCmd := flag.NewFlagSet("migratedb", flag.ExitOnError)
+	getPubKeyCmd := flag.NewFlagSet("getpubkey", flag.ExitOnError)
+	createMultisigCmd := flag.NewFlagSet("createmultisig", flag.ExitOnError)
+	spendMultisigCmd := flag.NewFlagSet("spendmultisig", flag.ExitOnError)
+	signMultisigCmd := flag.NewFlagSet("signmultisig", flag.ExitOnError)
+	sendMultisigCmd := flag.NewFlagSet("sendmultisig", flag.ExitOnError)
+	sendRawTxCmd := flag.NewFlagSet("sendrawtx", flag.ExitOnError)
 
 	// 给 createchain命令 添加 -address 标志
-	createChainAddress := createChainCmd.String("address", "", "The address to send genesis block reward to")
+	printChainFrom := printChainCmd.Int("from", 0, "Lowest height to print")
+	printChainTo := printChainCmd.Int("to", -1, "Highest height to print, defaults to the tip")
+	createChainAddress := createChainCmd.String("address", "", "The address to send the genesis block reward to, or the first block reward on networks with a fixed genesis block")
+	createChainConsensus := createChainCmd.String("consensus", ConsensusPoW, "Consensus engine of the chain: pow or poa")
+	createChainAuthorities := createChainCmd.String("authorities", "", "PoA: comma separated addresses from the local wallet that take turns sealing blocks")
+	createChainPeriod := createChainCmd.Int64("period", 5, "PoA: minimum seconds between blocks")
 	balanceAddress := balanceCmd.String("address", "", "The address to get balance for")
 	transferFromAddress := transferCmd.String("from", "", "Source wallet address")
 	transferToAddress := transferCmd.String("to", "", "Destination wallet address")
 	transferAmount := transferCmd.Int("amount", 0, "Amount to send")
+	transferMine := transferCmd.Bool("mine", true, "Mine immediately on the same node")
+	transferNode := transferCmd.String("node", defaultSeedNode, "Node to send the transaction or new block to")
+	transferLockTime := transferCmd.Int64("locktime", 0, "Only valid in blocks above this height, or after this unix time if it is at least 500000000")
+	transferAfterHeight := transferCmd.Uint("after-height", 0, "Each spent output must have this many blocks on top of the one confirming it")
+	transferOut := transferCmd.String("out", "", "Write the signed transaction to this file instead of sending it, e.g. when it is locked until a later height or time")
+	startNodeMiner := startNodeCmd.String("miner", "", "Enable mining mode and send reward to ADDRESS")
+	startNodeSeed := startNodeCmd.String("seed", defaultSeedNode, "Address of the node to sync with on startup")
+	invalidateBlockHash := invalidateBlockCmd.String("hash", "", "Hash of the block to invalidate")
+	proveTxID := proveTxCmd.String("txid", "", "ID of the transaction to prove")
+	mineAddress := mineCmd.String("address", "", "The address to send mining rewards to")
+	mineSeed := mineCmd.String("seed", defaultSeedNode, "Address of the node to sync with on startup")
+	historyAddress := historyCmd.String("address", "", "The address to list transactions for")
+	historyPage := historyCmd.Int("page", 1, "Page number, starting from 1 with the newest transactions")
+	historyPageSize := historyCmd.Int("pagesize", 10, "Number of transactions per page")
+	getPubKeyAddress := getPubKeyCmd.String("address", "", "Address from the local wallet")
+	createMultisigRequired := createMultisigCmd.Int("required", 0, "Number of signatures required to spend")
+	createMultisigPubKeys := createMultisigCmd.String("pubkeys", "", "Comma separated hex public keys of the participants, in a fixed order")
+	spendMultisigFrom := spendMultisigCmd.String("from", "", "Multisig address created with createmultisig")
+	spendMultisigTo := spendMultisigCmd.String("to", "", "Destination address")
+	spendMultisigAmount := spendMultisigCmd.Int("amount", 0, "Amount to send")
+	spendMultisigOut := spendMultisigCmd.String("out", "", "File to write the unsigned transaction to")
+	signMultisigFile := signMultisigCmd.String("file", "", "Multisig transaction file, signatures are added in place")
+	signMultisigAddress := signMultisigCmd.String("address", "", "Address from the local wallet to sign with")
+	signMultisigYes := signMultisigCmd.Bool("yes", false, "Sign without asking for confirmation after printing the outputs")
+	sendMultisigFile := sendMultisigCmd.String("file", "", "Multisig transaction file with enough signatures")
+	sendMultisigMine := sendMultisigCmd.Bool("mine", true, "Mine immediately on the same node")
+	sendMultisigMiner := sendMultisigCmd.String("miner", "", "Address to send the block reward to when mining")
+	sendMultisigNode := sendMultisigCmd.String("node", defaultSeedNode, "Node to send the transaction or new block to")
+	sendRawTxFile := sendRawTxCmd.String("file", "", "Transaction file written by transfer -out")
+	sendRawTxMine := sendRawTxCmd.Bool("mine", true, "Mine immediately on the same node")
+	sendRawTxMiner := sendRawTxCmd.String("miner", "", "Address to send the block reward to when mining")
+	sendRawTxNode := sendRawTxCmd.String("node", defaultSeedNode, "Node to send the transaction or new block to")
 
 	// 命令解析
 	switch os.Args[1] {
@@ -39,19 +106,39 @@ func (cli *CLI) Run() {
 	case "printchain":
 		_ = printChainCmd.Parse(os.Args[2:])
 	case "createwallet":
-		err := createWalletCmd.Parse(os.Args[2:])
-		if err != nil {
-			log.Panic(err)
-		}
+		_ = createWalletCmd.Parse(os.Args[2:])
 	case "listaddr":
-		err := listAddrCmd.Parse(os.Args[2:])
-		if err != nil {
-			log.Panic(err)
-		}
+		_ = listAddrCmd.Parse(os.Args[2:])
 	case "transfer":
 		_ = transferCmd.Parse(os.Args[2:])
 	case "balance":
 		_ = balanceCmd.Parse(os.Args[2:])
+	case "startnode":
+		_ = startNodeCmd.Parse(os.Args[2:])
+	case "invalidateblock":
+		_ = invalidateBlockCmd.Parse(os.Args[2:])
+	case "proveTx":
+		_ = proveTxCmd.Parse(os.Args[2:])
+	case "mine":
+		_ = mineCmd.Parse(os.Args[2:])
+	case "reindex-tx":
+		_ = reindexTxCmd.Parse(os.Args[2:])
+	case "history":
+		_ = historyCmd.Parse(os.Args[2:])
+	case "migratedb":
+		_ = migrateDbCmd.Parse(os.Args[2:])
+	case "getpubkey":
+		_ = getPubKeyCmd.Parse(os.Args[2:])
+	case "createmultisig":
+		_ = createMultisigCmd.Parse(os.Args[2:])
+	case "spendmultisig":
+		_ = spendMultisigCmd.Parse(os.Args[2:])
+	case "signmultisig":
+		_ = signMultisigCmd.Parse(os.Args[2:])
+	case "sendmultisig":
+		_ = sendMultisigCmd.Parse(os.Args[2:])
+	case "sendrawtx":
+		_ = sendRawTxCmd.Parse(os.Args[2:])
 	default:
 		cli.printUsage()
 		os.Exit(1)
@@ -59,34 +146,34 @@ func (cli *CLI) Run() {
 
 	// 解析相关并执行命令
 	if cleanCmd.Parsed() {
-		cli.cleanEnv()
+		err = cli.cleanEnv(nodeID)
 	}
 	if createChainCmd.Parsed() {
 		if *createChainAddress == "" {
 			createChainCmd.Usage()
 			os.Exit(1) // 没有-address参数时，直接退出
 		}
-		cli.createBlockchain(*createChainAddress)
+		err = cli.createBlockchain(*createChainAddress, nodeID, *createChainConsensus, *createChainAuthorities, *createChainPeriod)
 	}
 
 	if printChainCmd.Parsed() {
-		cli.printChain()
+		err = cli.printChain(nodeID, *printChainFrom, *printChainTo)
 	}
 
 	if createWalletCmd.Parsed() {
-		cli.createWallet()
+		err = cli.createWallet(nodeID)
 	}
 
 	if listAddrCmd.Parsed() {
-		cli.listaddr()
+		err = cli.listaddr(nodeID)
 	}
 
 	if transferCmd.Parsed() {
-		if *transferFromAddress == "" || *transferToAddress == "" || *transferAmount <= 0 {
+		if *transferFromAddress == "" || *transferToAddress == "" || *transferAmount <= 0 || *transferLockTime < 0 || *transferAfterHeight > math.MaxUint32 {
 			transferCmd.Usage()
 			os.Exit(1)
 		}
-		cli.transfer(*transferFromAddress, *transferToAddress, *transferAmount)
+		err = cli.transfer(*transferFromAddress, *transferToAddress, *transferAmount, *transferLockTime, uint32(*transferAfterHeight), nodeID, *transferMine, *transferNode, *transferOut)
 	}
 
 	if balanceCmd.Parsed() {
@@ -94,8 +181,114 @@ func (cli *CLI) Run() {
 			balanceCmd.Usage()
 			os.Exit(1)
 		}
-		cli.getBalance(*balanceAddress)
+		err = cli.getBalance(*balanceAddress, nodeID)
 	}
+
+	if startNodeCmd.Parsed() {
+		if nodeID == "" {
+			startNodeCmd.Usage()
+			os.Exit(1)
+		}
+		err = cli.startNode(nodeID, *startNodeMiner, *startNodeSeed)
+	}
+
+	if invalidateBlockCmd.Parsed() {
+		if *invalidateBlockHash == "" {
+			invalidateBlockCmd.Usage()
+			os.Exit(1)
+		}
+		err = cli.invalidateBlock(*invalidateBlockHash, nodeID)
+	}
+
+	if proveTxCmd.Parsed() {
+		if *proveTxID == "" {
+			proveTxCmd.Usage()
+			os.Exit(1)
+		}
+		err = cli.proveTx(*proveTxID, nodeID)
+	}
+
+	if mineCmd.Parsed() {
+		if nodeID == "" || *mineAddress == "" {
+			mineCmd.Usage()
+			os.Exit(1)
+		}
+		err = cli.mine(*mineAddress, nodeID, *mineSeed)
+	}
+
+	if reindexTxCmd.Parsed() {
+		err = cli.reindexTx(nodeID)
+	}
+
+	if historyCmd.Parsed() {
+		if *historyAddress == "" || *historyPage <= 0 || *historyPageSize <= 0 {
+			historyCmd.Usage()
+			os.Exit(1)
+		}
+		err = cli.history(*historyAddress, nodeID, *historyPage, *historyPageSize)
+	}
+
+	if migrateDbCmd.Parsed() {
+		err = cli.migrateDb(nodeID)
+	}
+
+	if getPubKeyCmd.Parsed() {
+		if *getPubKeyAddress == "" {
+			getPubKeyCmd.Usage()
+			os.Exit(1)
+		}
+		err = cli.getPubKey(*getPubKeyAddress, nodeID)
+	}
+
+	if createMultisigCmd.Parsed() {
+		if *createMultisigRequired <= 0 || *createMultisigPubKeys == "" {
+			createMultisigCmd.Usage()
+			os.Exit(1)
+		}
+		err = cli.createMultisig(*createMultisigRequired, *createMultisigPubKeys, nodeID)
+	}
+
+	if spendMultisigCmd.Parsed() {
+		if *spendMultisigFrom == "" || *spendMultisigTo == "" || *spendMultisigAmount <= 0 || *spendMultisigOut == "" {
+			spendMultisigCmd.Usage()
+			os.Exit(1)
+		}
+		err = cli.spendMultisig(*spendMultisigFrom, *spendMultisigTo, *spendMultisigAmount, *spendMultisigOut, nodeID)
+	}
+
+	if signMultisigCmd.Parsed() {
+		if *signMultisigFile == "" || *signMultisigAddress == "" {
+			signMultisigCmd.Usage()
+			os.Exit(1)
+		}
+		err = cli.signMultisig(*signMultisigFile, *signMultisigAddress, nodeID, *signMultisigYes)
+	}
+
+	if sendMultisigCmd.Parsed() {
+		if *sendMultisigFile == "" || (*sendMultisigMine && *sendMultisigMiner == "") {
+			sendMultisigCmd.Usage()
+			os.Exit(1)
+		}
+		err = cli.sendMultisig(*sendMultisigFile, nodeID, *sendMultisigMine, *sendMultisigMiner, *sendMultisigNode)
+	}
+
+	if sendRawTxCmd.Parsed() {
+		if *sendRawTxFile == "" || (*sendRawTxMine && *sendRawTxMiner == "") {
+			sendRawTxCmd.Usage()
+			os.Exit(1)
+		}
+		err = cli.sendRawTx(*sendRawTxFile, nodeID, *sendRawTxMine, *sendRawTxMiner, *sendRawTxNode)
+	}
+
+	if err != nil {
+		cli.exit(err)
+	}
+}
+
+// 命令执行失败时输出错误并退出，命令行是唯一直接退出进程的地方
+func (cli *CLI) exit(err error) {
+	fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+	os.Exit(1)
 }
 
 // 校验参数
@@ -108,128 +301,570 @@ func (cli *CLI) validateArgs() {
 
 // 使用说明
 func (cli *CLI) printUsage() {
-	log.Println("Usage:")
+	log.Println("Usage: (NETWORK=mainnet|testnet|regtest|params.json selects the chain, NODE_ID selects the node)")
 	log.Println("	clean - clean env")
-	log.Println("	createchain -address address - init block chain")
-	log.Println("	printchain - print all blocks of the blockchain")
+	log.Println("	createchain -address address -consensus pow|poa -authorities addr1,addr2 -period 5 - init block chain. testnet and regtest start from a fixed PoW genesis block and mine the first block to address, so PoA needs mainnet or a chain params file. PoA authorities must be addresses in the local wallet")
+	log.Println("	printchain -from 0 -to 10 - print blocks of the main chain between the two heights, newest first. Prints all blocks by default")
 	log.Println("	createwallet - generates a new key-pair and saves it into the wallet file")
 	log.Println("	listaddr - lists all addresses from the wallet file")
-	log.Println("	transfer -form tom -to jerry -amount 1 - tom transfers 1 coin to jerry")
+	log.Println("	transfer -form tom -to jerry -amount 1 -mine=false -node localhost:3000 -locktime 100 -after-height 10 -out tx.hex - tom transfers 1 coin to jerry. Mine locally by default, or send the transaction to -node when -mine=false. -locktime and -after-height lock the transaction until a height or time, or until the spent outputs have that many blocks on top; -out tx.hex saves a locked transaction for sendrawtx")
 	log.Println("	balance -address address - print balance of address")
+	log.Println("	startnode -miner address -seed localhost:3000 - start a node with ID specified in NODE_ID env. var. -miner enables mining")
+	log.Println("	invalidateblock -hash hash - mark a block as invalid and disconnect it and its descendants from the chain")
+	log.Println("	proveTx -txid txid - print the Merkle proof that the transaction is included in a block")
+	log.Println("	mine -address address -seed localhost:3000 - start a node with ID specified in NODE_ID env. var. and mine continuously, rewards go to address")
+	log.Println("	history -address address -page 1 -pagesize 10 - list transactions paying into or out of address, newest first")
+	log.Println("	migratedb - convert a database written with an older encoding, the original file is kept with a .old suffix")
+	log.Println("	reindex-tx - build the transaction index so transactions are looked up without scanning the chain")
+	log.Println("	getpubkey -address address - print the public key of a local wallet address, to share with multisig participants")
+	log.Println("	createmultisig -required 2 -pubkeys key1,key2,key3 - create a multisig address spendable with 2 of the 3 keys and save its redeem script in the wallet file")
+	log.Println("	spendmultisig -from multisig -to address -amount 1 -out tx.json - build an unsigned transaction spending from a multisig address of the local wallet file")
+	log.Println("	signmultisig -file tx.json -address address -yes - print the outputs of a multisig transaction, then add the signature of a local wallet address after confirmation, or without asking with -yes")
+	log.Println("	sendmultisig -file tx.json -mine=true -miner address -node localhost:3000 - finalize a multisig transaction with enough signatures, then mine it locally or send it to -node")
+	log.Println("	sendrawtx -file tx.hex -mine=true -miner address -node localhost:3000 - send a transaction saved with transfer -out once its lock time has passed, mining it locally or sending it to -node")
 }
 
-func (cli *CLI) cleanEnv() {
-	os.Remove(dbFile)
-	os.Remove(dbFile + ".lock")
-	os.Remove(walletFile)
+func (cli *CLI) cleanEnv(nodeID string) error {
+	os.Remove(cli.params.dbFileName(nodeID))
+	os.Remove(cli.params.dbFileName(nodeID) + ".lock")
+	os.Remove(cli.params.walletFileName(nodeID))
 	fmt.Println("Clean Done!")
+	return nil
 }
 
 // 创建并获取链
-func (cli *CLI) createBlockchain(address string) {
-	if !ValidateAddress(address) {
-		log.Panic("ERROR: Address is not valid")
+func (cli *CLI) createBlockchain(address, nodeID, consensus, authorities string, period int64) error {
+	if !cli.params.ValidateAddress(address) {
+		return fmt.Errorf("%w: %s", ErrInvalidAddress, address)
 	}
 
-	bc := NewBlockchain(address)
+	config := ConsensusConfig{Engine: consensus}
+	if consensus == ConsensusPoA {
+		wallets, err := NewWallets(cli.params, nodeID)
+		if err != nil {
+			return err
+		}
+		for _, authority := range strings.Split(authorities, ",") {
+			wallet, err := wallets.GetWallet(authority)
+			if err != nil {
+				return fmt.Errorf("authority %s: %w", authority, err)
+			}
+			config.Authorities = append(config.Authorities, hex.EncodeToString(wallet.PublicKey))
+		}
+		config.Period = period
+	}
+
+	bc, err := NewBlockchain(cli.params, address, nodeID, config)
+	if err != nil {
+		return err
+	}
 	defer bc.Db.Close()
 
 	UTXOSet := UTXOSet{bc}
-	UTXOSet.Reindex()
+	if err := UTXOSet.Reindex(); err != nil {
+		return err
+	}
 	fmt.Println("createBlockchain Done!")
+	return nil
 }
 
-// 通过迭代方式打印链条
-func (cli *CLI) printChain() {
-	bc := GetBlockchain()
+// 按高度从高到低打印主链上 from 到 to 之间的区块，只读取区块头
+// to 小于0时打印到 tip
+func (cli *CLI) printChain(nodeID string, from, to int) error {
+	bc, err := GetBlockchain(cli.params, nodeID)
+	if err != nil {
+		return err
+	}
 	defer bc.Db.Close()
-	bci := bc.Iterator()
 
-	for {
-		block := bci.Next()
-
-		fmt.Printf("Prev. hash: %x\n", block.PreHash)
-		fmt.Printf("Transactions: %x\n", block.HashTransactions())
-		fmt.Printf("Hash: %x\n", block.Hash)
-		pow := NewProofOfWork(block)
-		fmt.Printf("PoW: %s\n", strconv.FormatBool(pow.Validate()))
+	hi := bc.HeaderRangeIterator(BlockRange{From: from, To: to, Reverse: true})
+	for header, ok := hi.Next(); ok; header, ok = hi.Next() {
+		fmt.Printf("Height: %d\n", header.Height)
+		fmt.Printf("Prev. hash: %x\n", header.PreHash)
+		fmt.Printf("Transactions: %x\n", header.TxHash)
+		fmt.Printf("Witnesses: %x\n", header.WitnessHash)
+		fmt.Printf("Hash: %x\n", header.Hash)
+		fmt.Printf("Bits: %08x\n", header.Bits)
+		fmt.Printf("Seal: %s\n", strconv.FormatBool(bc.Engine.VerifySeal(bc, header) == nil))
 		fmt.Println()
-
-		if len(block.PreHash) == 0 {
-			break
-		}
 	}
+	return hi.Err()
 }
 
 // 创建钱包
-func (cli *CLI) createWallet() {
-	wallets, _ := NewWallets()
-	address := wallets.CreateWallet()
-	wallets.SaveToFile()
+func (cli *CLI) createWallet(nodeID string) error {
+	wallets, err := NewWallets(cli.params, nodeID)
+	if err != nil {
+		return err
+	}
+	address, err := wallets.CreateWallet()
+	if err != nil {
+		return err
+	}
+	if err := wallets.SaveToFile(); err != nil {
+		return err
+	}
 
 	fmt.Printf("Your new address: %s\n", address)
+	return nil
 }
 
 // 打印地址
-func (cli *CLI) listaddr() {
-	wallets, err := NewWallets()
+func (cli *CLI) listaddr(nodeID string) error {
+	wallets, err := NewWallets(cli.params, nodeID)
 	if err != nil {
-		log.Panic(err)
+		return err
 	}
 	addresses := wallets.GetAddresses()
 
 	for _, address := range addresses {
 		fmt.Println(address)
 	}
+	return nil
 }
 
 // 转账
-func (cli *CLI) transfer(from, to string, amount int) {
-	if !ValidateAddress(from) {
-		log.Panic("ERROR: Sender address is not valid")
+// mineNow 为 true 时在本地挖出新区块并推送给 node，否则把交易发送给 node 打包
+// lockTime 和 afterHeight 为交易的锁定时间和每个输入的相对锁定区块数，交易要在锁定到期后才能提交
+func (cli *CLI) transfer(from, to string, amount int, lockTime int64, afterHeight uint32, nodeID string, mineNow bool, node, out string) error {
+	if !cli.params.ValidateAddress(from) {
+		return fmt.Errorf("%w: sender %s", ErrInvalidAddress, from)
 	}
-	if !ValidateAddress(to) {
-		log.Panic("ERROR: Recipient address is not valid")
+	if _, err := cli.params.AddressScript(to); err != nil {
+		return fmt.Errorf("recipient: %w", err)
 	}
 
-	bc := GetBlockchain()
+	bc, err := GetBlockchain(cli.params, nodeID)
+	if err != nil {
+		return err
+	}
 	UTXOSet := UTXOSet{bc}
 	defer bc.Db.Close()
 
-	wallets, err := NewWallets()
+	wallets, err := NewWallets(cli.params, nodeID)
+	if err != nil {
+		return err
+	}
+
+	wallet, err := wallets.GetWallet(from)
+	if err != nil {
+		return err
+	}
+	tx, err := NewTransaction(wallet, to, amount, lockTime, afterHeight, &UTXOSet)
+	if err != nil {
+		return err
+	}
+	// 指定了 out 时只保存签名后的交易，锁定的交易可以等到能够打包时再用 sendrawtx 提交
+	if out != "" {
+		if err := tx.SaveToFile(out); err != nil {
+			return err
+		}
+		fmt.Printf("Transaction %x is saved to %s\n", tx.ID, out)
+		return nil
+	}
+	// 节点不接受还不能打包的交易，提前检查给出明确的错误
+	if err := UTXOSet.CheckFinal(tx); err != nil {
+		if errors.Is(err, ErrTxNotFinal) {
+			return fmt.Errorf("%w; save it with -out and send it with sendrawtx once it is final", err)
+		}
+		return err
+	}
+
+	if err := cli.submitTransaction(bc, tx, nodeID, mineNow, from, node); err != nil {
+		return err
+	}
+	fmt.Printf("%s transfers %d coin to %s\n", from, amount, to)
+	return nil
+}
+
+// 提交 transfer -out 保存的交易，交易还不能打包时返回错误，文件保持不变，可以之后再次提交
+func (cli *CLI) sendRawTx(file, nodeID string, mineNow bool, miner, node string) error {
+	if mineNow && !cli.params.ValidateAddress(miner) {
+		return fmt.Errorf("%w: miner %s", ErrInvalidAddress, miner)
+	}
+
+	tx, err := LoadTransaction(file)
+	if err != nil {
+		return err
+	}
+
+	bc, err := GetBlockchain(cli.params, nodeID)
 	if err != nil {
-		log.Panic(err)
+		return err
+	}
+	defer bc.Db.Close()
+
+	if err := bc.VerifyTransaction(tx); err != nil {
+		return err
 	}
+	if err := (UTXOSet{bc}).CheckFinal(tx); err != nil {
+		return err
+	}
+	if err := cli.submitTransaction(bc, tx, nodeID, mineNow, miner, node); err != nil {
+		return err
+	}
+	fmt.Printf("Transaction %x sent\n", tx.ID)
+	return nil
+}
 
-	wallet := wallets.GetWallet(from)
-	tx := NewTransaction(&wallet, to, amount, &UTXOSet)
+// 提交交易：mineNow 为 true 时在本地挖出包含交易的新区块并推送给 node，奖励给 miner，否则把交易发送给 node 打包
+func (cli *CLI) submitTransaction(bc *Blockchain, tx *Transaction, nodeID string, mineNow bool, miner, node string) error {
+	if !mineNow {
+		return SendTransaction(nodeID, node, tx)
+	}
 
-	cbTx := NewRewardTX(from, "")
+	// PoA 链上由 miner 签名区块，miner 必须是当前轮到的出块者
+	if err := bc.UseSigner(nodeID, miner); err != nil {
+		return err
+	}
+	reward, err := bc.MinerReward([]*Transaction{tx})
+	if err != nil {
+		return err
+	}
+	cbTx, err := NewRewardTX(bc.Params, miner, "", reward)
+	if err != nil {
+		return err
+	}
 	txs := []*Transaction{cbTx, tx}
 
-	newBlock := bc.AddBlock(txs)
-	UTXOSet.Update(newBlock)
-	fmt.Printf("%s transfers %d coin to %s\n", from, amount, to)
+	newBlock, err := bc.AddBlock(txs)
+	if err != nil {
+		return err
+	}
+	return BroadcastBlock(nodeID, node, newBlock)
 }
 
 // 获取余额
-func (cli *CLI) getBalance(address string) {
-
-	if !ValidateAddress(address) {
-		log.Panic("ERROR: Address is not valid")
+func (cli *CLI) getBalance(address, nodeID string) error {
+	script, err := cli.params.AddressScript(address)
+	if err != nil {
+		return err
+	}
+	bc, err := GetBlockchain(cli.params, nodeID)
+	if err != nil {
+		return err
 	}
-	bc := GetBlockchain()
 	UTXOSet := UTXOSet{bc}
 	defer bc.Db.Close()
 
 	balance := 0
-	pubKeyHash := Base58Decode([]byte(address))
-	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-4]
-	UTXOs := UTXOSet.FindUTXO(pubKeyHash)
+	UTXOs, err := UTXOSet.FindUTXO(script)
+	if err != nil {
+		return err
+	}
 
 	for _, out := range UTXOs {
 		balance += out.Value
 	}
 
 	fmt.Printf("Balance of '%s': %d\n", address, balance)
+	return nil
+}
+
+// 分页输出地址的交易记录
+func (cli *CLI) history(address, nodeID string, page, pageSize int) error {
+	script, err := cli.params.AddressScript(address)
+	if err != nil {
+		return err
+	}
+	bc, err := GetBlockchain(cli.params, nodeID)
+	if err != nil {
+		return err
+	}
+	defer bc.Db.Close()
+
+	bestHeight, err := bc.Height()
+	if err != nil {
+		return err
+	}
+	history, total, err := bc.AddressHistory(scriptAddressHash(script), (page-1)*pageSize, pageSize)
+	if err != nil {
+		return err
+	}
+
+	pages := (total + pageSize - 1) / pageSize
+	fmt.Printf("History of '%s': %d transactions, page %d/%d\n", address, total, page, pages)
+	for _, item := range history {
+		direction := "in"
+		if item.Delta < 0 {
+			direction = "out"
+		}
+		fmt.Printf("%x %-3s %+d height %d confirmations %d\n", item.TxID, direction, item.Delta, item.Height, bestHeight-item.Height+1)
+	}
+	return nil
+}
+
+// 启动节点
+func (cli *CLI) startNode(nodeID, minerAddress, seedNode string) error {
+	fmt.Printf("Starting node %s\n", nodeID)
+	if len(minerAddress) > 0 {
+		if !cli.params.ValidateAddress(minerAddress) {
+			return fmt.Errorf("%w: miner %s", ErrInvalidAddress, minerAddress)
+		}
+		fmt.Println("Mining is on. Address to receive rewards: ", minerAddress)
+	}
+	return StartServer(cli.params, nodeID, minerAddress, seedNode)
+}
+
+// 启动节点并持续挖矿
+func (cli *CLI) mine(address, nodeID, seedNode string) error {
+	if !cli.params.ValidateAddress(address) {
+		return fmt.Errorf("%w: miner %s", ErrInvalidAddress, address)
+	}
+	fmt.Printf("Starting node %s, mining to %s\n", nodeID, address)
+	return StartMiner(cli.params, nodeID, address, seedNode)
+}
+
+// 作废区块，回滚它以及之后的区块
+func (cli *CLI) invalidateBlock(hash, nodeID string) error {
+	blockHash, err := hex.DecodeString(hash)
+	if err != nil {
+		return fmt.Errorf("invalid block hash %s: %v", hash, err)
+	}
+
+	bc, err := GetBlockchain(cli.params, nodeID)
+	if err != nil {
+		return err
+	}
+	defer bc.Db.Close()
+
+	change, err := bc.InvalidateBlock(blockHash)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Block %s invalidated, %d blocks disconnected\n", hash, len(change.Disconnected))
+	return nil
+}
+
+// 输出交易的 Merkle 证明
+func (cli *CLI) proveTx(txid, nodeID string) error {
+	id, err := hex.DecodeString(txid)
+	if err != nil {
+		return fmt.Errorf("invalid txid %s: %v", txid, err)
+	}
+
+	bc, err := GetBlockchain(cli.params, nodeID)
+	if err != nil {
+		return err
+	}
+	defer bc.Db.Close()
+
+	block, proof, err := bc.ProveTransaction(id)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Transaction: %x\n", proof.TxID)
+	fmt.Printf("Block: %x\n", block.Hash)
+	fmt.Printf("Height: %d\n", block.Height)
+	fmt.Printf("Merkle root: %x\n", block.TxHash)
+	fmt.Printf("Index: %d\n", proof.Index)
+	for i, hash := range proof.Branch {
+		fmt.Printf("Branch %d: %x\n", i, hash)
+	}
+	fmt.Printf("Verified: %s\n", strconv.FormatBool(proof.Verify(block.TxHash)))
+	return nil
+}
+
+// 重建交易索引，建立之后索引随区块的连接和断开自动更新
+func (cli *CLI) reindexTx(nodeID string) error {
+	bc, err := GetBlockchain(cli.params, nodeID)
+	if err != nil {
+		return err
+	}
+	defer bc.Db.Close()
+
+	count, err := bc.ReindexTransactions()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Done! There are %d transactions in the transaction index.\n", count)
+	return nil
+}
+
+// 把旧编码的数据库转换成当前的编码，原文件保留为 .old 后缀
+func (cli *CLI) migrateDb(nodeID string) error {
+	blocks, legacy, err := MigrateDb(cli.params, nodeID)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Migrated %d blocks, the old database is kept as %s\n", blocks, cli.params.dbFileName(nodeID)+".old")
+	if legacy != nil {
+		fmt.Printf("The migrated chain fails the current consensus rules: %v\n", legacy)
+		fmt.Println("It can still be queried locally, but startnode will refuse to serve it to other nodes")
+	}
+	return nil
+}
+
+// 输出本地钱包地址的公钥，用于创建多签地址
+// 多签脚本只接受64字节的公钥，早期版本钱包的短公钥输出补齐后的形式
+func (cli *CLI) getPubKey(address, nodeID string) error {
+	wallets, err := NewWallets(cli.params, nodeID)
+	if err != nil {
+		return err
+	}
+	wallet, err := wallets.GetWallet(address)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%x\n", marshalPubKey(&wallet.PrivateKey.PublicKey))
+	return nil
+}
+
+// 创建多签地址，赎回脚本保存在钱包文件中，之后可以用 spendmultisig 花费
+// 各个参与者使用相同的公钥顺序时得到相同的地址
+func (cli *CLI) createMultisig(required int, pubKeys, nodeID string) error {
+	var keys [][]byte
+	for _, pubKey := range strings.Split(pubKeys, ",") {
+		key, err := hex.DecodeString(strings.TrimSpace(pubKey))
+		if err != nil {
+			return fmt.Errorf("invalid public key %s: %v", pubKey, err)
+		}
+		keys = append(keys, key)
+	}
+	redeemScript, err := NewMultisigScript(required, keys)
+	if err != nil {
+		return err
+	}
+
+	wallets, err := NewWallets(cli.params, nodeID)
+	if err != nil {
+		return err
+	}
+	address := wallets.AddScript(redeemScript)
+	if err := wallets.SaveToFile(); err != nil {
+		return err
+	}
+
+	fmt.Printf("Multisig address: %s\n", address)
+	fmt.Printf("Redeem script: %x\n", redeemScript)
+	return nil
+}
+
+// 创建花费多签地址的未签名交易，写入 out 文件，交给参与者用 signmultisig 签名
+func (cli *CLI) spendMultisig(from, to string, amount int, out, nodeID string) error {
+	if _, err := cli.params.AddressScript(to); err != nil {
+		return fmt.Errorf("recipient: %w", err)
+	}
+
+	wallets, err := NewWallets(cli.params, nodeID)
+	if err != nil {
+		return err
+	}
+	redeemScript, err := wallets.GetScript(from)
+	if err != nil {
+		return err
+	}
+
+	bc, err := GetBlockchain(cli.params, nodeID)
+	if err != nil {
+		return err
+	}
+	defer bc.Db.Close()
+
+	mtx, err := NewMultisigTransaction(redeemScript, to, amount, &UTXOSet{bc})
+	if err != nil {
+		return err
+	}
+	if err := mtx.SaveToFile(out); err != nil {
+		return err
+	}
+
+	_, need, err := mtx.SignatureCount()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Transaction %x written to %s, %d signatures required\n", mtx.Tx.ID, out, need)
+	return nil
+}
+
+// 用本地钱包地址签名多签交易，签名写回原文件
+// 签名不需要访问区块链，签名者可以在没有节点的机器上完成
+func (cli *CLI) signMultisig(file, address, nodeID string, yes bool) error {
+	mtx, err := LoadMultisigTx(file)
+	if err != nil {
+		return err
+	}
+
+	// 签名前列出交易的输出，签名者确认付款对象和金额，不对没看过的交易签名
+	from := cli.params.ScriptAddress(mtx.RedeemScript)
+	fmt.Printf("Transaction %x spends %d outputs of %s\n", mtx.Tx.ID, len(mtx.Tx.Vin), from)
+	for i, out := range mtx.Tx.Vout {
+		to := cli.params.OutputAddress(out.ScriptPubKey)
+		if to == "" {
+			to = fmt.Sprintf("script %x", out.ScriptPubKey)
+		} else if to == from {
+			to += " (change)"
+		}
+		fmt.Printf("  output %d: %d to %s\n", i, out.Value, to)
+	}
+	if mtx.Tx.LockTime != 0 {
+		fmt.Printf("  lock time: %d\n", mtx.Tx.LockTime)
+	}
+	if !yes && !confirm("Sign this transaction?") {
+		return errors.New("signing canceled")
+	}
+
+	wallets, err := NewWallets(cli.params, nodeID)
+	if err != nil {
+		return err
+	}
+	wallet, err := wallets.GetWallet(address)
+	if err != nil {
+		return err
+	}
+
+	if err := mtx.Sign(wallet); err != nil {
+		return err
+	}
+	if err := mtx.SaveToFile(file); err != nil {
+		return err
+	}
+
+	have, need, err := mtx.SignatureCount()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s signed transaction %x, %d of %d signatures\n", address, mtx.Tx.ID, have, need)
+	return nil
+}
+
+// 在终端询问用户，输入 y 或 yes 时返回 true
+func confirm(question string) bool {
+	fmt.Printf("%s [y/N] ", question)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+// 用收集到的签名完成多签交易并提交
+func (cli *CLI) sendMultisig(file, nodeID string, mineNow bool, miner, node string) error {
+	if mineNow && !cli.params.ValidateAddress(miner) {
+		return fmt.Errorf("%w: miner %s", ErrInvalidAddress, miner)
+	}
+
+	mtx, err := LoadMultisigTx(file)
+	if err != nil {
+		return err
+	}
+	tx, err := mtx.Finalize()
+	if err != nil {
+		return err
+	}
+
+	bc, err := GetBlockchain(cli.params, nodeID)
+	if err != nil {
+		return err
+	}
+	defer bc.Db.Close()
+
+	if err := bc.VerifyTransaction(tx); err != nil {
+		return err
+	}
+	if err := cli.submitTransaction(bc, tx, nodeID, mineNow, miner, node); err != nil {
+		return err
+	}
+	fmt.Printf("Multisig transaction %x sent\n", tx.ID)
+	return nil
 }
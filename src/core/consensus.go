@@ -0,0 +1,179 @@
+package core
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	// 工作量证明
+	ConsensusPoW = "pow"
+	// 权威证明，由配置的公钥轮流签名出块，适合私有测试网络
+	ConsensusPoA = "poa"
+)
+
+// 链使用的共识配置保存在 meta bucket 中的这个 key 下，原始配置记录在创世区块的奖励交易中，见 genesisInfo
+const consensusConfigKey = "consensus"
+
+// 区块的封装不满足共识规则
+var ErrBadSeal = fmt.Errorf("%w: invalid block seal", ErrInvalidBlock)
+
+// 共识引擎，决定区块如何封装、如何验证以及区块的难度
+type ConsensusEngine interface {
+	// 引擎名称，和 ConsensusConfig.Engine 一致
+	Name() string
+	// 计算接在 parentHash 之后的区块的难度（区块头中的 Bits），parentHash 为空时返回创世区块的难度
+	CalcDifficulty(chain HeaderReader, parentHash []byte) (uint32, error)
+	// 封装区块：填充区块头中的 Nonce、Hash、Signature 等字段，使区块满足共识规则
+	// ctx 被取消时放弃封装并返回 ctx 的错误
+	Seal(ctx context.Context, chain HeaderReader, block *Block) error
+	// 验证区块头的封装是否满足共识规则
+	VerifySeal(chain HeaderReader, header *BlockHeader) error
+	// 区块的工作量，主链是累计工作量最大的链
+	Work(header *BlockHeader) *big.Int
+}
+
+// 共识引擎读取链上区块头的接口
+type HeaderReader interface {
+	GetBlockHeader(hash []byte) (*BlockHeader, error)
+}
+
+// 在数据库事务内读取区块头，供事务中调用共识引擎时使用
+type txHeaderReader struct {
+	tx *bolt.Tx
+}
+
+func (r txHeaderReader) GetBlockHeader(hash []byte) (*BlockHeader, error) {
+	return getBlockHeader(r.tx, hash)
+}
+
+// 共识配置，创建链时选择，记录在创世区块的奖励交易中
+type ConsensusConfig struct {
+	Engine string `json:"engine"`
+	// PoA：按顺序轮流出块的公钥（十六进制），高度为 h 的区块由第 h % len(Authorities) 个公钥签名
+	Authorities []string `json:"authorities,omitempty"`
+	// PoA：两个区块之间的最小间隔（秒）
+	Period int64 `json:"period,omitempty"`
+}
+
+// 默认使用工作量证明
+var DefaultConsensusConfig = ConsensusConfig{Engine: ConsensusPoW}
+
+// 根据配置创建共识引擎
+func NewConsensusEngine(params *ChainParams, config ConsensusConfig) (ConsensusEngine, error) {
+	switch config.Engine {
+	case ConsensusPoW:
+		return NewPoWEngine(params), nil
+	case ConsensusPoA:
+		if len(config.Authorities) == 0 {
+			return nil, errors.New("PoA requires at least one authority")
+		}
+		var authorities [][]byte
+		for _, authority := range config.Authorities {
+			pubKey, err := hex.DecodeString(authority)
+			if err != nil {
+				return nil, fmt.Errorf("invalid authority %s: %v", authority, err)
+			}
+			authorities = append(authorities, pubKey)
+		}
+		return NewPoAEngine(authorities, config.Period), nil
+	default:
+		return nil, fmt.Errorf("unknown consensus engine %q", config.Engine)
+	}
+}
+
+// 以 JSON 形式记录在创世区块奖励交易中的数据
+type genesisInfo struct {
+	Network   string          `json:"network"`
+	Data      string          `json:"data,omitempty"`
+	Consensus ConsensusConfig `json:"consensus"`
+}
+
+// 创世区块奖励交易中附带的数据
+func genesisRewardData(params *ChainParams, consensus ConsensusConfig) (string, error) {
+	data, err := json.Marshal(genesisInfo{params.Name, params.GenesisData, consensus})
+	return string(data), err
+}
+
+// 读取链的共识配置并创建引擎
+// meta bucket 中没有记录时（旧版本创建的数据库）从创世区块中读取并补记，创世区块中也没有时使用工作量证明
+func loadConsensusEngine(tx *bolt.Tx, params *ChainParams) (ConsensusEngine, error) {
+	meta, err := tx.CreateBucketIfNotExists([]byte(metaBucket))
+	if err != nil {
+		return nil, err
+	}
+
+	var config ConsensusConfig
+	if data := meta.Get([]byte(consensusConfigKey)); data != nil {
+		if err := json.Unmarshal(data, &config); err != nil {
+			return nil, err
+		}
+	} else {
+		if config, err = genesisConsensusConfig(tx); err != nil {
+			return nil, err
+		}
+		if err := putConsensusConfig(tx, config); err != nil {
+			return nil, err
+		}
+	}
+
+	return NewConsensusEngine(params, config)
+}
+
+// 解析创世区块奖励交易中记录的共识配置
+// 更早的版本只记录了共识配置本身，再早的版本没有记录，使用工作量证明
+func genesisConsensusConfig(tx *bolt.Tx) (ConsensusConfig, error) {
+	hash, err := genesisHash(tx)
+	if err != nil {
+		return ConsensusConfig{}, err
+	}
+	genesis, err := getBlock(tx, hash)
+	if err != nil {
+		return ConsensusConfig{}, err
+	}
+	data := genesis.Transactions[0].Vin[0].ScriptSig
+
+	var info genesisInfo
+	if err := json.Unmarshal(data, &info); err == nil && info.Consensus.Engine != "" {
+		return info.Consensus, nil
+	}
+	var config ConsensusConfig
+	if err := json.Unmarshal(data, &config); err == nil && config.Engine != "" {
+		return config, nil
+	}
+	return DefaultConsensusConfig, nil
+}
+
+// 从 tip 回溯到创世区块，返回创世区块的 hash
+func genesisHash(tx *bolt.Tx) ([]byte, error) {
+	hash := tx.Bucket([]byte(blocksBucket)).Get([]byte("last"))
+	for {
+		header, err := getBlockHeader(tx, hash)
+		if err != nil {
+			return nil, err
+		}
+		if len(header.PreHash) == 0 {
+			return header.Hash, nil
+		}
+		hash = header.PreHash
+	}
+}
+
+// 保存共识配置
+func putConsensusConfig(tx *bolt.Tx, config ConsensusConfig) error {
+	meta, err := tx.CreateBucketIfNotExists([]byte(metaBucket))
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	return meta.Put([]byte(consensusConfigKey), data)
+}
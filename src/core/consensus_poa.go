@@ -0,0 +1,155 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+)
+
+// PoA 区块的 Bits 固定为这个值，每个区块的工作量都是 1，主链就是最长的链
+const poaBits = 1
+
+// 当前高度不轮到本节点的公钥签名
+var ErrNotInTurn = errors.New("not in turn to seal the block")
+
+// 权威证明共识引擎
+// 高度为 h 的区块必须由第 h % len(authorities) 个公钥签名，相邻区块的时间间隔不小于 period 秒
+type PoAEngine struct {
+	authorities [][]byte
+	period      int64
+	// 本节点出块时用来签名的钱包，只验证区块时可以为空
+	Signer *Wallet
+}
+
+func NewPoAEngine(authorities [][]byte, period int64) *PoAEngine {
+	return &PoAEngine{authorities: authorities, period: period}
+}
+
+func (e *PoAEngine) Name() string {
+	return ConsensusPoA
+}
+
+func (e *PoAEngine) CalcDifficulty(chain HeaderReader, parentHash []byte) (uint32, error) {
+	return poaBits, nil
+}
+
+// 轮到签名者出块时，等到距父区块 period 秒之后再签名
+// 创世区块不需要签名
+func (e *PoAEngine) Seal(ctx context.Context, chain HeaderReader, block *Block) error {
+	if block.Height == 0 {
+		block.Nonce = 0
+		block.Hash = poaHash(&block.BlockHeader)
+		return nil
+	}
+
+	if e.Signer == nil {
+		return errors.New("PoA signer is not set")
+	}
+	if !bytes.Equal(e.Signer.PublicKey, e.inTurn(block.Height)) {
+		return ErrNotInTurn
+	}
+
+	parent, err := chain.GetBlockHeader(block.PreHash)
+	if err != nil {
+		return err
+	}
+	if earliest := parent.Timestamp + e.period; block.Timestamp < earliest {
+		block.Timestamp = earliest
+	}
+	if wait := time.Until(time.Unix(block.Timestamp, 0)); wait > 0 {
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	block.Nonce = 0
+	block.Hash = poaHash(&block.BlockHeader)
+	r, s, err := ecdsa.Sign(rand.Reader, &e.Signer.PrivateKey, block.Hash)
+	if err != nil {
+		return err
+	}
+	// r 和 s 各占固定的 32 字节
+	block.Signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	return nil
+}
+
+// 验证区块 hash、出块间隔以及轮值公钥的签名
+func (e *PoAEngine) VerifySeal(chain HeaderReader, header *BlockHeader) error {
+	if header.Bits != poaBits || header.Nonce != 0 {
+		return fmt.Errorf("%w: unexpected bits or nonce", ErrBadSeal)
+	}
+	if !bytes.Equal(header.Hash, poaHash(header)) {
+		return fmt.Errorf("%w: hash mismatch", ErrBadSeal)
+	}
+	if header.Height == 0 {
+		return nil
+	}
+
+	parent, err := chain.GetBlockHeader(header.PreHash)
+	if err != nil {
+		return err
+	}
+	if header.Timestamp < parent.Timestamp+e.period {
+		return fmt.Errorf("%w: block is sealed too early", ErrBadSeal)
+	}
+
+	pubKey := e.inTurn(header.Height)
+	if len(header.Signature) != 64 || len(pubKey) != 64 {
+		return fmt.Errorf("%w: malformed signature", ErrBadSeal)
+	}
+	rawPubKey := ecdsa.PublicKey{
+		Curve: elliptic.P256(),
+		X:     new(big.Int).SetBytes(pubKey[:32]),
+		Y:     new(big.Int).SetBytes(pubKey[32:]),
+	}
+	r := new(big.Int).SetBytes(header.Signature[:32])
+	s := new(big.Int).SetBytes(header.Signature[32:])
+	if !ecdsa.Verify(&rawPubKey, header.Hash, r, s) {
+		return fmt.Errorf("%w: block %x is not signed by authority %d", ErrBadSeal, header.Hash, header.Height%len(e.authorities))
+	}
+
+	return nil
+}
+
+func (e *PoAEngine) Work(header *BlockHeader) *big.Int {
+	return big.NewInt(1)
+}
+
+// 负责签名高度为 height 的区块的公钥
+func (e *PoAEngine) inTurn(height int) []byte {
+	return e.authorities[height%len(e.authorities)]
+}
+
+// PoA 区块的 hash，和工作量证明使用相同的区块头数据，nonce 固定为 0，签名不参与计算
+func poaHash(header *BlockHeader) []byte {
+	hash := sha256.Sum256(header.hashData(0))
+	return hash[:]
+}
+
+// PoA 链上使用本地钱包中 address 对应的私钥签名区块，其他共识不需要签名者
+func (bc *Blockchain) UseSigner(nodeID, address string) error {
+	poa, ok := bc.Engine.(*PoAEngine)
+	if !ok {
+		return nil
+	}
+
+	wallets, err := NewWallets(bc.Params, nodeID)
+	if err != nil {
+		return err
+	}
+	wallet, err := wallets.GetWallet(address)
+	if err != nil {
+		return err
+	}
+	poa.Signer = wallet
+	return nil
+}
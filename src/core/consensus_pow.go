@@ -0,0 +1,84 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+// 工作量证明共识引擎
+type PoWEngine struct {
+	params *ChainParams
+	// 并行计算工作量证明的 goroutine 数量
+	Workers int
+	// 累计尝试过的 hash 数量，用于计算算力
+	hashes uint64
+}
+
+func NewPoWEngine(params *ChainParams) *PoWEngine {
+	return &PoWEngine{params: params, Workers: runtime.NumCPU()}
+}
+
+func (e *PoWEngine) Name() string {
+	return ConsensusPoW
+}
+
+// 难度每 retargetInterval 个区块根据出块时间调整一次，见 difficulty.go
+func (e *PoWEngine) CalcDifficulty(chain HeaderReader, parentHash []byte) (uint32, error) {
+	return calcNextBits(e.params, chain, parentHash)
+}
+
+// 对区块进行工作量证明，成功时填充 Nonce 和 Hash
+// nonce 用完后修改区块再继续：本地时间已经前进就更新时间戳，否则修改奖励交易中的 extra nonce，使 Merkle 根发生变化
+func (e *PoWEngine) Seal(ctx context.Context, chain HeaderReader, block *Block) error {
+	rewardData := block.Transactions[0].Vin[0].ScriptSig
+	extraNonce := int64(0)
+
+	for {
+		nonce, hash, hashes, err := NewProofOfWork(&block.BlockHeader).RunParallel(ctx, e.Workers)
+		atomic.AddUint64(&e.hashes, hashes)
+		if err == nil {
+			block.Nonce = nonce
+			block.Hash = hash
+			return nil
+		}
+		if !errors.Is(err, ErrNonceExhausted) {
+			return err
+		}
+
+		if now := time.Now().Unix(); now > block.Timestamp {
+			block.Timestamp = now
+			continue
+		}
+		extraNonce++
+		reward := block.Transactions[0]
+		reward.Vin[0].ScriptSig = append(append([]byte{}, rewardData...), Int2Hex(extraNonce)...)
+		reward.SetID()
+		block.setTxCommitments()
+	}
+}
+
+// 区块头的 Bits 必须等于共识规则计算出的难度，hash 满足对应的目标
+func (e *PoWEngine) VerifySeal(chain HeaderReader, header *BlockHeader) error {
+	bits, err := calcNextBits(e.params, chain, header.PreHash)
+	if err != nil {
+		return err
+	}
+	if !NewProofOfWork(header).Validate(bits) {
+		return fmt.Errorf("%w: block %x", ErrBadProofOfWork, header.Hash)
+	}
+	return nil
+}
+
+func (e *PoWEngine) Work(header *BlockHeader) *big.Int {
+	return NewProofOfWork(header).Work()
+}
+
+// 累计尝试过的 hash 数量
+func (e *PoWEngine) Hashes() uint64 {
+	return atomic.LoadUint64(&e.hashes)
+}
@@ -0,0 +1,101 @@
+package core
+
+import (
+	"math/big"
+)
+
+// 和比特币一样，单次调整最多把难度变为原来的 4 倍或 1/4
+// 调整间隔、期望的出块间隔和最低难度由链参数决定，见 chain_params.go
+const retargetAdjustmentFactor = 4
+
+// 把目标值转换为紧凑格式（与比特币区块头中的 nBits 相同）
+// 最高字节是字节长度，低 3 个字节是目标值的最高有效位
+func BigToCompact(n *big.Int) uint32 {
+	if n.Sign() == 0 {
+		return 0
+	}
+
+	var mantissa uint32
+	exponent := uint(len(n.Bytes()))
+	if exponent <= 3 {
+		mantissa = uint32(n.Bits()[0])
+		mantissa <<= 8 * (3 - exponent)
+	} else {
+		tn := new(big.Int).Rsh(n, 8*(exponent-3))
+		mantissa = uint32(tn.Bits()[0])
+	}
+
+	// 尾数的最高位是符号位，被占用时需要多用一个字节
+	if mantissa&0x00800000 != 0 {
+		mantissa >>= 8
+		exponent++
+	}
+
+	return uint32(exponent<<24) | mantissa
+}
+
+// 把紧凑格式还原为目标值
+func CompactToBig(compact uint32) *big.Int {
+	mantissa := compact & 0x007fffff
+	exponent := uint(compact >> 24)
+
+	var bn *big.Int
+	if exponent <= 3 {
+		mantissa >>= 8 * (3 - exponent)
+		bn = big.NewInt(int64(mantissa))
+	} else {
+		bn = big.NewInt(int64(mantissa))
+		bn.Lsh(bn, 8*(exponent-3))
+	}
+
+	return bn
+}
+
+// 工作量证明下，接在 parentHash 之后的区块应当使用的 Bits
+// 不是调整周期的第一个区块时沿用父区块的难度；否则根据上一个周期实际花费的时间按比例调整目标值，
+// 实际时间限制在期望时间的 1/4 到 4 倍之间，调整后的目标值不能超过 powLimit。
+// 区块沿 PreHash 回溯查找，因此分叉上的区块也能得到正确的结果。链参数指定不调整难度时始终使用最低难度
+func calcNextBits(params *ChainParams, chain HeaderReader, parentHash []byte) (uint32, error) {
+	if len(parentHash) == 0 || params.NoRetargeting {
+		return params.PowLimitBits(), nil
+	}
+
+	parent, err := chain.GetBlockHeader(parentHash)
+	if err != nil {
+		return 0, err
+	}
+	// 从旧编码转换来的区块没有记录难度，Bits 为0，按最低难度处理，否则目标值为0，永远挖不出区块
+	parentBits := parent.Bits
+	if parentBits == 0 {
+		parentBits = params.PowLimitBits()
+	}
+	if (parent.Height+1)%params.RetargetInterval != 0 {
+		return parentBits, nil
+	}
+
+	first := parent
+	for i := 0; i < params.RetargetInterval-1; i++ {
+		first, err = chain.GetBlockHeader(first.PreHash)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	targetTimespan := params.targetTimespan()
+	actualTimespan := parent.Timestamp - first.Timestamp
+	if actualTimespan < targetTimespan/retargetAdjustmentFactor {
+		actualTimespan = targetTimespan / retargetAdjustmentFactor
+	}
+	if actualTimespan > targetTimespan*retargetAdjustmentFactor {
+		actualTimespan = targetTimespan * retargetAdjustmentFactor
+	}
+
+	newTarget := CompactToBig(parentBits)
+	newTarget.Mul(newTarget, big.NewInt(actualTimespan))
+	newTarget.Div(newTarget, big.NewInt(targetTimespan))
+	if powLimit := params.PowLimit(); newTarget.Cmp(powLimit) > 0 {
+		newTarget.Set(powLimit)
+	}
+
+	return BigToCompact(newTarget), nil
+}
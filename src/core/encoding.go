@@ -0,0 +1,345 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// 区块和交易的规范二进制编码，用于计算交易hash、写入数据库和网络传输
+// 不依赖 Go 的类型信息，其他语言可以按下面的格式重新计算交易ID：
+//
+//	整数      有符号整数使用 zigzag varint，无符号整数使用 uvarint，都必须是最短编码
+//	字节串    uvarint 长度 + 内容
+//	TXInput   Txid, Vout, ScriptSig, Sequence
+//	TXOutput  Value, ScriptPubKey
+//	交易      ID, 输入个数, 输入..., 输出个数, 输出..., LockTime
+//	区块头    Timestamp, TxHash, WitnessHash, PreHash, Hash, Nonce, Height, Bits, Signature
+//	区块      区块头, 交易个数, 交易...
+//	UTXO      Height, TXOutput
+//	撤销数据  被花费输出个数, (Txid, Vout, Height, TXOutput)...
+//	区块索引  Height, ChainWork, Invalid
+//
+// 布尔值使用 uvarint 0 或 1
+// 单独序列化的交易、输出、UTXO、区块头、区块、撤销数据和区块索引前面有1字节的编码版本，区块中的交易不再重复版本
+// 计算交易ID时 ID 为空，普通交易输入的 ScriptSig 也为空，见 Transaction.Hash
+// 版本1的输入直接保存签名和公钥，输出直接保存公钥hash，版本2改为脚本，版本3加入 Sequence 和 LockTime，版本4的区块头加入 WitnessHash
+// 版本号参与交易ID的计算，只有格式变化时才能修改
+const encodingVersion = 4
+
+// 数据不符合规范编码
+var ErrInvalidEncoding = errors.New("invalid encoding")
+
+// 编码器，写入 bytes.Buffer 不会失败，所以不返回错误
+type encoder struct {
+	buf bytes.Buffer
+}
+
+func (e *encoder) uvarint(v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	e.buf.Write(b[:binary.PutUvarint(b[:], v)])
+}
+
+func (e *encoder) varint(v int64) {
+	var b [binary.MaxVarintLen64]byte
+	e.buf.Write(b[:binary.PutVarint(b[:], v)])
+}
+
+func (e *encoder) bytes(data []byte) {
+	e.uvarint(uint64(len(data)))
+	e.buf.Write(data)
+}
+
+func (e *encoder) bool(v bool) {
+	if v {
+		e.uvarint(1)
+	} else {
+		e.uvarint(0)
+	}
+}
+
+func (e *encoder) version() {
+	e.buf.WriteByte(encodingVersion)
+}
+
+// 解码器，出错后后续的读取都返回零值，最后通过 finish 检查错误
+type decoder struct {
+	data []byte
+	err  error
+	// 数据的编码版本，由 version 读取，转换旧数据库时按旧版本解码
+	ver int
+}
+
+func (d *decoder) fail(format string, args ...interface{}) {
+	if d.err == nil {
+		d.err = fmt.Errorf("%w: %s", ErrInvalidEncoding, fmt.Sprintf(format, args...))
+	}
+}
+
+func (d *decoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.data)
+	if n <= 0 {
+		d.fail("bad uvarint")
+		return 0
+	}
+	// 不接受非最短的编码，保证同一个值只有一种编码
+	var b [binary.MaxVarintLen64]byte
+	if binary.PutUvarint(b[:], v) != n {
+		d.fail("non-canonical uvarint")
+		return 0
+	}
+	d.data = d.data[n:]
+	return v
+}
+
+func (d *decoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.data)
+	if n <= 0 {
+		d.fail("bad varint")
+		return 0
+	}
+	var b [binary.MaxVarintLen64]byte
+	if binary.PutVarint(b[:], v) != n {
+		d.fail("non-canonical varint")
+		return 0
+	}
+	d.data = d.data[n:]
+	return v
+}
+
+// 读取的字节串是新分配的，不引用输入数据（bolt 返回的数据只在事务内有效）
+func (d *decoder) bytes() []byte {
+	n := d.uvarint()
+	if d.err != nil {
+		return nil
+	}
+	if n > uint64(len(d.data)) {
+		d.fail("length %d exceeds remaining %d bytes", n, len(d.data))
+		return nil
+	}
+	if n == 0 {
+		return nil
+	}
+	data := append([]byte{}, d.data[:n]...)
+	d.data = d.data[n:]
+	return data
+}
+
+// 数组的元素个数，每个元素至少占1个字节，用剩余长度限制个数，避免恶意数据导致分配过大的内存
+func (d *decoder) count() int {
+	n := d.uvarint()
+	if n > uint64(len(d.data)) {
+		d.fail("count %d exceeds remaining %d bytes", n, len(d.data))
+		return 0
+	}
+	return int(n)
+}
+
+func (d *decoder) int() int {
+	return int(d.varint())
+}
+
+func (d *decoder) bool() bool {
+	switch d.uvarint() {
+	case 0:
+		return false
+	case 1:
+		return true
+	}
+	d.fail("bad bool")
+	return false
+}
+
+func (d *decoder) version() {
+	if d.err != nil {
+		return
+	}
+	if len(d.data) == 0 {
+		d.fail("missing version")
+		return
+	}
+	if d.data[0] != encodingVersion {
+		d.fail("unsupported version %d", d.data[0])
+		return
+	}
+	d.ver = encodingVersion
+	d.data = d.data[1:]
+}
+
+// 检查数据是否恰好读完
+func (d *decoder) finish() error {
+	if d.err == nil && len(d.data) > 0 {
+		d.fail("%d trailing bytes", len(d.data))
+	}
+	return d.err
+}
+
+func (in *TXInput) encode(e *encoder) {
+	e.bytes(in.Txid)
+	e.varint(int64(in.Vout))
+	e.bytes(in.ScriptSig)
+	e.uvarint(uint64(in.Sequence))
+}
+
+func (in *TXInput) decode(d *decoder) {
+	in.Txid = d.bytes()
+	in.Vout = d.int()
+	in.ScriptSig = d.bytes()
+	if d.ver >= 3 {
+		sequence := d.uvarint()
+		if sequence > 0xffffffff {
+			d.fail("sequence %d overflows uint32", sequence)
+		}
+		in.Sequence = uint32(sequence)
+	}
+}
+
+func (out *TXOutput) encode(e *encoder) {
+	e.varint(int64(out.Value))
+	e.bytes(out.ScriptPubKey)
+}
+
+func (out *TXOutput) decode(d *decoder) {
+	out.Value = d.int()
+	out.ScriptPubKey = d.bytes()
+}
+
+func (tx *Transaction) encode(e *encoder) {
+	e.bytes(tx.ID)
+	e.uvarint(uint64(len(tx.Vin)))
+	for i := range tx.Vin {
+		tx.Vin[i].encode(e)
+	}
+	e.uvarint(uint64(len(tx.Vout)))
+	for i := range tx.Vout {
+		tx.Vout[i].encode(e)
+	}
+	e.varint(tx.LockTime)
+}
+
+func (tx *Transaction) decode(d *decoder) {
+	tx.ID = d.bytes()
+	if n := d.count(); n > 0 {
+		tx.Vin = make([]TXInput, n)
+		for i := range tx.Vin {
+			tx.Vin[i].decode(d)
+		}
+	}
+	if n := d.count(); n > 0 {
+		tx.Vout = make([]TXOutput, n)
+		for i := range tx.Vout {
+			tx.Vout[i].decode(d)
+		}
+	}
+	if d.ver >= 3 {
+		tx.LockTime = d.varint()
+	}
+}
+
+func (entry *UTXOEntry) encode(e *encoder) {
+	e.varint(int64(entry.Height))
+	entry.Out.encode(e)
+}
+
+func (entry *UTXOEntry) decode(d *decoder) {
+	entry.Height = d.int()
+	entry.Out.decode(d)
+}
+
+func (spent *SpentOutput) encode(e *encoder) {
+	e.bytes(spent.Txid)
+	e.varint(int64(spent.Vout))
+	e.varint(int64(spent.Height))
+	spent.Out.encode(e)
+}
+
+func (spent *SpentOutput) decode(d *decoder) {
+	spent.Txid = d.bytes()
+	spent.Vout = d.int()
+	spent.Height = d.int()
+	spent.Out.decode(d)
+}
+
+func (undo *BlockUndo) encode(e *encoder) {
+	e.uvarint(uint64(len(undo.Spent)))
+	for i := range undo.Spent {
+		undo.Spent[i].encode(e)
+	}
+}
+
+func (undo *BlockUndo) decode(d *decoder) {
+	if n := d.count(); n > 0 {
+		undo.Spent = make([]SpentOutput, n)
+		for i := range undo.Spent {
+			undo.Spent[i].decode(d)
+		}
+	}
+}
+
+func (idx *blockIndex) encode(e *encoder) {
+	e.varint(int64(idx.Height))
+	e.bytes(idx.ChainWork)
+	e.bool(idx.Invalid)
+}
+
+func (idx *blockIndex) decode(d *decoder) {
+	idx.Height = d.int()
+	idx.ChainWork = d.bytes()
+	idx.Invalid = d.bool()
+}
+
+func (h *BlockHeader) encode(e *encoder) {
+	e.varint(h.Timestamp)
+	e.bytes(h.TxHash)
+	e.bytes(h.WitnessHash)
+	e.bytes(h.PreHash)
+	e.bytes(h.Hash)
+	e.varint(int64(h.Nonce))
+	e.varint(int64(h.Height))
+	e.uvarint(uint64(h.Bits))
+	e.bytes(h.Signature)
+}
+
+func (h *BlockHeader) decode(d *decoder) {
+	h.Timestamp = d.varint()
+	h.TxHash = d.bytes()
+	if d.ver >= 4 {
+		h.WitnessHash = d.bytes()
+	}
+	h.PreHash = d.bytes()
+	h.Hash = d.bytes()
+	h.Nonce = d.int()
+	h.Height = d.int()
+	bits := d.uvarint()
+	if bits > 0xffffffff {
+		d.fail("bits %d overflows uint32", bits)
+	}
+	h.Bits = uint32(bits)
+	h.Signature = d.bytes()
+}
+
+func (block *Block) encode(e *encoder) {
+	block.BlockHeader.encode(e)
+	e.uvarint(uint64(len(block.Transactions)))
+	for _, tx := range block.Transactions {
+		tx.encode(e)
+	}
+}
+
+func (block *Block) decode(d *decoder) {
+	block.BlockHeader.decode(d)
+	if n := d.count(); n > 0 {
+		block.Transactions = make([]*Transaction, n)
+		for i := range block.Transactions {
+			block.Transactions[i] = &Transaction{}
+			block.Transactions[i].decode(d)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package core
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// 固定的测试数据，期望的编码按 encoding.go 中的格式手工计算，编码格式的任何变化都会使这些测试失败
+func testTransaction() *Transaction {
+	return &Transaction{
+		ID:       []byte{0x01, 0x02},
+		Vin:      []TXInput{{Txid: []byte{0xaa}, Vout: 1, ScriptSig: []byte{0x51}, Sequence: 300}},
+		Vout:     []TXOutput{{Value: 10, ScriptPubKey: []byte{0x76, 0xa9}}},
+		LockTime: 100,
+	}
+}
+
+func testRewardTransaction() *Transaction {
+	return &Transaction{
+		ID:   []byte{0x03},
+		Vin:  []TXInput{{Vout: -1, ScriptSig: []byte{0x04}}},
+		Vout: []TXOutput{{Value: 25, ScriptPubKey: []byte{0x76}}},
+	}
+}
+
+const (
+	// ID | 输入个数 | Txid, Vout 1, ScriptSig, Sequence 300 | 输出个数 | Value 10, ScriptPubKey | LockTime 100
+	testTransactionHex = "020102" + "01" + "01aa" + "02" + "0151" + "ac02" + "01" + "14" + "0276a9" + "c801"
+	// Txid 为空，Vout -1
+	testRewardTransactionHex = "0103" + "01" + "00" + "01" + "0104" + "00" + "01" + "32" + "0176" + "00"
+	// Timestamp 1 | TxHash | WitnessHash | PreHash 为空 | Hash | Nonce 7 | Height 0 | Bits 0x1f00ffff | Signature 为空
+	testBlockHeaderHex = "02" + "0111" + "0133" + "00" + "0122" + "0e" + "00" + "ffff83f801" + "00"
+)
+
+func testBlock() *Block {
+	return &Block{
+		BlockHeader: BlockHeader{
+			Timestamp:   1,
+			TxHash:      []byte{0x11},
+			WitnessHash: []byte{0x33},
+			Hash:        []byte{0x22},
+			Nonce:       7,
+			Bits:        0x1f00ffff,
+		},
+		Transactions: []*Transaction{testRewardTransaction(), testTransaction()},
+	}
+}
+
+func mustDecodeHex(t *testing.T, s string) []byte {
+	t.Helper()
+	data, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestTransactionEncoding(t *testing.T) {
+	tx := testTransaction()
+	want := mustDecodeHex(t, "04"+testTransactionHex)
+
+	data := tx.Serialize()
+	if !bytes.Equal(data, want) {
+		t.Fatalf("Serialize() = %x, want %x", data, want)
+	}
+
+	decoded, err := DeserializeTransaction(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&decoded, tx) {
+		t.Fatalf("DeserializeTransaction() = %+v, want %+v", decoded, *tx)
+	}
+}
+
+func TestRewardTransactionEncoding(t *testing.T) {
+	tx := testRewardTransaction()
+	want := mustDecodeHex(t, "04"+testRewardTransactionHex)
+
+	data := tx.Serialize()
+	if !bytes.Equal(data, want) {
+		t.Fatalf("Serialize() = %x, want %x", data, want)
+	}
+
+	decoded, err := DeserializeTransaction(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&decoded, tx) {
+		t.Fatalf("DeserializeTransaction() = %+v, want %+v", decoded, *tx)
+	}
+}
+
+func TestBlockEncoding(t *testing.T) {
+	block := testBlock()
+	// 区块中的交易不重复版本
+	want := mustDecodeHex(t, "04"+testBlockHeaderHex+"02"+testRewardTransactionHex+testTransactionHex)
+
+	data := block.SerializeBlock()
+	if !bytes.Equal(data, want) {
+		t.Fatalf("SerializeBlock() = %x, want %x", data, want)
+	}
+
+	decoded, err := DeserializeBlock(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, block) {
+		t.Fatalf("DeserializeBlock() = %+v, want %+v", decoded, block)
+	}
+
+	header := block.BlockHeader
+	wantHeader := mustDecodeHex(t, "04"+testBlockHeaderHex)
+	if data := header.Serialize(); !bytes.Equal(data, wantHeader) {
+		t.Fatalf("BlockHeader.Serialize() = %x, want %x", data, wantHeader)
+	}
+	decodedHeader, err := DeserializeBlockHeader(wantHeader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(*decodedHeader, header) {
+		t.Fatalf("DeserializeBlockHeader() = %+v, want %+v", *decodedHeader, header)
+	}
+}
+
+func TestUTXOEntryEncoding(t *testing.T) {
+	entry := UTXOEntry{Height: 5, Out: TXOutput{Value: 10, ScriptPubKey: []byte{0x76, 0xa9}}}
+	// Height 5 | Value 10 | ScriptPubKey
+	want := mustDecodeHex(t, "04"+"0a"+"14"+"0276a9")
+
+	data := entry.Serialize()
+	if !bytes.Equal(data, want) {
+		t.Fatalf("Serialize() = %x, want %x", data, want)
+	}
+
+	decoded, err := DeserializeUTXOEntry(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, entry) {
+		t.Fatalf("DeserializeUTXOEntry() = %+v, want %+v", decoded, entry)
+	}
+}
+
+// 不符合规范编码的数据都应该被拒绝
+func TestDecodeRejectsInvalidEncoding(t *testing.T) {
+	tests := []struct {
+		name string
+		hex  string
+	}{
+		{"empty", ""},
+		{"unsupported version", "03" + testTransactionHex},
+		{"trailing bytes", "04" + testTransactionHex + "00"},
+		{"truncated", "04" + testTransactionHex[:len(testTransactionHex)-2]},
+		// LockTime 100 使用了多余的 0x80 前缀
+		{"non-canonical varint", "04" + testTransactionHex[:len(testTransactionHex)-4] + "c88100"},
+		{"length exceeds data", "04" + "05" + "0102"},
+		{"sequence overflows uint32", "04" + "020102" + "01" + "01aa" + "02" + "0151" + "8080808010" + "00" + "00"},
+	}
+
+	for _, test := range tests {
+		_, err := DeserializeTransaction(mustDecodeHex(t, test.hex))
+		if !errors.Is(err, ErrInvalidEncoding) {
+			t.Errorf("%s: err = %v, want ErrInvalidEncoding", test.name, err)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/boltdb/bolt"
+)
+
+// 主链的高度索引，key 为4字节大端序的区块高度，value 为主链上该高度的区块hash
+// 区块接入主链时写入，从主链断开时删除，分叉上的区块不在这里
+const heightIndexBucket = "heightindex"
+
+func heightKey(height int) []byte {
+	key := make([]byte, 4)
+	binary.BigEndian.PutUint32(key, uint32(height))
+	return key
+}
+
+// 把区块记为主链上对应高度的区块
+func putMainChainHeight(tx *bolt.Tx, block *Block) error {
+	return tx.Bucket([]byte(heightIndexBucket)).Put(heightKey(block.Height), block.Hash)
+}
+
+// 区块从主链断开时删除它的高度记录
+func deleteMainChainHeight(tx *bolt.Tx, block *Block) error {
+	b := tx.Bucket([]byte(heightIndexBucket))
+	if !bytes.Equal(b.Get(heightKey(block.Height)), block.Hash) {
+		return nil
+	}
+	return b.Delete(heightKey(block.Height))
+}
+
+// 主链上指定高度的区块hash
+func getMainChainHash(tx *bolt.Tx, height int) ([]byte, error) {
+	hash := tx.Bucket([]byte(heightIndexBucket)).Get(heightKey(height))
+	if hash == nil {
+		return nil, fmt.Errorf("%w: no block at height %d", ErrBlockNotFound, height)
+	}
+	return append([]byte{}, hash...), nil
+}
+
+// 旧版本创建的数据库没有高度索引，打开时从 tip 开始沿主链补建
+// 高度按区块到创世区块的距离计算，不依赖区块中保存的 Height（最早的区块没有这个字段）
+func ensureHeightIndex(tx *bolt.Tx) error {
+	if tx.Bucket([]byte(heightIndexBucket)) != nil {
+		return nil
+	}
+	b, err := tx.CreateBucket([]byte(heightIndexBucket))
+	if err != nil {
+		return err
+	}
+
+	var mainChain [][]byte
+	for hash := tx.Bucket([]byte(blocksBucket)).Get([]byte("last")); len(hash) > 0; {
+		header, err := getBlockHeader(tx, hash)
+		if err != nil {
+			return err
+		}
+		mainChain = append(mainChain, header.Hash)
+		hash = header.PreHash
+	}
+	for i, hash := range mainChain {
+		if err := b.Put(heightKey(len(mainChain)-1-i), hash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 获取主链上指定高度的区块
+func (bc *Blockchain) GetBlockByHeight(height int) (*Block, error) {
+	if height < 0 {
+		return nil, fmt.Errorf("%w: no block at height %d", ErrBlockNotFound, height)
+	}
+
+	var block *Block
+	err := bc.Db.View(func(tx *bolt.Tx) error {
+		hash, err := getMainChainHash(tx, height)
+		if err != nil {
+			return err
+		}
+		block, err = getBlock(tx, hash)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return block, nil
+}
+
+// 获取主链上指定高度的区块头
+func (bc *Blockchain) GetHeaderByHeight(height int) (*BlockHeader, error) {
+	if height < 0 {
+		return nil, fmt.Errorf("%w: no block at height %d", ErrBlockNotFound, height)
+	}
+
+	var header *BlockHeader
+	err := bc.Db.View(func(tx *bolt.Tx) error {
+		hash, err := getMainChainHash(tx, height)
+		if err != nil {
+			return err
+		}
+		header, err = getBlockHeader(tx, hash)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return header, nil
+}
+
+// 主链的高度，即 tip 的高度，只有创世区块时为0
+func (bc *Blockchain) Height() (int, error) {
+	height := 0
+
+	err := bc.Db.View(func(tx *bolt.Tx) error {
+		k, _ := tx.Bucket([]byte(heightIndexBucket)).Cursor().Last()
+		if k == nil {
+			return ErrNoChain
+		}
+		height = int(binary.BigEndian.Uint32(k))
+		return nil
+	})
+
+	return height, err
+}
@@ -0,0 +1,78 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/boltdb/bolt"
+)
+
+// Transaction.LockTime 小于这个值时是区块高度，交易只能打包进高度大于 LockTime 的区块；
+// 否则是 Unix 时间戳，交易只能打包进父区块的中位时间（见 calcPastMedianTime）大于 LockTime 的区块
+// 使用中位时间而不是区块自己的时间戳，出块者无法通过调快时间戳提前打包交易
+const lockTimeThreshold = 500000000
+
+// 交易还没有到可以打包的高度或时间
+var ErrTxNotFinal = errors.New("transaction is not final")
+
+// 检查交易能否打包进高度为 height 的区块，medianTime 为父区块的中位时间
+func (tx *Transaction) checkLockTime(height int, medianTime int64) error {
+	if tx.LockTime == 0 {
+		return nil
+	}
+	if tx.LockTime < lockTimeThreshold {
+		if int64(height) > tx.LockTime {
+			return nil
+		}
+		return fmt.Errorf("%w: locked until height %d, block height is %d", ErrTxNotFinal, tx.LockTime+1, height)
+	}
+	if medianTime > tx.LockTime {
+		return nil
+	}
+	return fmt.Errorf("%w: locked until time %d, median time is %d", ErrTxNotFinal, tx.LockTime, medianTime)
+}
+
+// 检查输入的相对锁定，prevHeights 为每个输入花费的输出所在区块的高度
+// 输出在高度 h 的区块中确认，Sequence 为 n 的输入只能打包进高度不小于 h+n 的区块
+func (tx *Transaction) checkSequenceLocks(prevHeights []int, height int) error {
+	for inID, vin := range tx.Vin {
+		if unlock := prevHeights[inID] + int(vin.Sequence); height < unlock {
+			return fmt.Errorf("%w: input %d is locked until height %d, block height is %d", ErrTxNotFinal, inID, unlock, height)
+		}
+	}
+	return nil
+}
+
+// 检查交易能否打包进接在当前 tip 之后的区块，输入花费的输出都必须在 UTXO 集中
+// 不满足锁定条件时返回包装了 ErrTxNotFinal 的错误
+func (u UTXOSet) CheckFinal(transaction *Transaction) error {
+	return u.Blockchain.Db.View(func(tx *bolt.Tx) error {
+		tip := tx.Bucket([]byte(blocksBucket)).Get([]byte("last"))
+		parent, err := getBlockHeader(tx, tip)
+		if err != nil {
+			return err
+		}
+		medianTime, err := calcPastMedianTime(tx, tip)
+		if err != nil {
+			return err
+		}
+		height := parent.Height + 1
+		if err := transaction.checkLockTime(height, medianTime); err != nil {
+			return err
+		}
+
+		var prevHeights []int
+		for _, vin := range transaction.Vin {
+			outBytes := tx.Bucket([]byte(utxoBucket)).Get(outpointKey(vin.Txid, vin.Vout))
+			if outBytes == nil {
+				return fmt.Errorf("%x:%d is missing or spent", vin.Txid, vin.Vout)
+			}
+			entry, err := DeserializeUTXOEntry(outBytes)
+			if err != nil {
+				return err
+			}
+			prevHeights = append(prevHeights, entry.Height)
+		}
+		return transaction.checkSequenceLocks(prevHeights, height)
+	})
+}
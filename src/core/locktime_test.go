@@ -0,0 +1,116 @@
+package core
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+// 锁定到之后高度的交易先保存到文件，到达高度之前交易池和区块都不接受，之后从文件读回的交易可以打包
+func TestLockedTransactionFlow(t *testing.T) {
+	bc, alice := newTestChain(t)
+	bob := newTestWallet(t)
+	utxoSet := UTXOSet{bc}
+
+	// tip 高度为1，交易只能打包进高度大于3的区块
+	tx, err := NewTransaction(alice, testAddress(bc.Params, bob), 4, 3, 0, &utxoSet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "tx.hex")
+	if err := tx.SaveToFile(file); err != nil {
+		t.Fatal(err)
+	}
+
+	for height := 2; height <= 3; height++ {
+		if err := utxoSet.CheckFinal(tx); !errors.Is(err, ErrTxNotFinal) {
+			t.Fatalf("height %d: CheckFinal err = %v, want ErrTxNotFinal", height, err)
+		}
+		if err := NewMempool(utxoSet, defaultMempoolMaxSize).Add(tx); !errors.Is(err, ErrInvalidTx) {
+			t.Fatalf("height %d: mempool err = %v, want ErrInvalidTx", height, err)
+		}
+		if _, err := bc.ProcessBlock(sealTestBlock(t, bc, tx)); !errors.Is(err, ErrNonFinalTx) {
+			t.Fatalf("height %d: block err = %v, want ErrNonFinalTx", height, err)
+		}
+		mineTestBlock(t, bc)
+	}
+
+	loaded, err := LoadTransaction(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bc.VerifyTransaction(loaded); err != nil {
+		t.Fatal(err)
+	}
+	if err := utxoSet.CheckFinal(loaded); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewMempool(utxoSet, defaultMempoolMaxSize).Add(loaded); err != nil {
+		t.Fatal(err)
+	}
+	if block := mineTestBlock(t, bc, loaded); block.Height != 4 {
+		t.Fatalf("transaction mined at height %d, want 4", block.Height)
+	}
+
+	outputs, err := utxoSet.FindUTXO(NewP2PKHScript(HashPubKey(bob.PublicKey)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(outputs) != 1 || outputs[0].Value != 4 {
+		t.Fatalf("bob's outputs = %+v, want one output of 4", outputs)
+	}
+}
+
+// 输入花费的输出上面需要有足够多的区块，交易才能打包
+func TestSequenceLocks(t *testing.T) {
+	bc, alice := newTestChain(t)
+	utxoSet := UTXOSet{bc}
+
+	// alice 的输出在高度1确认，要求之上有2个区块，只能打包进高度不小于3的区块
+	tx, err := NewTransaction(alice, testAddress(bc.Params, newTestWallet(t)), 4, 0, 2, &utxoSet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := utxoSet.CheckFinal(tx); !errors.Is(err, ErrTxNotFinal) {
+		t.Fatalf("CheckFinal err = %v, want ErrTxNotFinal", err)
+	}
+	if _, err := bc.ProcessBlock(sealTestBlock(t, bc, tx)); !errors.Is(err, ErrNonFinalTx) {
+		t.Fatalf("block err = %v, want ErrNonFinalTx", err)
+	}
+
+	mineTestBlock(t, bc)
+	if err := utxoSet.CheckFinal(tx); err != nil {
+		t.Fatal(err)
+	}
+	mineTestBlock(t, bc, tx)
+}
+
+func TestCheckLockTime(t *testing.T) {
+	tests := []struct {
+		lockTime   int64
+		height     int
+		medianTime int64
+		final      bool
+	}{
+		{0, 1, 0, true},
+		// 高度锁定：区块高度必须大于 LockTime
+		{10, 10, 0, false},
+		{10, 11, 0, true},
+		{lockTimeThreshold - 1, lockTimeThreshold - 1, 0, false},
+		// 时间锁定：父区块的中位时间必须大于 LockTime，和区块高度无关
+		{lockTimeThreshold, lockTimeThreshold + 1, lockTimeThreshold, false},
+		{1700000000, 1, 1700000000, false},
+		{1700000000, 1, 1700000001, true},
+	}
+
+	for _, test := range tests {
+		tx := &Transaction{LockTime: test.lockTime}
+		err := tx.checkLockTime(test.height, test.medianTime)
+		if test.final && err != nil {
+			t.Errorf("lock time %d at height %d, median time %d: %v", test.lockTime, test.height, test.medianTime, err)
+		}
+		if !test.final && !errors.Is(err, ErrTxNotFinal) {
+			t.Errorf("lock time %d at height %d, median time %d: err = %v, want ErrTxNotFinal", test.lockTime, test.height, test.medianTime, err)
+		}
+	}
+}
@@ -0,0 +1,292 @@
+package core
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// 交易池默认最多占用的字节数（按序列化后的交易大小计算）
+const defaultMempoolMaxSize = 1 << 20
+
+var (
+	// 交易已经在交易池中
+	ErrTxInMempool = errors.New("transaction is already in the mempool")
+	// 交易花费的输出已经被交易池中的其他交易花费
+	ErrMempoolConflict = errors.New("transaction conflicts with a pending transaction")
+	// 交易没有通过校验
+	ErrInvalidTx = errors.New("invalid transaction")
+	// 交易池已满，并且新交易的手续费率不足以挤出已有的交易
+	ErrMempoolFull = errors.New("mempool is full")
+)
+
+// 交易池中的一条交易
+type mempoolEntry struct {
+	tx   Transaction
+	fee  int
+	size int
+}
+
+// 手续费率高于另一条交易，即 fee/size 更大
+func (e *mempoolEntry) feeRateAbove(other *mempoolEntry) bool {
+	return e.fee*other.size > other.fee*e.size
+}
+
+// 尚未打包进区块的交易
+// 交易加入前按 UTXO 集校验，输入必须是未花费的输出，并且不能和池中其他交易花费同一个输出；
+// 总大小超过上限时按手续费率从低到高淘汰
+type Mempool struct {
+	utxo    UTXOSet
+	maxSize int
+
+	entries map[string]*mempoolEntry
+	// 池中交易花费的输出，key 为 outpointKey，value 为花费它的交易ID
+	spent map[string]string
+	size  int
+
+	mu sync.Mutex
+}
+
+func NewMempool(utxo UTXOSet, maxSize int) *Mempool {
+	return &Mempool{
+		utxo:    utxo,
+		maxSize: maxSize,
+		entries: make(map[string]*mempoolEntry),
+		spent:   make(map[string]string),
+	}
+}
+
+// 校验交易并加入交易池
+func (m *Mempool) Add(tx *Transaction) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.add(tx)
+}
+
+func (m *Mempool) add(tx *Transaction) error {
+	txID := hex.EncodeToString(tx.ID)
+	if _, ok := m.entries[txID]; ok {
+		return ErrTxInMempool
+	}
+
+	fee, err := m.validate(tx)
+	if err != nil {
+		return err
+	}
+
+	entry := &mempoolEntry{*tx, fee, len(tx.Serialize())}
+	m.entries[txID] = entry
+	for _, vin := range tx.Vin {
+		m.spent[string(outpointKey(vin.Txid, vin.Vout))] = txID
+	}
+	m.size += entry.size
+
+	for m.size > m.maxSize {
+		evicted := m.lowestFeeRate()
+		m.remove(hex.EncodeToString(evicted.tx.ID))
+		if evicted == entry {
+			return ErrMempoolFull
+		}
+	}
+
+	return nil
+}
+
+// 按 UTXO 集校验交易，返回交易的手续费
+func (m *Mempool) validate(tx *Transaction) (int, error) {
+	if tx.IsRewardTx() {
+		return 0, fmt.Errorf("%w: reward transaction can not be relayed", ErrInvalidTx)
+	}
+	if !bytes.Equal(tx.ID, tx.Hash()) {
+		return 0, fmt.Errorf("%w: id %x does not match its content", ErrInvalidTx, tx.ID)
+	}
+
+	var prevOuts []TXOutput
+	spent := make(map[string]bool)
+	in := 0
+	for _, vin := range tx.Vin {
+		key := string(outpointKey(vin.Txid, vin.Vout))
+		if spent[key] {
+			return 0, fmt.Errorf("%w: %x:%d is spent twice", ErrInvalidTx, vin.Txid, vin.Vout)
+		}
+		spent[key] = true
+		if other, ok := m.spent[key]; ok {
+			return 0, fmt.Errorf("%w: %x:%d is spent by %s", ErrMempoolConflict, vin.Txid, vin.Vout, other)
+		}
+
+		entry, ok, err := m.utxo.FindOutput(vin.Txid, vin.Vout)
+		if err != nil {
+			return 0, err
+		}
+		if !ok {
+			return 0, fmt.Errorf("%w: %x:%d is missing or spent", ErrInvalidTx, vin.Txid, vin.Vout)
+		}
+		in += entry.Out.Value
+		if !MoneyRange(entry.Out.Value) || !MoneyRange(in) {
+			return 0, fmt.Errorf("%w: inputs of more than %d", ErrInvalidTx, MaxMoney)
+		}
+		prevOuts = append(prevOuts, entry.Out)
+	}
+
+	// 交易池中的交易必须可以打包进下一个区块
+	if err := m.utxo.CheckFinal(tx); err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrInvalidTx, err)
+	}
+	if err := tx.verifyInputs(prevOuts); err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrInvalidTx, err)
+	}
+
+	out := 0
+	for _, vout := range tx.Vout {
+		if !MoneyRange(vout.Value) {
+			return 0, fmt.Errorf("%w: output of %d", ErrInvalidTx, vout.Value)
+		}
+		out += vout.Value
+		if !MoneyRange(out) {
+			return 0, fmt.Errorf("%w: outputs of more than %d", ErrInvalidTx, MaxMoney)
+		}
+	}
+	if out > in {
+		return 0, fmt.Errorf("%w: spends %d but only has %d", ErrInvalidTx, out, in)
+	}
+
+	return in - out, nil
+}
+
+// 从交易池中移除交易
+func (m *Mempool) Remove(txID []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.remove(hex.EncodeToString(txID))
+}
+
+func (m *Mempool) remove(txID string) {
+	entry, ok := m.entries[txID]
+	if !ok {
+		return
+	}
+
+	for _, vin := range entry.tx.Vin {
+		delete(m.spent, string(outpointKey(vin.Txid, vin.Vout)))
+	}
+	m.size -= entry.size
+	delete(m.entries, txID)
+}
+
+func (m *Mempool) lowestFeeRate() *mempoolEntry {
+	var lowest *mempoolEntry
+	for _, entry := range m.entries {
+		if lowest == nil || lowest.feeRateAbove(entry) {
+			lowest = entry
+		}
+	}
+	return lowest
+}
+
+// 查找交易池中的交易
+func (m *Mempool) Get(txID []byte) (Transaction, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry, ok := m.entries[hex.EncodeToString(txID)]
+	if !ok {
+		return Transaction{}, false
+	}
+	return entry.tx, true
+}
+
+func (m *Mempool) Has(txID []byte) bool {
+	_, ok := m.Get(txID)
+	return ok
+}
+
+// 交易池中的交易数量
+func (m *Mempool) Count() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return len(m.entries)
+}
+
+// 按手续费率从高到低返回交易池中的交易，挖矿时优先打包手续费率高的交易
+func (m *Mempool) Transactions() []*Transaction {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var txs []*Transaction
+	for _, entry := range m.sortedEntries() {
+		tx := entry.tx
+		txs = append(txs, &tx)
+	}
+	return txs
+}
+
+// 为区块模板挑选交易：按手续费率从高到低，总大小不超过 maxSize，返回选中的交易和它们的手续费总额
+func (m *Mempool) SelectTransactions(maxSize int) ([]*Transaction, int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var selected []*Transaction
+	size, fees := 0, 0
+	for _, entry := range m.sortedEntries() {
+		if size+entry.size > maxSize {
+			continue
+		}
+
+		tx := entry.tx
+		selected = append(selected, &tx)
+		size += entry.size
+		fees += entry.fee
+	}
+
+	return selected, fees
+}
+
+// 按手续费率从高到低排列的交易，手续费率相同时按交易ID排序，保证结果稳定
+func (m *Mempool) sortedEntries() []*mempoolEntry {
+	entries := make([]*mempoolEntry, 0, len(m.entries))
+	for _, entry := range m.entries {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].feeRateAbove(entries[j]) || entries[j].feeRateAbove(entries[i]) {
+			return entries[i].feeRateAbove(entries[j])
+		}
+		return hex.EncodeToString(entries[i].tx.ID) < hex.EncodeToString(entries[j].tx.ID)
+	})
+	return entries
+}
+
+// 主链变化后更新交易池，调用时 UTXO 集已经处于变化之后的状态
+// 已经上链的交易以及和它们花费同一个输出的交易被移除；断开的区块中的交易重新校验后放回交易池
+func (m *Mempool) Update(change *ChainChange) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, block := range change.Connected {
+		for _, tx := range block.Transactions {
+			m.remove(hex.EncodeToString(tx.ID))
+			if tx.IsRewardTx() {
+				continue
+			}
+			for _, vin := range tx.Vin {
+				if other, ok := m.spent[string(outpointKey(vin.Txid, vin.Vout))]; ok {
+					m.remove(other)
+				}
+			}
+		}
+	}
+
+	for _, block := range change.Disconnected {
+		for _, tx := range block.Transactions {
+			if !tx.IsRewardTx() {
+				_ = m.add(tx)
+			}
+		}
+	}
+}
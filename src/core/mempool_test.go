@@ -0,0 +1,133 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+)
+
+// 给每个钱包转入 amount，每笔转账单独打包，区块奖励发回给 from，保证 from 的余额足够
+func fundWallets(t *testing.T, bc *Blockchain, from *Wallet, amount int, wallets ...*Wallet) {
+	t.Helper()
+
+	for _, wallet := range wallets {
+		tx, err := NewTransaction(from, testAddress(bc.Params, wallet), amount, 0, 0, &UTXOSet{bc})
+		if err != nil {
+			t.Fatal(err)
+		}
+		block, err := bc.NewBlockTemplate(testAddress(bc.Params, from), []*Transaction{tx}, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := bc.Engine.Seal(context.Background(), bc, block); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := bc.ProcessBlock(block); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// wallet 把它唯一的输出全部转给一个新地址，留下 fee 作为手续费
+func spendWithFee(t *testing.T, bc *Blockchain, wallet *Wallet, fee int) *Transaction {
+	t.Helper()
+
+	tx, err := NewTransaction(wallet, testAddress(bc.Params, newTestWallet(t)), testBalance(t, bc, wallet), 0, 0, &UTXOSet{bc})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx.Vout[0].Value -= fee
+	tx.SetID()
+	if err := bc.SignTransaction(tx, wallet.PrivateKey); err != nil {
+		t.Fatal(err)
+	}
+	return tx
+}
+
+// 总大小超过上限时淘汰手续费率最低的交易，新交易自己的手续费率最低时返回 ErrMempoolFull
+func TestMempoolEviction(t *testing.T) {
+	bc, alice := newTestChain(t)
+	wallets := []*Wallet{newTestWallet(t), newTestWallet(t), newTestWallet(t), newTestWallet(t)}
+	fundWallets(t, bc, alice, 5, wallets...)
+
+	low := spendWithFee(t, bc, wallets[0], 1)
+	mid := spendWithFee(t, bc, wallets[1], 2)
+	high := spendWithFee(t, bc, wallets[2], 3)
+	none := spendWithFee(t, bc, wallets[3], 0)
+
+	// 交易大小可能相差几个字节，上限可以容纳任意两笔，但容纳不下三笔
+	maxSize := 0
+	for _, tx := range []*Transaction{low, mid, high, none} {
+		if size := len(tx.Serialize()); 2*size > maxSize {
+			maxSize = 2 * size
+		}
+	}
+	mempool := NewMempool(UTXOSet{bc}, maxSize)
+
+	for _, tx := range []*Transaction{low, mid, high} {
+		if err := mempool.Add(tx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if mempool.Count() != 2 || mempool.Has(low.ID) {
+		t.Fatalf("mempool has %d transactions, low fee transaction kept = %v, want it evicted", mempool.Count(), mempool.Has(low.ID))
+	}
+	txs := mempool.Transactions()
+	if len(txs) != 2 || !bytes.Equal(txs[0].ID, high.ID) || !bytes.Equal(txs[1].ID, mid.ID) {
+		t.Fatal("transactions are not ordered by fee rate")
+	}
+
+	if err := mempool.Add(none); !errors.Is(err, ErrMempoolFull) {
+		t.Fatalf("err = %v, want ErrMempoolFull", err)
+	}
+	if mempool.Count() != 2 || mempool.Has(none.ID) || !mempool.Has(mid.ID) || !mempool.Has(high.ID) {
+		t.Fatal("rejected transaction changed the mempool")
+	}
+
+	// 被淘汰的交易花费的输出不再被占用，可以再次加入
+	mempool.Remove(mid.ID)
+	if err := mempool.Add(low); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 和池中交易花费同一个输出的交易被拒绝；上链的交易和与它冲突的交易被移除，区块断开后交易放回交易池
+func TestMempoolUpdate(t *testing.T) {
+	bc, alice := newTestChain(t)
+	wallets := []*Wallet{newTestWallet(t), newTestWallet(t)}
+	fundWallets(t, bc, alice, 5, wallets...)
+	mempool := NewMempool(UTXOSet{bc}, defaultMempoolMaxSize)
+
+	pending := spendWithFee(t, bc, wallets[0], 1)
+	conflict := spendWithFee(t, bc, wallets[0], 2)
+	other := spendWithFee(t, bc, wallets[1], 1)
+	for _, tx := range []*Transaction{pending, other} {
+		if err := mempool.Add(tx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := mempool.Add(conflict); !errors.Is(err, ErrMempoolConflict) {
+		t.Fatalf("err = %v, want ErrMempoolConflict", err)
+	}
+
+	// 区块打包了冲突的交易，池中花费同一个输出的交易随之移除
+	block := sealTestBlock(t, bc, conflict, other)
+	change, err := bc.ProcessBlock(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mempool.Update(change)
+	if mempool.Count() != 0 {
+		t.Fatalf("mempool has %d transactions after the block, want 0", mempool.Count())
+	}
+
+	change, err = bc.InvalidateBlock(block.Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mempool.Update(change)
+	if mempool.Count() != 2 || !mempool.Has(conflict.ID) || !mempool.Has(other.ID) {
+		t.Fatalf("mempool has %d transactions after the block is disconnected, want the two transactions of the block", mempool.Count())
+	}
+}
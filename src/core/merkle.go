@@ -0,0 +1,115 @@
+package core
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+)
+
+// Merkle 树，叶子节点是区块中按顺序排列的交易ID
+// 每一层两两拼接后做 sha256 得到上一层，节点数为奇数时复制最后一个节点，和比特币一致
+// 轻节点只需要区块头和一条 Merkle 路径，就能确认交易被包含在区块中
+type MerkleTree struct {
+	// levels[0] 是叶子节点，最后一层只有根节点
+	levels [][][]byte
+}
+
+// 交易在区块中的 Merkle 证明
+type MerkleProof struct {
+	TxID []byte
+	// 交易在区块中的位置，决定每一层兄弟节点在左边还是右边
+	Index int
+	// 从叶子到根的兄弟节点
+	Branch [][]byte
+}
+
+func NewMerkleTree(data [][]byte) *MerkleTree {
+	if len(data) == 0 {
+		return &MerkleTree{[][][]byte{{make([]byte, sha256.Size)}}}
+	}
+
+	level := make([][]byte, len(data))
+	copy(level, data)
+	levels := [][][]byte{level}
+
+	for len(level) > 1 {
+		var next [][]byte
+		for i := 0; i < len(level); i += 2 {
+			left := level[i]
+			right := left
+			if i+1 < len(level) {
+				right = level[i+1]
+			}
+			next = append(next, hashMerkleNodes(left, right))
+		}
+		levels = append(levels, next)
+		level = next
+	}
+
+	return &MerkleTree{levels}
+}
+
+// 根节点的hash
+func (t *MerkleTree) Root() []byte {
+	return t.levels[len(t.levels)-1][0]
+}
+
+// 生成第 index 个叶子节点的证明
+func (t *MerkleTree) Proof(index int) (*MerkleProof, error) {
+	if index < 0 || index >= len(t.levels[0]) {
+		return nil, errors.New("Leaf index out of range")
+	}
+
+	proof := &MerkleProof{t.levels[0][index], index, nil}
+	for _, level := range t.levels[:len(t.levels)-1] {
+		sibling := index ^ 1
+		if sibling >= len(level) {
+			sibling = index
+		}
+		proof.Branch = append(proof.Branch, level[sibling])
+		index /= 2
+	}
+
+	return proof, nil
+}
+
+// 用证明中的路径重新计算根节点，和区块头中的 Merkle 根比较
+func (p *MerkleProof) Verify(root []byte) bool {
+	hash := p.TxID
+	index := p.Index
+
+	for _, sibling := range p.Branch {
+		if index%2 == 0 {
+			hash = hashMerkleNodes(hash, sibling)
+		} else {
+			hash = hashMerkleNodes(sibling, hash)
+		}
+		index /= 2
+	}
+
+	return index == 0 && bytes.Equal(hash, root)
+}
+
+func hashMerkleNodes(left, right []byte) []byte {
+	hash := sha256.Sum256(append(append([]byte{}, left...), right...))
+	return hash[:]
+}
+
+// 在主链上查找交易所在的区块，并生成交易的 Merkle 证明
+func (bc *Blockchain) ProveTransaction(txid []byte) (*Block, *MerkleProof, error) {
+	bci := bc.RangeIterator(BlockRange{
+		To:      -1,
+		Reverse: true,
+		Filter:  func(block *Block) bool { return block.TransactionIndex(txid) >= 0 },
+	})
+	if block, ok := bci.Next(); ok {
+		proof, err := block.MerkleTree().Proof(block.TransactionIndex(txid))
+		return block, proof, err
+	}
+	if err := bci.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	return nil, nil, fmt.Errorf("%w: %x", ErrTxNotFound, txid)
+}
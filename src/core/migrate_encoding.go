@@ -0,0 +1,383 @@
+package core
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/boltdb/bolt"
+)
+
+// 数据库的格式版本，位于 meta bucket
+// 最早的版本使用 encoding/gob，没有这个 key
+const encodingKey = "encoding"
+
+// 3 及之前和区块、交易的编码版本 encodingVersion 相同，4 开始撤销数据和区块索引也使用 encoding.go 的编码，之前使用 encoding/gob，
+// 5 开始使用编码版本4
+const dbFormatVersion = 5
+
+// 数据库还在使用旧的编码，需要先用 migratedb 转换
+var ErrLegacyEncoding = errors.New("database uses a legacy encoding, run migratedb first")
+
+// 转换后的链不满足当前的共识规则，其他节点无法校验，节点不能把它提供给其他节点
+var ErrLegacyChain = errors.New("chain was converted from a legacy encoding and fails the current consensus rules")
+
+// 转换后的链没有通过校验时记录失败的原因，位于 meta bucket
+const legacyChainKey = "legacy_chain"
+
+func putEncodingVersion(tx *bolt.Tx) error {
+	meta, err := tx.CreateBucketIfNotExists([]byte(metaBucket))
+	if err != nil {
+		return err
+	}
+	return meta.Put([]byte(encodingKey), []byte{dbFormatVersion})
+}
+
+// 数据库的格式版本，gob 编码时为0
+func dbEncodingVersion(tx *bolt.Tx) (int, error) {
+	meta := tx.Bucket([]byte(metaBucket))
+	if meta == nil || meta.Get([]byte(encodingKey)) == nil {
+		return 0, nil
+	}
+	version := meta.Get([]byte(encodingKey))
+	if len(version) != 1 || version[0] > dbFormatVersion {
+		return 0, fmt.Errorf("%w: unsupported database encoding version %x", ErrInvalidEncoding, version)
+	}
+	return int(version[0]), nil
+}
+
+// 打开数据库时检查编码版本
+func checkEncoding(tx *bolt.Tx) error {
+	version, err := dbEncodingVersion(tx)
+	if err != nil {
+		return err
+	}
+	if version != dbFormatVersion {
+		return ErrLegacyEncoding
+	}
+	return nil
+}
+
+// 编码版本2之前的交易格式：输入直接保存签名和公钥，输出直接保存公钥hash
+// 字段名和当时的类型相同，gob 按字段名解码
+type legacyTXInput struct {
+	Txid      []byte
+	Vout      int
+	Signature []byte
+	PubKey    []byte
+}
+
+type legacyTXOutput struct {
+	Value      int
+	PubKeyHash []byte
+}
+
+type legacyTransaction struct {
+	ID   []byte
+	Vin  []legacyTXInput
+	Vout []legacyTXOutput
+}
+
+type legacyBlock struct {
+	BlockHeader
+	Transactions []*legacyTransaction
+}
+
+// 输出转换为锁定到原公钥hash的 P2PKH 脚本
+func (out legacyTXOutput) convert() TXOutput {
+	return TXOutput{out.Value, NewP2PKHScript(out.PubKeyHash)}
+}
+
+// 输入的签名和公钥转换为 P2PKH 的解锁脚本，奖励交易 PubKey 中的附加数据原样放入 ScriptSig
+// 交易ID原样保留
+func (tx *legacyTransaction) convert() *Transaction {
+	reward := len(tx.Vin) == 1 && len(tx.Vin[0].Txid) == 0 && tx.Vin[0].Vout == -1
+	transaction := &Transaction{ID: tx.ID}
+	for _, in := range tx.Vin {
+		scriptSig := in.PubKey
+		if !reward {
+			scriptSig = p2pkhScriptSig(in.Signature, in.PubKey)
+		}
+		transaction.Vin = append(transaction.Vin, TXInput{in.Txid, in.Vout, scriptSig, 0})
+	}
+	for _, out := range tx.Vout {
+		transaction.Vout = append(transaction.Vout, out.convert())
+	}
+	return transaction
+}
+
+func (block *legacyBlock) convert() *Block {
+	converted := &Block{BlockHeader: block.BlockHeader}
+	for _, tx := range block.Transactions {
+		converted.Transactions = append(converted.Transactions, tx.convert())
+	}
+	return converted
+}
+
+// 编码版本1的格式和当前版本的区别只在输入和输出
+func (in *legacyTXInput) decode(d *decoder) {
+	in.Txid = d.bytes()
+	in.Vout = d.int()
+	in.Signature = d.bytes()
+	in.PubKey = d.bytes()
+}
+
+func (out *legacyTXOutput) decode(d *decoder) {
+	out.Value = d.int()
+	out.PubKeyHash = d.bytes()
+}
+
+func (tx *legacyTransaction) decode(d *decoder) {
+	tx.ID = d.bytes()
+	if n := d.count(); n > 0 {
+		tx.Vin = make([]legacyTXInput, n)
+		for i := range tx.Vin {
+			tx.Vin[i].decode(d)
+		}
+	}
+	if n := d.count(); n > 0 {
+		tx.Vout = make([]legacyTXOutput, n)
+		for i := range tx.Vout {
+			tx.Vout[i].decode(d)
+		}
+	}
+}
+
+func (block *legacyBlock) decode(d *decoder) {
+	block.BlockHeader.decode(d)
+	if n := d.count(); n > 0 {
+		block.Transactions = make([]*legacyTransaction, n)
+		for i := range block.Transactions {
+			block.Transactions[i] = &legacyTransaction{}
+			block.Transactions[i].decode(d)
+		}
+	}
+}
+
+// 按数据库的格式版本解码旧数据，gob 编码时解码到 v
+// 否则数据自带编码版本，用 decode 按数据中的版本读取版本号之后的内容
+func decodeLegacy(version int, data []byte, v interface{}, decode func(*decoder)) error {
+	if version == 0 {
+		return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+	}
+	if len(data) == 0 || data[0] == 0 || data[0] > encodingVersion {
+		return fmt.Errorf("%w: unsupported encoding version", ErrInvalidEncoding)
+	}
+	d := decoder{data: data[1:], ver: int(data[0])}
+	decode(&d)
+	return d.finish()
+}
+
+// 需要转换编码的 bucket 和转换方法，其他 bucket 原样复制，version 为源数据库的编码版本
+// 版本4之前区块索引使用 gob 编码；地址索引和交易索引的 key 不依赖编码，原样复制
+// 版本3之前的交易没有 Sequence 和 LockTime，转换后都为0；版本4之前的区块头没有 WitnessHash，转换后为空
+func encodingMigrations(version int) map[string]func(key, value []byte) ([]byte, error) {
+	return map[string]func(key, value []byte) ([]byte, error){
+		blocksBucket: func(key, value []byte) ([]byte, error) {
+			if bytes.Equal(key, []byte("last")) {
+				return value, nil
+			}
+			// 版本2之后的交易已经使用脚本，按数据中的编码版本解码即可
+			if version >= 2 {
+				var block Block
+				if err := decodeLegacy(version, value, &block, block.decode); err != nil {
+					return nil, fmt.Errorf("decode block %x: %w", key, err)
+				}
+				return block.SerializeBlock(), nil
+			}
+			var block legacyBlock
+			if err := decodeLegacy(version, value, &block, block.decode); err != nil {
+				return nil, fmt.Errorf("decode block %x: %w", key, err)
+			}
+			return block.convert().SerializeBlock(), nil
+		},
+		headersBucket: func(key, value []byte) ([]byte, error) {
+			var header BlockHeader
+			if err := decodeLegacy(version, value, &header, header.decode); err != nil {
+				return nil, fmt.Errorf("decode header %x: %w", key, err)
+			}
+			return header.Serialize(), nil
+		},
+		blockIndexBucket: func(key, value []byte) ([]byte, error) {
+			var idx blockIndex
+			var err error
+			if version < 4 {
+				err = gob.NewDecoder(bytes.NewReader(value)).Decode(&idx)
+			} else {
+				err = decodeLegacy(version, value, &idx, idx.decode)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("decode block index %x: %w", key, err)
+			}
+			return idx.serialize(), nil
+		},
+	}
+}
+
+// 不复制的 bucket：chainstate 和撤销数据的格式随 chainstate 版本变化，打开转换后的数据库时从区块重建
+var skippedMigrationBuckets = map[string]bool{
+	utxoBucket: true,
+	undoBucket: true,
+}
+
+// 把使用 gob 编码或者旧版本二进制编码的数据库 src 转换成当前的编码，写入新的数据库 dst，返回转换的区块数量
+// 旧交易的签名和公钥转换成 P2PKH 脚本
+// 交易ID和区块hash原样保留：区块hash通过 Merkle 根承诺的是已有的交易ID，重新计算会使整条链失效
+// 因此转换前的交易ID和签名仍然对应旧的编码，不满足当前的共识规则，转换后需要用 VerifyChain 重新校验，见 MarkLegacyChain
+func MigrateDbEncoding(src, dst string) (int, error) {
+	if !dbExists(src) {
+		return 0, ErrNoChain
+	}
+	if dbExists(dst) {
+		return 0, fmt.Errorf("%s already exists", dst)
+	}
+
+	srcDb, err := bolt.Open(src, 0600, &bolt.Options{ReadOnly: true})
+	if err != nil {
+		return 0, err
+	}
+	defer srcDb.Close()
+
+	dstDb, err := bolt.Open(dst, 0600, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	blocks := 0
+	err = srcDb.View(func(stx *bolt.Tx) error {
+		if stx.Bucket([]byte(blocksBucket)) == nil {
+			return ErrNoChain
+		}
+		version, err := dbEncodingVersion(stx)
+		if err != nil {
+			return err
+		}
+		if version == dbFormatVersion {
+			return fmt.Errorf("%s already uses format version %d", src, dbFormatVersion)
+		}
+		migrations := encodingMigrations(version)
+
+		return dstDb.Update(func(dtx *bolt.Tx) error {
+			err := stx.ForEach(func(name []byte, sb *bolt.Bucket) error {
+				if skippedMigrationBuckets[string(name)] {
+					return nil
+				}
+				b, err := dtx.CreateBucket(name)
+				if err != nil {
+					return err
+				}
+				convert := migrations[string(name)]
+
+				return sb.ForEach(func(k, v []byte) error {
+					if v == nil {
+						return fmt.Errorf("unexpected nested bucket %s/%x", name, k)
+					}
+					if convert != nil {
+						if v, err = convert(k, v); err != nil {
+							return err
+						}
+					}
+					if string(name) == blocksBucket && !bytes.Equal(k, []byte("last")) {
+						blocks++
+					}
+					return b.Put(k, v)
+				})
+			})
+			if err != nil {
+				return err
+			}
+			return putEncodingVersion(dtx)
+		})
+	})
+	if closeErr := dstDb.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(dst)
+		return 0, err
+	}
+
+	return blocks, nil
+}
+
+// 把节点使用旧编码的数据库转换成当前的编码，原文件保留为 .old 后缀，返回转换的区块数量
+// 转换结果先写入临时文件，打开并用 VerifyChain 重新校验，没有通过时标记为旧链（见 MarkLegacyChain），
+// 全部完成后才替换原文件，中途出错时删除临时文件，原文件保持不变
+// legacy 不为空时是转换后的链没有通过校验的原因
+func MigrateDb(params *ChainParams, nodeID string) (blocks int, legacy error, err error) {
+	dbFile := params.dbFileName(nodeID)
+	tmpFile := dbFile + ".migrating"
+	backupFile := dbFile + ".old"
+	if dbExists(backupFile) {
+		return 0, nil, fmt.Errorf("%s already exists", backupFile)
+	}
+	// 上次转换中断时留下的临时文件
+	if err := os.Remove(tmpFile); err != nil && !os.IsNotExist(err) {
+		return 0, nil, err
+	}
+
+	if blocks, err = MigrateDbEncoding(dbFile, tmpFile); err != nil {
+		return 0, nil, err
+	}
+	if legacy, err = verifyMigratedChain(params, tmpFile); err != nil {
+		os.Remove(tmpFile)
+		return 0, nil, err
+	}
+
+	if err := os.Rename(dbFile, backupFile); err != nil {
+		os.Remove(tmpFile)
+		return 0, nil, err
+	}
+	if err := os.Rename(tmpFile, dbFile); err != nil {
+		os.Rename(backupFile, dbFile)
+		os.Remove(tmpFile)
+		return 0, nil, err
+	}
+	return blocks, legacy, nil
+}
+
+// 打开转换后的数据库并重新校验整条链，旧编码的交易ID和签名不满足当前的共识规则，这样的链标记为旧链，只保留在本地
+// 链没有通过校验时返回原因，其他错误通过 err 返回
+func verifyMigratedChain(params *ChainParams, dbFile string) (legacy error, err error) {
+	bc, err := openBlockchain(params, dbFile)
+	if err != nil {
+		return nil, err
+	}
+	defer bc.Db.Close()
+
+	if verifyErr := bc.VerifyChain(); verifyErr != nil {
+		if !errors.Is(verifyErr, ErrInvalidBlock) {
+			return nil, verifyErr
+		}
+		if err := bc.MarkLegacyChain(verifyErr); err != nil {
+			return nil, err
+		}
+		return verifyErr, nil
+	}
+	return nil, nil
+}
+
+// 转换后的链没有通过 VerifyChain 时调用，记录失败的原因
+// 这样的链只能在本地查询，节点启动时返回 ErrLegacyChain，不会把其他节点无法校验的区块发送出去
+func (bc *Blockchain) MarkLegacyChain(reason error) error {
+	return bc.Db.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists([]byte(metaBucket))
+		if err != nil {
+			return err
+		}
+		return meta.Put([]byte(legacyChainKey), []byte(reason.Error()))
+	})
+}
+
+// 检查链是否被标记为旧编码转换来的无效链，是时返回包装了 ErrLegacyChain 的错误
+func (bc *Blockchain) checkLegacyChain() error {
+	return bc.Db.View(func(tx *bolt.Tx) error {
+		meta := tx.Bucket([]byte(metaBucket))
+		if meta == nil || meta.Get([]byte(legacyChainKey)) == nil {
+			return nil
+		}
+		return fmt.Errorf("%w: %s", ErrLegacyChain, meta.Get([]byte(legacyChainKey)))
+	})
+}
@@ -0,0 +1,169 @@
+package core
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+// 最早版本的区块格式，使用 encoding/gob 编码，没有区块头、高度和难度
+type baselineBlock struct {
+	Timestamp    int64
+	Transactions []*legacyTransaction
+	PreHash      []byte
+	Hash         []byte
+	Nonce        int
+}
+
+// 按最早版本的格式写入一条链，数据库中只有 blocks bucket
+// 每个区块只有一笔奖励交易，奖励 10 发给 pubKeyHashes 中对应的公钥hash，返回各个区块的 hash
+func writeBaselineDb(t *testing.T, dbFile string, pubKeyHashes ...[]byte) [][]byte {
+	t.Helper()
+
+	db, err := bolt.Open(dbFile, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var hashes [][]byte
+	err = db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte(blocksBucket))
+		if err != nil {
+			return err
+		}
+		preHash := []byte{}
+		for i, pubKeyHash := range pubKeyHashes {
+			reward := &legacyTransaction{
+				Vin:  []legacyTXInput{{Vout: -1, PubKey: []byte(fmt.Sprintf("reward %d", i))}},
+				Vout: []legacyTXOutput{{10, pubKeyHash}},
+			}
+			id := sha256.Sum256(reward.Vin[0].PubKey)
+			reward.ID = id[:]
+			hash := sha256.Sum256(append(append([]byte{}, preHash...), reward.ID...))
+			block := baselineBlock{int64(1600000000 + 10*i), []*legacyTransaction{reward}, preHash, hash[:], i}
+
+			var buf bytes.Buffer
+			if err := gob.NewEncoder(&buf).Encode(block); err != nil {
+				return err
+			}
+			if err := b.Put(hash[:], buf.Bytes()); err != nil {
+				return err
+			}
+			if err := b.Put([]byte("last"), hash[:]); err != nil {
+				return err
+			}
+			preHash = hash[:]
+			hashes = append(hashes, preHash)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hashes
+}
+
+// 转换最早版本写入的主网数据库，返回转换后打开的链，调用者负责关闭数据库
+func openBaselineMainnet(t *testing.T, pubKeyHashes ...[]byte) (*Blockchain, [][]byte) {
+	t.Helper()
+
+	params := MainNetParams
+	params.DbFile = filepath.Join(t.TempDir(), params.DbFile)
+	hashes := writeBaselineDb(t, params.DbFile, pubKeyHashes...)
+
+	if _, err := GetBlockchain(&params, ""); !errors.Is(err, ErrLegacyEncoding) {
+		t.Fatalf("opening before migratedb: err = %v, want ErrLegacyEncoding", err)
+	}
+	blocks, legacy, err := MigrateDb(&params, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if blocks != len(pubKeyHashes) {
+		t.Fatalf("migrated %d blocks, want %d", blocks, len(pubKeyHashes))
+	}
+	// 旧交易的ID和签名不满足当前的规则
+	if legacy == nil {
+		t.Fatal("migrated chain passes the current consensus rules")
+	}
+	if !dbExists(params.DbFile + ".old") {
+		t.Fatal("the original database is not kept")
+	}
+
+	bc, err := GetBlockchain(&params, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bc, hashes
+}
+
+// 之前版本创建的主网链转换后可以打开，创世区块 hash 补记在数据库中，余额和转换前一致
+func TestOpenBaselineMainnetDatabase(t *testing.T) {
+	alice := HashPubKey(newTestWallet(t).PublicKey)
+	bob := HashPubKey(newTestWallet(t).PublicKey)
+	bc, hashes := openBaselineMainnet(t, alice, bob, alice)
+	defer bc.Db.Close()
+
+	if !bytes.Equal(bc.getLastHash(), hashes[2]) {
+		t.Fatalf("tip is %x, want %x", bc.getLastHash(), hashes[2])
+	}
+	err := bc.Db.View(func(tx *bolt.Tx) error {
+		if genesis := tx.Bucket([]byte(metaBucket)).Get([]byte(genesisKey)); !bytes.Equal(genesis, hashes[0]) {
+			return fmt.Errorf("recorded genesis block is %x, want %x", genesis, hashes[0])
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		pubKeyHash []byte
+		balance    int
+	}{{alice, 20}, {bob, 10}} {
+		outputs, err := (UTXOSet{bc}).FindUTXO(NewP2PKHScript(test.pubKeyHash))
+		if err != nil {
+			t.Fatal(err)
+		}
+		balance := 0
+		for _, out := range outputs {
+			balance += out.Value
+		}
+		if balance != test.balance {
+			t.Fatalf("balance of %x = %d, want %d", test.pubKeyHash, balance, test.balance)
+		}
+	}
+
+	// 固定了创世区块的网络不接受其他创世区块
+	params := *bc.Params
+	params.GenesisHash = RegTestParams.GenesisHash
+	bc.Db.Close()
+	if _, err := GetBlockchain(&params, ""); !errors.Is(err, ErrNetworkMismatch) {
+		t.Fatalf("err = %v, want ErrNetworkMismatch", err)
+	}
+}
+
+// 转换来的区块没有记录难度，在它们之后挖矿使用最低难度，跨过难度调整周期时也不能得到为0的目标值
+func TestMineOnBaselineChain(t *testing.T) {
+	bc, _ := openBaselineMainnet(t, HashPubKey(newTestWallet(t).PublicKey), HashPubKey(newTestWallet(t).PublicKey))
+	defer bc.Db.Close()
+
+	for height := 2; height <= bc.Params.RetargetInterval+1; height++ {
+		bits, err := bc.Engine.CalcDifficulty(bc, bc.getLastHash())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bits != bc.Params.PowLimitBits() {
+			t.Fatalf("bits at height %d = %08x, want %08x", height, bits, bc.Params.PowLimitBits())
+		}
+		if block := mineTestBlock(t, bc); block.Height != height {
+			t.Fatalf("mined block at height %d, want %d", block.Height, height)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// 区块模板中交易的总大小上限（按序列化后的交易大小计算）
+const maxBlockTxSize = 1 << 20
+
+// 统计 hash 次数的共识引擎，用于报告算力
+type hashCounter interface {
+	Hashes() uint64
+}
+
+// 持续挖矿的矿工
+// 每一轮从交易池中挑选交易组装区块模板，交给链的共识引擎封装；主链 tip 变化时放弃当前模板，基于新的 tip 重新开始
+type Miner struct {
+	bc      *Blockchain
+	mempool *Mempool
+	// 接收区块奖励的地址
+	address string
+	// 挖出的区块交给节点处理，由节点负责上链和广播
+	submit func(*Block)
+
+	mu     sync.Mutex
+	cancel context.CancelFunc
+}
+
+func NewMiner(bc *Blockchain, mempool *Mempool, address string, submit func(*Block)) *Miner {
+	return &Miner{bc: bc, mempool: mempool, address: address, submit: submit}
+}
+
+// 开始挖矿，不会返回
+func (m *Miner) Run() {
+	for {
+		// 先登记 cancel 再读取 tip，这样读取 tip 之后到达的新区块一定能取消这一轮
+		ctx, cancel := context.WithCancel(context.Background())
+		m.mu.Lock()
+		m.cancel = cancel
+		m.mu.Unlock()
+
+		txs, fees := m.mempool.SelectTransactions(maxBlockTxSize)
+		// 交易池按当时的 UTXO 集校验交易，之后可能失效；移出不能打包的交易，避免每个模板都被拒绝
+		_, invalid, err := m.bc.selectValidTransactions(txs)
+		if err != nil {
+			log.Printf("Failed to check block template: %v\n", err)
+			cancel()
+			time.Sleep(time.Second)
+			continue
+		}
+		if len(invalid) > 0 {
+			for _, tx := range invalid {
+				log.Printf("Evicting transaction %x from the mempool: it fails block validation\n", tx.ID)
+				m.mempool.Remove(tx.ID)
+			}
+			cancel()
+			continue
+		}
+
+		block, err := m.bc.NewBlockTemplate(m.address, txs, fees)
+		if err != nil {
+			log.Printf("Failed to create block template: %v\n", err)
+			cancel()
+			time.Sleep(time.Second)
+			continue
+		}
+
+		start := time.Now()
+		counter, countHashes := m.bc.Engine.(hashCounter)
+		var startHashes uint64
+		if countHashes {
+			startHashes = counter.Hashes()
+		}
+
+		err = m.bc.Engine.Seal(ctx, m.bc, block)
+		if errors.Is(err, ErrNotInTurn) {
+			// 不轮到本节点出块，等其他节点的区块改变 tip 之后再试
+			<-ctx.Done()
+		}
+		cancel()
+		if err != nil {
+			continue
+		}
+
+		if countHashes {
+			fmt.Printf("Hashrate: %.0f H/s\n", float64(counter.Hashes()-startHashes)/time.Since(start).Seconds())
+		}
+		m.submit(block)
+	}
+}
+
+// 通知矿工主链的 tip 已经变化，放弃当前的区块模板
+func (m *Miner) NewTip() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.cancel != nil {
+		m.cancel()
+	}
+}
@@ -0,0 +1,263 @@
+package core
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+// M-of-N 多重签名，通过锁定到脚本hash（P2SH）的输出使用：
+//
+//	赎回脚本  OP_M <公钥1> ... <公钥N> OP_N OP_CHECKMULTISIG
+//	锁定脚本  OP_HASH160 <赎回脚本的hash> OP_EQUAL
+//	解锁脚本  <签名1> ... <签名M> <赎回脚本>
+//
+// 付款方只需要知道赎回脚本的hash（即多签地址），花费时再提供完整的赎回脚本
+// 公钥的顺序决定了赎回脚本和地址，所有参与者需要使用相同的顺序
+// 赎回脚本作为一个元素压入栈，不能超过 maxScriptElementSize
+// 每个64字节的公钥占 1+64 字节，加上 OP_M、OP_N 和 OP_CHECKMULTISIG，7个公钥共 458 字节，8个就超过了 520 字节
+const maxMultisigKeys = 7
+
+var (
+	// 收集到的签名少于赎回脚本要求的数量
+	ErrNotEnoughSignatures = errors.New("not enough signatures")
+	// 不是 OP_M <公钥>... OP_N OP_CHECKMULTISIG 形式的赎回脚本
+	ErrNotMultisigScript = errors.New("not a multisig redeem script")
+)
+
+// 创建 M-of-N 多签赎回脚本
+func NewMultisigScript(m int, pubKeys [][]byte) ([]byte, error) {
+	n := len(pubKeys)
+	if n == 0 || n > maxMultisigKeys || m <= 0 || m > n {
+		return nil, fmt.Errorf("invalid multisig %d of %d, need 1 <= M <= N <= %d", m, n, maxMultisigKeys)
+	}
+
+	script := []byte{OP_1 - 1 + byte(m)}
+	for _, pubKey := range pubKeys {
+		if len(pubKey) != publicKeyLength {
+			return nil, fmt.Errorf("invalid public key %x", pubKey)
+		}
+		script = pushData(script, pubKey)
+	}
+	script = append(script, OP_1-1+byte(n), OP_CHECKMULTISIG)
+	if len(script) > maxScriptElementSize {
+		return nil, fmt.Errorf("redeem script of %d keys is %d bytes, more than %d", n, len(script), maxScriptElementSize)
+	}
+	return script, nil
+}
+
+// 解析多签赎回脚本，返回需要的签名数量和公钥
+func parseMultisigScript(script []byte) (int, [][]byte, error) {
+	ops, err := parseScript(script)
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(ops) < 4 || ops[len(ops)-1].opcode != OP_CHECKMULTISIG {
+		return 0, nil, ErrNotMultisigScript
+	}
+
+	first, last := ops[0].opcode, ops[len(ops)-2].opcode
+	if first < OP_1 || first > OP_16 || last < OP_1 || last > OP_16 {
+		return 0, nil, ErrNotMultisigScript
+	}
+	m, n := int(first-OP_1+1), int(last-OP_1+1)
+	if n != len(ops)-3 || m > n || n > maxMultisigKeys {
+		return 0, nil, ErrNotMultisigScript
+	}
+
+	var pubKeys [][]byte
+	for _, op := range ops[1 : len(ops)-2] {
+		if len(op.data) != publicKeyLength {
+			return 0, nil, ErrNotMultisigScript
+		}
+		pubKeys = append(pubKeys, op.data)
+	}
+	return m, pubKeys, nil
+}
+
+// 锁定到脚本hash的标准脚本
+func NewP2SHScript(scriptHash []byte) []byte {
+	script := []byte{OP_HASH160}
+	script = pushData(script, scriptHash)
+	return append(script, OP_EQUAL)
+}
+
+// 标准 P2SH 锁定脚本中的脚本hash，其他脚本返回 nil
+func extractScriptHash(script []byte) []byte {
+	if len(script) == 23 && script[0] == OP_HASH160 && script[1] == 20 && script[22] == OP_EQUAL {
+		return script[2:22]
+	}
+	return nil
+}
+
+// 标准锁定脚本对应地址中的hash（公钥hash或者脚本hash），地址索引按它记录，非标准脚本返回 nil
+func scriptAddressHash(script []byte) []byte {
+	if hash := extractPubKeyHash(script); hash != nil {
+		return hash
+	}
+	return extractScriptHash(script)
+}
+
+// 多签交易的签名过程中在参与者之间传递的数据，以 JSON 文件保存
+// 签名不改变交易ID，参与者可以按任意顺序签名
+type MultisigTx struct {
+	// 还没有解锁脚本的交易，所有输入都花费锁定到同一个赎回脚本的 P2SH 输出
+	Tx Transaction
+	// 赎回脚本
+	RedeemScript []byte
+	// 每个输入收集到的签名，key 为签名者公钥的十六进制
+	Signatures []map[string][]byte
+}
+
+// 创建花费多签地址中 amount 个币的交易，redeemScript 为多签地址的赎回脚本，找零回到多签地址
+func NewMultisigTransaction(redeemScript []byte, to string, amount int, UTXOSet *UTXOSet) (*MultisigTx, error) {
+	if _, _, err := parseMultisigScript(redeemScript); err != nil {
+		return nil, err
+	}
+	toScript, err := UTXOSet.Blockchain.Params.AddressScript(to)
+	if err != nil {
+		return nil, err
+	}
+
+	lockScript := NewP2SHScript(HashPubKey(redeemScript))
+	acc, validOutputs, err := UTXOSet.FindSpendableOutputs(lockScript, amount)
+	if err != nil {
+		return nil, err
+	}
+	if acc < amount {
+		return nil, fmt.Errorf("%w: need %d, have %d", ErrInsufficientFunds, amount, acc)
+	}
+
+	var inputs []TXInput
+	for txid, outs := range validOutputs {
+		txID, _ := hex.DecodeString(txid)
+		for _, out := range outs {
+			inputs = append(inputs, NewTxin(txID, out))
+		}
+	}
+
+	outputs := []TXOutput{{amount, toScript}}
+	if acc > amount {
+		outputs = append(outputs, TXOutput{acc - amount, lockScript})
+	}
+
+	tx := Transaction{nil, inputs, outputs, 0}
+	tx.SetID()
+
+	mtx := &MultisigTx{Tx: tx, RedeemScript: redeemScript}
+	for range inputs {
+		mtx.Signatures = append(mtx.Signatures, make(map[string][]byte))
+	}
+	return mtx, nil
+}
+
+// 用钱包的私钥签名所有输入，钱包的公钥必须在赎回脚本中
+func (mtx *MultisigTx) Sign(wallet *Wallet) error {
+	_, pubKeys, err := parseMultisigScript(mtx.RedeemScript)
+	if err != nil {
+		return err
+	}
+	// 赎回脚本中是补齐后的64字节公钥，早期版本钱包保存的短公钥需要转换
+	pubKey := marshalPubKey(&wallet.PrivateKey.PublicKey)
+	if !containsKey(pubKeys, pubKey) {
+		return fmt.Errorf("%x is not a key of the multisig", pubKey)
+	}
+
+	for inID := range mtx.Tx.Vin {
+		signature, err := signHash(&wallet.PrivateKey, mtx.Tx.signatureHash(inID, mtx.RedeemScript))
+		if err != nil {
+			return err
+		}
+		mtx.Signatures[inID][hex.EncodeToString(pubKey)] = signature
+	}
+	return nil
+}
+
+func containsKey(pubKeys [][]byte, pubKey []byte) bool {
+	for _, key := range pubKeys {
+		if bytes.Equal(key, pubKey) {
+			return true
+		}
+	}
+	return false
+}
+
+// 已经签名的公钥数量和需要的签名数量，以签名最少的输入为准
+func (mtx *MultisigTx) SignatureCount() (have, need int, err error) {
+	need, _, err = parseMultisigScript(mtx.RedeemScript)
+	if err != nil {
+		return 0, 0, err
+	}
+	have = -1
+	for _, signatures := range mtx.Signatures {
+		if have < 0 || len(signatures) < have {
+			have = len(signatures)
+		}
+	}
+	return have, need, nil
+}
+
+// 按赎回脚本中公钥的顺序选出 M 个签名，生成每个输入的解锁脚本，返回可以广播的交易
+func (mtx *MultisigTx) Finalize() (*Transaction, error) {
+	m, pubKeys, err := parseMultisigScript(mtx.RedeemScript)
+	if err != nil {
+		return nil, err
+	}
+	if len(mtx.Signatures) != len(mtx.Tx.Vin) {
+		return nil, fmt.Errorf("%d inputs but signatures for %d", len(mtx.Tx.Vin), len(mtx.Signatures))
+	}
+
+	tx := mtx.Tx.TrimmedCopy()
+	for inID, signatures := range mtx.Signatures {
+		var scriptSig []byte
+		count := 0
+		for _, pubKey := range pubKeys {
+			signature, ok := signatures[hex.EncodeToString(pubKey)]
+			if !ok || count == m {
+				continue
+			}
+			scriptSig = pushData(scriptSig, signature)
+			count++
+		}
+		if count < m {
+			return nil, fmt.Errorf("%w: input %d has %d of %d", ErrNotEnoughSignatures, inID, count, m)
+		}
+		tx.Vin[inID].ScriptSig = pushData(scriptSig, mtx.RedeemScript)
+	}
+
+	return &tx, nil
+}
+
+// 把多签交易写入文件
+func (mtx *MultisigTx) SaveToFile(file string) error {
+	data, err := json.MarshalIndent(mtx, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, data, 0644)
+}
+
+// 从文件读取多签交易
+func LoadMultisigTx(file string) (*MultisigTx, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var mtx MultisigTx
+	if err := json.Unmarshal(data, &mtx); err != nil {
+		return nil, fmt.Errorf("decode multisig transaction %s: %w", file, err)
+	}
+	if len(mtx.Signatures) != len(mtx.Tx.Vin) {
+		return nil, fmt.Errorf("%s: %d inputs but signatures for %d", file, len(mtx.Tx.Vin), len(mtx.Signatures))
+	}
+	for inID := range mtx.Signatures {
+		if mtx.Signatures[inID] == nil {
+			mtx.Signatures[inID] = make(map[string][]byte)
+		}
+	}
+	return &mtx, nil
+}
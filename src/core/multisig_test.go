@@ -0,0 +1,152 @@
+package core
+
+import (
+	"errors"
+	"testing"
+)
+
+// 早期版本的钱包保存的是不补齐的短公钥
+func newLegacyTestWallet(t *testing.T) *Wallet {
+	t.Helper()
+	for {
+		wallet := newTestWallet(t)
+		if pubKey := legacyPubKey(&wallet.PrivateKey.PublicKey); len(pubKey) < publicKeyLength {
+			wallet.PublicKey = pubKey
+			return wallet
+		}
+	}
+}
+
+// 给 M-of-N 多签地址转入 amount，返回赎回脚本
+func fundMultisig(t *testing.T, bc *Blockchain, from *Wallet, amount, m int, wallets ...*Wallet) []byte {
+	t.Helper()
+
+	var pubKeys [][]byte
+	for _, wallet := range wallets {
+		pubKeys = append(pubKeys, marshalPubKey(&wallet.PrivateKey.PublicKey))
+	}
+	redeemScript, err := NewMultisigScript(m, pubKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx, err := NewTransaction(from, bc.Params.ScriptAddress(redeemScript), amount, 0, 0, &UTXOSet{bc})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mineTestBlock(t, bc, tx)
+	return redeemScript
+}
+
+// 早期版本钱包的参与者也能签名，签名按补齐后的公钥记录，Finalize 能按赎回脚本中的公钥找到它
+func TestMultisigSignWithLegacyWallet(t *testing.T) {
+	bc, alice := newTestChain(t)
+	legacy := newLegacyTestWallet(t)
+	other := newTestWallet(t)
+	redeemScript := fundMultisig(t, bc, alice, 6, 2, legacy, other)
+
+	mtx, err := NewMultisigTransaction(redeemScript, testAddress(bc.Params, alice), 4, &UTXOSet{bc})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, wallet := range []*Wallet{legacy, other} {
+		if err := mtx.Sign(wallet); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if have, need, err := mtx.SignatureCount(); err != nil || have != 2 || need != 2 {
+		t.Fatalf("SignatureCount() = %d, %d, %v, want 2 of 2", have, need, err)
+	}
+	tx, err := mtx.Finalize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mineTestBlock(t, bc, tx)
+}
+
+// 解锁脚本不满足 P2SH 多签输出的各种情况：交易池和区块都拒绝
+func TestMultisigScriptFailures(t *testing.T) {
+	bc, alice := newTestChain(t)
+	a, b, c, outsider := newTestWallet(t), newTestWallet(t), newTestWallet(t), newTestWallet(t)
+	redeemScript := fundMultisig(t, bc, alice, 6, 2, a, b, c)
+	otherScript, err := NewMultisigScript(2, [][]byte{marshalPubKey(&a.PrivateKey.PublicKey), marshalPubKey(&outsider.PrivateKey.PublicKey)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mtx, err := NewMultisigTransaction(redeemScript, testAddress(bc.Params, alice), 4, &UTXOSet{bc})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mtx.Tx.Vin) != 1 {
+		t.Fatalf("transaction has %d inputs, want 1", len(mtx.Tx.Vin))
+	}
+	if err := mtx.Sign(outsider); err == nil {
+		t.Fatal("a key outside the redeem script signed the transaction")
+	}
+	if err := mtx.Sign(a); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mtx.Finalize(); !errors.Is(err, ErrNotEnoughSignatures) {
+		t.Fatalf("finalizing with one signature: err = %v, want ErrNotEnoughSignatures", err)
+	}
+
+	sign := func(wallet *Wallet, script []byte) []byte {
+		signature, err := signHash(&wallet.PrivateKey, mtx.Tx.signatureHash(0, script))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signature
+	}
+	scriptSig := func(redeemScript []byte, signatures ...[]byte) []byte {
+		var script []byte
+		for _, signature := range signatures {
+			script = pushData(script, signature)
+		}
+		if redeemScript != nil {
+			script = pushData(script, redeemScript)
+		}
+		return script
+	}
+	sigA, sigB, sigC := sign(a, redeemScript), sign(b, redeemScript), sign(c, redeemScript)
+
+	entry, found, err := (UTXOSet{bc}).FindOutput(mtx.Tx.Vin[0].Txid, mtx.Tx.Vin[0].Vout)
+	if err != nil || !found {
+		t.Fatalf("funding output found = %v, err = %v", found, err)
+	}
+	prevOuts := []TXOutput{entry.Out}
+
+	for _, test := range []struct {
+		name      string
+		scriptSig []byte
+		valid     bool
+	}{
+		{"first and third key", scriptSig(redeemScript, sigA, sigC), true},
+		{"wrong redeem script", scriptSig(otherScript, sign(a, otherScript), sign(outsider, otherScript)), false},
+		{"no redeem script", scriptSig(nil, sigA, sigB), false},
+		{"one signature", scriptSig(redeemScript, sigA), false},
+		{"signatures out of order", scriptSig(redeemScript, sigB, sigA), false},
+		{"same signature twice", scriptSig(redeemScript, sigA, sigA), false},
+		{"signer outside the redeem script", scriptSig(redeemScript, sigA, sign(outsider, redeemScript)), false},
+		{"signature for another script", scriptSig(redeemScript, sigA, sign(b, otherScript)), false},
+	} {
+		tx := mtx.Tx.TrimmedCopy()
+		tx.Vin[0].ScriptSig = test.scriptSig
+
+		err := tx.verifyInputs(prevOuts)
+		if test.valid {
+			if err != nil {
+				t.Fatalf("%s: %v", test.name, err)
+			}
+			continue
+		}
+		if !errors.Is(err, ErrScriptFailed) {
+			t.Fatalf("%s: err = %v, want ErrScriptFailed", test.name, err)
+		}
+		if err := NewMempool(UTXOSet{bc}, defaultMempoolMaxSize).Add(&tx); !errors.Is(err, ErrInvalidTx) {
+			t.Fatalf("%s: mempool err = %v, want ErrInvalidTx", test.name, err)
+		}
+		if _, err := bc.ProcessBlock(sealTestBlock(t, bc, &tx)); !errors.Is(err, ErrBadSignature) {
+			t.Fatalf("%s: block err = %v, want ErrBadSignature", test.name, err)
+		}
+	}
+}
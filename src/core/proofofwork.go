@@ -2,87 +2,169 @@ package core
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/binary"
-	"log"
+	"errors"
 	"math"
 	"math/big"
+	"runtime"
+	"sync"
+	"sync/atomic"
 )
 
 var (
 	maxNonce = math.MaxInt64
 )
 
-// 目标（调整这个数字可以变更计算的难度，数字越小哈希的前置0越少）
-const targetBits = 10
+// 挖矿时每尝试这么多个 nonce 检查一次是否被取消，并行挖矿时也是每个 goroutine 一次领取的 nonce 数量
+const ctxCheckInterval = 1 << 12
+
+// nonce 已经全部尝试过，需要修改时间戳或 extra nonce 后重新开始
+var ErrNonceExhausted = errors.New("nonce space exhausted")
 
 type ProofOfWork struct {
-	block  *Block   // 区块
-	target *big.Int // 目标
+	block  *BlockHeader // 区块头，工作量证明只涉及区块头中的字段
+	target *big.Int     // 目标
 }
 
-func NewProofOfWork(block *Block) *ProofOfWork {
-	target := big.NewInt(1)
-	// 左移运算，target 的二进制位全部左移uint(256-targetBits)位
-	// 也理解为 target 乘以 2 的 uint(256-targetBits) 次方
-	target.Lsh(target, uint(256-targetBits))
+func NewProofOfWork(block *BlockHeader) *ProofOfWork {
+	// 目标值由区块头中紧凑格式的 Bits 还原
+	target := CompactToBig(block.Bits)
 
 	return &ProofOfWork{block, target}
 }
 
-//Run执行工作证明
-func (pow *ProofOfWork) Run() (int, []byte) {
+//Run执行工作证明，使用所有 CPU 核心
+// nonce 全部尝试过仍然没有找到满足目标的 hash 时返回 ErrNonceExhausted
+func (pow *ProofOfWork) Run() (int, []byte, error) {
+	nonce, hash, _, err := pow.RunParallel(context.Background(), runtime.NumCPU())
+	return nonce, hash, err
+}
+
+// 单线程执行工作量证明，从 0 开始依次尝试 nonce，ctx 被取消时停止并返回 ctx 的错误
+func (pow *ProofOfWork) RunContext(ctx context.Context) (int, []byte, error) {
 	var hashInt big.Int
 	var hash [32]byte
-	nonce := 0
 
-	for nonce < maxNonce {
+	for nonce := 0; nonce < maxNonce; nonce++ {
+		// 每尝试一批 nonce 检查一次是否需要停止
+		if nonce%ctxCheckInterval == 0 && ctx.Err() != nil {
+			return 0, nil, ctx.Err()
+		}
+
 		data := pow.prepareData(nonce)
 		hash = sha256.Sum256(data)
 		hashInt.SetBytes(hash[:])
-		//fmt.Printf("generate hash: %x  nonce:%d\n", hash, nonce)
 
 		// 比较hash，小于目标值
 		if hashInt.Cmp(pow.target) == -1 {
-			break
-		} else {
-			nonce++
+			return nonce, hash[:], nil
 		}
 	}
 
-	return nonce, hash[:]
+	return 0, nil, ErrNonceExhausted
+}
+
+// 用 workers 个 goroutine 并行执行工作量证明，同时返回尝试过的 hash 数量，用于计算算力
+// nonce 按 ctxCheckInterval 分段，各 goroutine 依次领取。找到满足条件的 nonce 后，
+// 编号更小的分段仍会算完，因此结果总是最小的有效 nonce，和 RunContext 的结果相同。
+// ctx 被取消时返回 ctx 的错误，所有 nonce 都不满足时返回 ErrNonceExhausted
+func (pow *ProofOfWork) RunParallel(ctx context.Context, workers int) (int, []byte, uint64, error) {
+	if workers < 1 {
+		workers = 1
+	}
+
+	var (
+		nextChunk int64
+		hashes    uint64
+		// 找到结果的分段编号，编号更大的分段不需要再领取
+		stopChunk int64 = math.MaxInt64
+		mu        sync.Mutex
+		best      = -1
+		bestHash  []byte
+		wg        sync.WaitGroup
+	)
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var hashInt big.Int
+
+			for ctx.Err() == nil {
+				chunk := atomic.AddInt64(&nextChunk, 1) - 1
+				start := chunk * ctxCheckInterval
+				if chunk > atomic.LoadInt64(&stopChunk) || start >= int64(maxNonce) {
+					return
+				}
+				end := start + ctxCheckInterval
+				if end > int64(maxNonce) {
+					end = int64(maxNonce)
+				}
+
+				var count uint64
+				for nonce := start; nonce < end; nonce++ {
+					hash := sha256.Sum256(pow.prepareData(int(nonce)))
+					count++
+					hashInt.SetBytes(hash[:])
+					if hashInt.Cmp(pow.target) == -1 {
+						mu.Lock()
+						if best < 0 || int(nonce) < best {
+							best = int(nonce)
+							bestHash = hash[:]
+							atomic.StoreInt64(&stopChunk, chunk)
+						}
+						mu.Unlock()
+						break
+					}
+				}
+				atomic.AddUint64(&hashes, count)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		return 0, nil, hashes, ctx.Err()
+	}
+	if best < 0 {
+		return 0, nil, hashes, ErrNonceExhausted
+	}
+	return best, bestHash, hashes, nil
 }
 
 // 工作量计算
 func (pow *ProofOfWork) prepareData(nonce int) []byte {
-	data := bytes.Join(
-		[][]byte{
-			pow.block.PreHash,
-			pow.block.HashTransactions(),
-			Int2Hex(pow.block.Timestamp),
-			Int2Hex(int64(targetBits)),
-			Int2Hex(int64(nonce)),
-		}, []byte{},
-	)
-	return data
+	return pow.block.hashData(nonce)
 }
 
 func Int2Hex(num int64) []byte {
-	buff := new(bytes.Buffer)
-	err := binary.Write(buff, binary.BigEndian, num)
-	if err != nil {
-		log.Panic(err)
-	}
+	buff := make([]byte, 8)
+	binary.BigEndian.PutUint64(buff, uint64(num))
 
-	return buff.Bytes()
+	return buff
 }
 
 // 验证hash
-func (pow *ProofOfWork) Validate() bool {
+// expectedBits 是按共识规则计算出的难度，区块声明的 Bits 必须与它一致，否则矿工可以自己降低难度
+// 区块中记录的 Hash 也必须和重新计算的结果相同
+func (pow *ProofOfWork) Validate(expectedBits uint32) bool {
+	if pow.block.Bits != expectedBits {
+		return false
+	}
+
 	data := pow.prepareData(pow.block.Nonce)
 	hash := sha256.Sum256(data)
 	var hashInt big.Int
 	hashInt.SetBytes(hash[:])
 
-	return hashInt.Cmp(pow.target) == -1
+	return bytes.Equal(hash[:], pow.block.Hash) && hashInt.Cmp(pow.target) == -1
+}
+
+// 区块的工作量，即找到满足目标的hash平均需要尝试的次数：2^256 / (target+1)
+// 目标值越小，工作量越大
+func (pow *ProofOfWork) Work() *big.Int {
+	denominator := new(big.Int).Add(pow.target, big.NewInt(1))
+	return new(big.Int).Div(new(big.Int).Lsh(big.NewInt(1), 256), denominator)
 }
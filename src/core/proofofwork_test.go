@@ -0,0 +1,56 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"math/big"
+	"testing"
+)
+
+// 并行挖矿总是返回最小的有效 nonce，和单线程从 0 开始依次尝试的结果相同
+// 目标约为 2^-14，有效 nonce 通常落在第一个分段之后，多个 goroutine 会同时算到
+func TestRunParallelMatchesRunContext(t *testing.T) {
+	header := &BlockHeader{
+		Timestamp: 1700000000,
+		TxHash:    bytes.Repeat([]byte{0x11}, 32),
+		PreHash:   bytes.Repeat([]byte{0x22}, 32),
+		Height:    1,
+		Bits:      BigToCompact(new(big.Int).Lsh(big.NewInt(1), 256-14)),
+	}
+	pow := NewProofOfWork(header)
+
+	wantNonce, wantHash, err := pow.RunContext(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, workers := range []int{1, 2, 4, 8} {
+		nonce, hash, hashes, err := pow.RunParallel(context.Background(), workers)
+		if err != nil {
+			t.Fatalf("%d workers: %v", workers, err)
+		}
+		if nonce != wantNonce || !bytes.Equal(hash, wantHash) {
+			t.Fatalf("%d workers: nonce %d hash %x, want nonce %d hash %x", workers, nonce, hash, wantNonce, wantHash)
+		}
+		if hashes < uint64(wantNonce)+1 {
+			t.Fatalf("%d workers: %d hashes, at least %d nonces must be tried", workers, hashes, wantNonce+1)
+		}
+	}
+
+	header.Nonce = wantNonce
+	header.Hash = wantHash
+	if !pow.Validate(header.Bits) {
+		t.Fatal("found nonce does not validate")
+	}
+}
+
+// 取消后返回 ctx 的错误
+func TestRunParallelCanceled(t *testing.T) {
+	header := &BlockHeader{Bits: BigToCompact(big.NewInt(1))}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, _, _, err := NewProofOfWork(header).RunParallel(ctx, 4); err != context.Canceled {
+		t.Fatalf("err = %v, want context.Canceled", err)
+	}
+}
@@ -0,0 +1,440 @@
+package core
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// 输出通过锁定脚本（TXOutput.ScriptPubKey）规定花费条件，输入通过解锁脚本（TXInput.ScriptSig）提供满足条件的数据
+// 验证时先执行解锁脚本，再在同一个栈上执行锁定脚本，最后栈上只剩一个为真的元素时验证通过
+// 脚本是基于栈的字节码，操作码的取值和比特币相同：
+//
+//	0x00        OP_0，压入空字节串
+//	0x01-0x4b   压入后面紧跟的 1-75 个字节
+//	0x4c        OP_PUSHDATA1，后面1字节长度，再压入对应长度的数据
+//	0x4d        OP_PUSHDATA2，后面2字节小端序长度，再压入对应长度的数据
+//	0x51-0x60   OP_1-OP_16，压入数字 1-16
+//
+// 锁定到公钥hash（P2PKH）的标准脚本：
+//
+//	锁定脚本  OP_DUP OP_HASH160 <公钥hash> OP_EQUALVERIFY OP_CHECKSIG
+//	解锁脚本  <签名> <公钥>
+//
+// 锁定到脚本hash（P2SH）的输出见 multisig.go
+const (
+	OP_0           = 0x00
+	OP_PUSHDATA1   = 0x4c
+	OP_PUSHDATA2   = 0x4d
+	OP_1           = 0x51
+	OP_16          = 0x60
+	OP_VERIFY      = 0x69
+	OP_DROP        = 0x75
+	OP_DUP         = 0x76
+	OP_EQUAL       = 0x87
+	OP_EQUALVERIFY = 0x88
+	OP_SHA256      = 0xa8
+	OP_HASH160     = 0xa9
+	OP_CHECKSIG    = 0xac
+	// 执行 OP_CHECKSIG，结果为假时失败，不在栈上留下结果
+	OP_CHECKSIGVERIFY = 0xad
+	// <签名1> ... <签名M> M <公钥1> ... <公钥N> N OP_CHECKMULTISIG
+	// 签名的顺序必须和对应公钥的顺序一致
+	OP_CHECKMULTISIG       = 0xae
+	OP_CHECKMULTISIGVERIFY = 0xaf
+)
+
+// 脚本执行的限制，防止恶意脚本消耗过多资源
+const (
+	maxScriptSize        = 10000
+	maxScriptElementSize = 520
+	maxScriptStackSize   = 1000
+	// 每个脚本中非数据压入的操作码数量，OP_CHECKMULTISIG 的每个公钥也计入
+	maxScriptOps = 201
+)
+
+// 脚本格式错误或者执行结果不满足条件
+var ErrScriptFailed = errors.New("script verification failed")
+
+// 解析出的一条指令，data 为数据压入指令压入的数据
+type scriptOp struct {
+	opcode byte
+	data   []byte
+}
+
+// 解析脚本，数据压入指令必须使用最短的编码，保证同样的脚本只有一种字节表示
+func parseScript(script []byte) ([]scriptOp, error) {
+	if len(script) > maxScriptSize {
+		return nil, fmt.Errorf("%w: script is %d bytes", ErrScriptFailed, len(script))
+	}
+
+	var ops []scriptOp
+	for i := 0; i < len(script); {
+		start := i
+		opcode := script[i]
+		i++
+
+		var n int
+		switch {
+		case opcode >= 0x01 && opcode <= 0x4b:
+			n = int(opcode)
+		case opcode == OP_PUSHDATA1:
+			if i+1 > len(script) {
+				return nil, fmt.Errorf("%w: truncated OP_PUSHDATA1", ErrScriptFailed)
+			}
+			n = int(script[i])
+			i++
+		case opcode == OP_PUSHDATA2:
+			if i+2 > len(script) {
+				return nil, fmt.Errorf("%w: truncated OP_PUSHDATA2", ErrScriptFailed)
+			}
+			n = int(binary.LittleEndian.Uint16(script[i:]))
+			i += 2
+		default:
+			ops = append(ops, scriptOp{opcode: opcode})
+			continue
+		}
+
+		if i+n > len(script) {
+			return nil, fmt.Errorf("%w: push of %d bytes exceeds script", ErrScriptFailed, n)
+		}
+		data := script[i : i+n]
+		i += n
+		if !bytes.Equal(pushData(nil, data), script[start:i]) {
+			return nil, fmt.Errorf("%w: non-minimal push", ErrScriptFailed)
+		}
+		ops = append(ops, scriptOp{opcode, data})
+	}
+
+	return ops, nil
+}
+
+// 在脚本后追加压入 data 的指令，使用最短的编码
+func pushData(script, data []byte) []byte {
+	n := len(data)
+	switch {
+	case n == 0:
+		return append(script, OP_0)
+	case n == 1 && data[0] >= 1 && data[0] <= 16:
+		return append(script, OP_1-1+data[0])
+	case n <= 0x4b:
+		script = append(script, byte(n))
+	case n <= 0xff:
+		script = append(script, OP_PUSHDATA1, byte(n))
+	default:
+		script = append(script, OP_PUSHDATA2, byte(n), byte(n>>8))
+	}
+	return append(script, data...)
+}
+
+// 是否只包含数据压入指令
+func isPushOnly(ops []scriptOp) bool {
+	for _, op := range ops {
+		if op.opcode > OP_16 {
+			return false
+		}
+	}
+	return true
+}
+
+// 锁定到公钥hash的标准脚本
+func NewP2PKHScript(pubKeyHash []byte) []byte {
+	script := []byte{OP_DUP, OP_HASH160}
+	script = pushData(script, pubKeyHash)
+	return append(script, OP_EQUALVERIFY, OP_CHECKSIG)
+}
+
+// P2PKH 输出的解锁脚本
+func p2pkhScriptSig(signature, pubKey []byte) []byte {
+	return pushData(pushData(nil, signature), pubKey)
+}
+
+// 标准 P2PKH 锁定脚本中的公钥hash，其他脚本返回 nil
+func extractPubKeyHash(script []byte) []byte {
+	if len(script) == 25 && script[0] == OP_DUP && script[1] == OP_HASH160 && script[2] == 20 &&
+		script[23] == OP_EQUALVERIFY && script[24] == OP_CHECKSIG {
+		return script[3:23]
+	}
+	return nil
+}
+
+// 栈中的元素作为布尔值：任何一个字节不为0时为真
+func castToBool(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// 检查签名时计算被签名数据需要的交易上下文
+type sigChecker interface {
+	// 用 pubKey 验证签名，scriptCode 为正在执行的锁定脚本
+	checkSig(signature, pubKey, scriptCode []byte) bool
+}
+
+// 脚本解释器，解锁脚本和锁定脚本共用一个栈
+type scriptEngine struct {
+	stack   [][]byte
+	checker sigChecker
+	// 当前脚本已经执行的操作数
+	ops int
+}
+
+func (e *scriptEngine) push(data []byte) error {
+	if len(data) > maxScriptElementSize {
+		return fmt.Errorf("%w: element of %d bytes", ErrScriptFailed, len(data))
+	}
+	if len(e.stack) >= maxScriptStackSize {
+		return fmt.Errorf("%w: stack overflow", ErrScriptFailed)
+	}
+	e.stack = append(e.stack, data)
+	return nil
+}
+
+func (e *scriptEngine) pop() ([]byte, error) {
+	if len(e.stack) == 0 {
+		return nil, fmt.Errorf("%w: stack underflow", ErrScriptFailed)
+	}
+	data := e.stack[len(e.stack)-1]
+	e.stack = e.stack[:len(e.stack)-1]
+	return data, nil
+}
+
+// 弹出一个 0-16 之间的数字
+func (e *scriptEngine) popSmallInt() (int, error) {
+	data, err := e.pop()
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case len(data) == 0:
+		return 0, nil
+	case len(data) == 1 && data[0] <= 16:
+		return int(data[0]), nil
+	}
+	return 0, fmt.Errorf("%w: %x is not a number between 0 and 16", ErrScriptFailed, data)
+}
+
+func (e *scriptEngine) countOps(n int) error {
+	if e.ops += n; e.ops > maxScriptOps {
+		return fmt.Errorf("%w: too many operations", ErrScriptFailed)
+	}
+	return nil
+}
+
+// 执行一段脚本
+func (e *scriptEngine) execute(script []byte) error {
+	ops, err := parseScript(script)
+	if err != nil {
+		return err
+	}
+
+	e.ops = 0
+	for _, op := range ops {
+		if op.opcode > OP_16 {
+			if err := e.countOps(1); err != nil {
+				return err
+			}
+		}
+		if err := e.step(op, script); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 执行一条指令
+func (e *scriptEngine) step(op scriptOp, script []byte) error {
+	switch {
+	case op.opcode <= OP_PUSHDATA2:
+		return e.push(op.data)
+	case op.opcode >= OP_1 && op.opcode <= OP_16:
+		return e.push([]byte{op.opcode - OP_1 + 1})
+	}
+
+	switch op.opcode {
+	case OP_VERIFY:
+		return e.verify("OP_VERIFY")
+
+	case OP_DROP:
+		_, err := e.pop()
+		return err
+
+	case OP_DUP:
+		data, err := e.pop()
+		if err != nil {
+			return err
+		}
+		if err := e.push(data); err != nil {
+			return err
+		}
+		return e.push(data)
+
+	case OP_EQUAL, OP_EQUALVERIFY:
+		a, err := e.pop()
+		if err != nil {
+			return err
+		}
+		b, err := e.pop()
+		if err != nil {
+			return err
+		}
+		if err := e.push(boolBytes(bytes.Equal(a, b))); err != nil {
+			return err
+		}
+		if op.opcode == OP_EQUALVERIFY {
+			return e.verify("OP_EQUALVERIFY")
+		}
+		return nil
+
+	case OP_SHA256:
+		data, err := e.pop()
+		if err != nil {
+			return err
+		}
+		hash := sha256.Sum256(data)
+		return e.push(hash[:])
+
+	case OP_HASH160:
+		data, err := e.pop()
+		if err != nil {
+			return err
+		}
+		return e.push(HashPubKey(data))
+
+	case OP_CHECKSIG, OP_CHECKSIGVERIFY:
+		pubKey, err := e.pop()
+		if err != nil {
+			return err
+		}
+		signature, err := e.pop()
+		if err != nil {
+			return err
+		}
+		if err := e.push(boolBytes(e.checker.checkSig(signature, pubKey, script))); err != nil {
+			return err
+		}
+		if op.opcode == OP_CHECKSIGVERIFY {
+			return e.verify("OP_CHECKSIGVERIFY")
+		}
+		return nil
+
+	case OP_CHECKMULTISIG, OP_CHECKMULTISIGVERIFY:
+		ok, err := e.checkMultisig(script)
+		if err != nil {
+			return err
+		}
+		if err := e.push(boolBytes(ok)); err != nil {
+			return err
+		}
+		if op.opcode == OP_CHECKMULTISIGVERIFY {
+			return e.verify("OP_CHECKMULTISIGVERIFY")
+		}
+		return nil
+	}
+
+	return fmt.Errorf("%w: unknown opcode 0x%02x", ErrScriptFailed, op.opcode)
+}
+
+// 从栈上取出公钥和签名，检查 M 个签名是否分别对应 N 个公钥中的 M 个
+// 签名和公钥都按压入的顺序匹配，一个公钥只能对应一个签名
+func (e *scriptEngine) checkMultisig(script []byte) (bool, error) {
+	n, err := e.popSmallInt()
+	if err != nil {
+		return false, err
+	}
+	if err := e.countOps(n); err != nil {
+		return false, err
+	}
+	pubKeys := make([][]byte, n)
+	for i := n - 1; i >= 0; i-- {
+		if pubKeys[i], err = e.pop(); err != nil {
+			return false, err
+		}
+	}
+
+	m, err := e.popSmallInt()
+	if err != nil {
+		return false, err
+	}
+	if m > n {
+		return false, fmt.Errorf("%w: %d signatures required but only %d keys", ErrScriptFailed, m, n)
+	}
+	signatures := make([][]byte, m)
+	for i := m - 1; i >= 0; i-- {
+		if signatures[i], err = e.pop(); err != nil {
+			return false, err
+		}
+	}
+
+	i := 0
+	for j := 0; i < m && j < n && m-i <= n-j; j++ {
+		if e.checker.checkSig(signatures[i], pubKeys[j], script) {
+			i++
+		}
+	}
+	return i == m, nil
+}
+
+// 栈顶元素为真时移除它，否则失败
+func (e *scriptEngine) verify(name string) error {
+	data, err := e.pop()
+	if err != nil {
+		return err
+	}
+	if !castToBool(data) {
+		return fmt.Errorf("%w: %s failed", ErrScriptFailed, name)
+	}
+	return nil
+}
+
+func boolBytes(v bool) []byte {
+	if v {
+		return []byte{1}
+	}
+	return nil
+}
+
+// 验证解锁脚本是否满足锁定脚本的条件
+// 解锁脚本只能压入数据，执行结束后栈上必须恰好剩下一个为真的元素
+// 锁定脚本是 P2SH 脚本时，锁定脚本只检查解锁脚本最后压入的赎回脚本的hash，之后再用解锁脚本压入的其他数据执行赎回脚本
+func verifyScript(scriptSig, scriptPubKey []byte, checker sigChecker) error {
+	ops, err := parseScript(scriptSig)
+	if err != nil {
+		return err
+	}
+	if !isPushOnly(ops) {
+		return fmt.Errorf("%w: unlocking script is not push only", ErrScriptFailed)
+	}
+
+	e := scriptEngine{checker: checker}
+	if err := e.execute(scriptSig); err != nil {
+		return err
+	}
+	p2sh := extractScriptHash(scriptPubKey) != nil
+	stack := append([][]byte{}, e.stack...)
+	if err := e.execute(scriptPubKey); err != nil {
+		return err
+	}
+
+	if p2sh {
+		if len(e.stack) == 0 || !castToBool(e.stack[len(e.stack)-1]) {
+			return fmt.Errorf("%w: redeem script hash mismatch", ErrScriptFailed)
+		}
+		// 锁定脚本中的 OP_HASH160 已经保证解锁脚本至少压入了一个元素
+		redeemScript := stack[len(stack)-1]
+		e.stack = stack[:len(stack)-1]
+		if err := e.execute(redeemScript); err != nil {
+			return err
+		}
+	}
+
+	if len(e.stack) != 1 || !castToBool(e.stack[0]) {
+		return fmt.Errorf("%w: script evaluated to false", ErrScriptFailed)
+	}
+	return nil
+}
@@ -0,0 +1,690 @@
+package core
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+const protocol = "tcp"
+
+// 协议版本，2 开始区块和交易使用规范的二进制编码，3 开始交易的输入和输出使用脚本，4 开始交易带有锁定时间和相对锁定，5 开始区块头包含 WitnessHash，不同版本的节点之间不交换数据
+const nodeVersion = 5
+
+// 消息头中命令名称的固定长度
+const commandLength = 12
+
+// 一条消息的最大长度，超过时丢弃消息并断开连接，避免对方发送无限长的数据耗尽内存
+// 挖矿时区块中交易的总大小不超过 maxBlockTxSize，inv 消息中每个区块hash约占33字节，这个长度可以容纳近百万个区块hash
+const maxMessageSize = 32 << 20
+
+// 默认的种子节点，新节点启动后先和它同步
+const defaultSeedNode = "localhost:3000"
+
+// 最多暂存的孤块数量
+const maxOrphanBlocks = 100
+
+// 矿工节点收到交易后等待这么久再挖矿，期间收到的交易会打包进同一个区块
+const miningDelay = time.Second
+
+// 节点之间交换的消息
+// version：握手，交换链的高度，高度低的一方发起同步
+type versionMsg struct {
+	Version    int
+	BestHeight int
+	AddrFrom   string
+}
+
+// getblocks：请求对方在 TipHash 之后的所有区块hash
+type getBlocksMsg struct {
+	AddrFrom string
+	TipHash  []byte
+}
+
+// inv：告知对方自己拥有的区块或交易
+type invMsg struct {
+	AddrFrom string
+	Type     string
+	Items    [][]byte
+}
+
+// getdata：请求某个区块或交易的完整数据
+type getDataMsg struct {
+	AddrFrom string
+	Type     string
+	ID       []byte
+}
+
+type blockMsg struct {
+	AddrFrom string
+	Block    []byte
+}
+
+type txMsg struct {
+	AddrFrom    string
+	Transaction []byte
+}
+
+// 网络节点，负责和其他节点交换区块和交易
+type Server struct {
+	nodeAddress   string
+	miningAddress string
+	bc            *Blockchain
+	// 已知的其他节点地址
+	knownNodes []string
+	// 同步过程中等待下载的区块
+	blocksInTransit [][]byte
+	// 父区块还没有收到的区块，key 为区块hash
+	orphans map[string]*Block
+	// 尚未打包进区块的交易
+	mempool *Mempool
+	// 已经安排了挖矿，在这之前收到的交易会被打包进同一个区块
+	miningScheduled bool
+	// 持续挖矿模式下的矿工，为 nil 时只在收到交易后挖矿
+	miner *Miner
+	// 同一时间只处理一条消息，避免并发修改链的状态
+	mu sync.Mutex
+}
+
+// 启动节点，监听 localhost:nodeID
+// 如果指定了 minerAddress，节点收到交易后会把它们打包进新区块，奖励发给该地址
+// 只有启动失败时才返回
+func StartServer(params *ChainParams, nodeID, minerAddress, seedNode string) error {
+	return startServer(params, nodeID, minerAddress, seedNode, false)
+}
+
+// 启动节点并持续挖矿，即使没有交易也会挖出只包含奖励交易的区块，奖励发给 minerAddress
+func StartMiner(params *ChainParams, nodeID, minerAddress, seedNode string) error {
+	return startServer(params, nodeID, minerAddress, seedNode, true)
+}
+
+func startServer(params *ChainParams, nodeID, minerAddress, seedNode string, continuous bool) error {
+	nodeAddress := fmt.Sprintf("localhost:%s", nodeID)
+	ln, err := net.Listen(protocol, nodeAddress)
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+
+	bc, err := GetBlockchain(params, nodeID)
+	if err != nil {
+		return err
+	}
+	defer bc.Db.Close()
+	if err := bc.checkLegacyChain(); err != nil {
+		return err
+	}
+	if minerAddress != "" {
+		if err := bc.UseSigner(nodeID, minerAddress); err != nil {
+			return err
+		}
+	}
+
+	s := newServer(nodeAddress, minerAddress, bc)
+	if continuous {
+		s.miner = NewMiner(bc, s.mempool, minerAddress, s.submitBlock)
+		go s.miner.Run()
+	}
+	return s.serve(ln, seedNode)
+}
+
+func newServer(nodeAddress, miningAddress string, bc *Blockchain) *Server {
+	return &Server{
+		nodeAddress:   nodeAddress,
+		miningAddress: miningAddress,
+		bc:            bc,
+		mempool:       NewMempool(UTXOSet{bc}, defaultMempoolMaxSize),
+		orphans:       make(map[string]*Block),
+	}
+}
+
+// 向种子节点发起握手，然后处理 ln 上的连接，ln 被关闭时返回
+func (s *Server) serve(ln net.Listener, seedNode string) error {
+	if seedNode != "" && seedNode != s.nodeAddress {
+		s.mu.Lock()
+		s.knownNodes = append(s.knownNodes, seedNode)
+		err := s.sendVersion(seedNode)
+		s.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go s.handleConnection(conn)
+	}
+}
+
+func (s *Server) handleConnection(conn net.Conn) {
+	defer conn.Close()
+	// 对方发来的数据不可信，处理时出现的 panic 不能让整个节点退出
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Error handling message from %s: %v\n", conn.RemoteAddr(), r)
+		}
+	}()
+
+	// 多读1个字节，用来判断消息是否超过了最大长度
+	request, err := ioutil.ReadAll(io.LimitReader(conn, maxMessageSize+1))
+	if err != nil {
+		log.Printf("Error reading from %s: %v\n", conn.RemoteAddr(), err)
+		return
+	}
+	if len(request) > maxMessageSize {
+		log.Printf("Message from %s exceeds %d bytes, dropping the connection\n", conn.RemoteAddr(), maxMessageSize)
+		return
+	}
+	if len(request) < commandLength {
+		return
+	}
+	command := bytesToCommand(request[:commandLength])
+	payload := request[commandLength:]
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch command {
+	case "version":
+		err = s.handleVersion(payload)
+	case "getblocks":
+		err = s.handleGetBlocks(payload)
+	case "inv":
+		err = s.handleInv(payload)
+	case "getdata":
+		err = s.handleGetData(payload)
+	case "block":
+		err = s.handleBlock(payload)
+	case "tx":
+		err = s.handleTx(payload)
+	default:
+		log.Printf("Unknown command: %s\n", command)
+	}
+	if err != nil {
+		log.Printf("Error handling %s from %s: %v\n", command, conn.RemoteAddr(), err)
+	}
+}
+
+func (s *Server) handleVersion(request []byte) error {
+	var payload versionMsg
+	if err := decodePayload(request, &payload); err != nil {
+		return err
+	}
+	if payload.Version != nodeVersion {
+		return fmt.Errorf("%s uses protocol version %d, expected %d", payload.AddrFrom, payload.Version, nodeVersion)
+	}
+
+	myBestHeight, err := s.bc.Height()
+	if err != nil {
+		return err
+	}
+	s.addKnownNode(payload.AddrFrom)
+	if myBestHeight < payload.BestHeight {
+		return s.sendGetBlocks(payload.AddrFrom)
+	} else if myBestHeight > payload.BestHeight {
+		return s.sendVersion(payload.AddrFrom)
+	}
+	return nil
+}
+
+func (s *Server) handleGetBlocks(request []byte) error {
+	var payload getBlocksMsg
+	if err := decodePayload(request, &payload); err != nil {
+		return err
+	}
+
+	hashes, err := s.bc.GetBlockHashes(payload.TipHash)
+	if err != nil {
+		return err
+	}
+	if len(hashes) > 0 {
+		return s.sendInv(payload.AddrFrom, "block", hashes)
+	}
+	return nil
+}
+
+func (s *Server) handleInv(request []byte) error {
+	var payload invMsg
+	if err := decodePayload(request, &payload); err != nil {
+		return err
+	}
+
+	switch payload.Type {
+	case "block":
+		var missing [][]byte
+		for _, hash := range payload.Items {
+			if !s.bc.HasBlock(hash) && !s.inTransit(hash) && s.orphans[hex.EncodeToString(hash)] == nil {
+				missing = append(missing, hash)
+			}
+		}
+		if len(missing) == 0 {
+			return nil
+		}
+
+		// 一次只请求一个区块，正在下载时新的区块排在后面，避免重复请求
+		idle := len(s.blocksInTransit) == 0
+		s.blocksInTransit = append(s.blocksInTransit, missing...)
+		if idle {
+			return s.sendGetData(payload.AddrFrom, "block", s.blocksInTransit[0])
+		}
+	case "tx":
+		for _, txID := range payload.Items {
+			if !s.mempool.Has(txID) {
+				if err := s.sendGetData(payload.AddrFrom, "tx", txID); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Server) handleGetData(request []byte) error {
+	var payload getDataMsg
+	if err := decodePayload(request, &payload); err != nil {
+		return err
+	}
+
+	switch payload.Type {
+	case "block":
+		block, err := s.bc.GetBlockByHash(payload.ID)
+		if err != nil {
+			return err
+		}
+		return s.sendBlock(payload.AddrFrom, block)
+	case "tx":
+		tx, ok := s.mempool.Get(payload.ID)
+		if !ok {
+			return fmt.Errorf("%w: %x is not in the mempool", ErrTxNotFound, payload.ID)
+		}
+		return s.sendTx(payload.AddrFrom, &tx)
+	}
+	return nil
+}
+
+func (s *Server) handleBlock(request []byte) error {
+	var payload blockMsg
+	if err := decodePayload(request, &payload); err != nil {
+		return err
+	}
+
+	block, err := DeserializeBlock(payload.Block)
+	if err != nil {
+		return err
+	}
+	requested := s.inTransit(block.Hash)
+	s.removeFromTransit(block.Hash)
+
+	err = s.processBlock(block, payload.AddrFrom)
+	switch {
+	case errors.Is(err, ErrOrphanBlock):
+		// 缺少父区块，先暂存起来，从发送方补齐父区块后再处理
+		s.addOrphan(block)
+		if len(s.blocksInTransit) == 0 {
+			if err := s.sendGetBlocks(payload.AddrFrom); err != nil {
+				return err
+			}
+		}
+	case err != nil:
+		// 对方的链无效，放弃从它同步剩余的区块
+		log.Printf("Rejected block %x: %v\n", block.Hash, err)
+		s.blocksInTransit = nil
+	}
+
+	// 收到请求的区块后再请求下一个
+	if requested && len(s.blocksInTransit) > 0 {
+		return s.sendGetData(payload.AddrFrom, "block", s.blocksInTransit[0])
+	}
+	return nil
+}
+
+// 处理区块，区块保存之后继续处理以它为父区块的孤块
+func (s *Server) processBlock(block *Block, addrFrom string) error {
+	change, err := s.bc.ProcessBlock(block)
+	if err != nil {
+		return err
+	}
+
+	if len(change.Connected) > 0 {
+		fmt.Printf("Added block %x\n", block.Hash)
+		s.mempool.Update(change)
+		if err := s.broadcastInv("block", block.Hash, addrFrom); err != nil {
+			log.Printf("Failed to announce block %x: %v\n", block.Hash, err)
+		}
+		if s.miner != nil {
+			s.miner.NewTip()
+		}
+	}
+
+	for _, orphan := range s.takeOrphans(block.Hash) {
+		if err := s.processBlock(orphan, addrFrom); err != nil {
+			log.Printf("Rejected block %x: %v\n", orphan.Hash, err)
+		}
+	}
+	return nil
+}
+
+// 暂存父区块未知的区块，超过上限时随机丢弃一个
+func (s *Server) addOrphan(block *Block) {
+	if len(s.orphans) >= maxOrphanBlocks {
+		for hash := range s.orphans {
+			delete(s.orphans, hash)
+			break
+		}
+	}
+	s.orphans[hex.EncodeToString(block.Hash)] = block
+}
+
+// 取出父区块为 parentHash 的孤块
+func (s *Server) takeOrphans(parentHash []byte) []*Block {
+	var children []*Block
+	for hash, orphan := range s.orphans {
+		if bytes.Equal(orphan.PreHash, parentHash) {
+			children = append(children, orphan)
+			delete(s.orphans, hash)
+		}
+	}
+	return children
+}
+
+func (s *Server) handleTx(request []byte) error {
+	var payload txMsg
+	if err := decodePayload(request, &payload); err != nil {
+		return err
+	}
+
+	tx, err := DeserializeTransaction(payload.Transaction)
+	if err != nil {
+		return err
+	}
+	err = s.mempool.Add(&tx)
+	if errors.Is(err, ErrTxInMempool) {
+		return nil
+	}
+	if err != nil {
+		log.Printf("Rejected transaction %x: %v\n", tx.ID, err)
+		return nil
+	}
+	if err := s.broadcastInv("tx", tx.ID, payload.AddrFrom); err != nil {
+		return err
+	}
+
+	// 等待一小段时间再挖矿，让这段时间内收到的交易打包进同一个区块
+	if s.miningAddress != "" && s.miner == nil && !s.miningScheduled {
+		s.miningScheduled = true
+		time.AfterFunc(miningDelay, func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			s.miningScheduled = false
+			if err := s.mineTransactions(); err != nil {
+				log.Printf("Mining failed: %v\n", err)
+			}
+		})
+	}
+	return nil
+}
+
+// 把交易池中的交易打包进新区块，并通知其他节点
+// 不能通过区块校验的交易从交易池中移除，其余的交易照常打包
+func (s *Server) mineTransactions() error {
+	txs, invalid, err := s.bc.selectValidTransactions(s.mempool.Transactions())
+	if err != nil {
+		return err
+	}
+	for _, tx := range invalid {
+		log.Printf("Evicting transaction %x from the mempool: it fails block validation\n", tx.ID)
+		s.mempool.Remove(tx.ID)
+	}
+	if len(txs) == 0 {
+		return nil
+	}
+
+	reward, err := s.bc.MinerReward(txs)
+	if err != nil {
+		return err
+	}
+	cbTx, err := NewRewardTX(s.bc.Params, s.miningAddress, "", reward)
+	if err != nil {
+		return err
+	}
+	txs = append([]*Transaction{cbTx}, txs...)
+
+	newBlock, err := s.bc.AddBlock(txs)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Mined block %x\n", newBlock.Hash)
+
+	s.mempool.Update(&ChainChange{Connected: []*Block{newBlock}})
+	return s.broadcastInv("block", newBlock.Hash, "")
+}
+
+// 处理矿工挖出的区块
+func (s *Server) submitBlock(block *Block) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	change, err := s.bc.ProcessBlock(block)
+	if err != nil {
+		log.Printf("Mined block %x rejected: %v\n", block.Hash, err)
+		return
+	}
+	if len(change.Connected) == 0 {
+		// 挖矿期间 tip 已经变化，区块成为分叉
+		return
+	}
+
+	fmt.Printf("Mined block %x at height %d with %d transactions\n", block.Hash, block.Height, len(block.Transactions))
+	s.mempool.Update(change)
+	if err := s.broadcastInv("block", block.Hash, ""); err != nil {
+		log.Printf("Failed to announce block %x: %v\n", block.Hash, err)
+	}
+}
+
+// 下面的 send 方法只在消息编码失败时返回错误，对方不可达由 sendData 处理
+func (s *Server) sendVersion(addr string) error {
+	bestHeight, err := s.bc.Height()
+	if err != nil {
+		return err
+	}
+	return s.send(addr, "version", versionMsg{nodeVersion, bestHeight, s.nodeAddress})
+}
+
+func (s *Server) sendGetBlocks(addr string) error {
+	return s.send(addr, "getblocks", getBlocksMsg{s.nodeAddress, s.bc.tip})
+}
+
+func (s *Server) sendInv(addr, kind string, items [][]byte) error {
+	return s.send(addr, "inv", invMsg{s.nodeAddress, kind, items})
+}
+
+func (s *Server) sendGetData(addr, kind string, id []byte) error {
+	return s.send(addr, "getdata", getDataMsg{s.nodeAddress, kind, id})
+}
+
+func (s *Server) sendBlock(addr string, block *Block) error {
+	data, err := blockMessage(s.nodeAddress, block)
+	if err != nil {
+		return err
+	}
+	s.sendData(addr, data)
+	return nil
+}
+
+func (s *Server) sendTx(addr string, tx *Transaction) error {
+	data, err := txMessage(s.nodeAddress, tx)
+	if err != nil {
+		return err
+	}
+	s.sendData(addr, data)
+	return nil
+}
+
+func (s *Server) send(addr, command string, payload interface{}) error {
+	data, err := newMessage(command, payload)
+	if err != nil {
+		return err
+	}
+	s.sendData(addr, data)
+	return nil
+}
+
+// 向除 except 以外的所有已知节点通告新的区块或交易
+func (s *Server) broadcastInv(kind string, id []byte, except string) error {
+	data, err := newMessage("inv", invMsg{s.nodeAddress, kind, [][]byte{id}})
+	if err != nil {
+		return err
+	}
+	for _, node := range s.knownNodes {
+		if node != except {
+			s.sendData(node, data)
+		}
+	}
+	return nil
+}
+
+// 发送消息，对方不可达时将其从已知节点中移除
+func (s *Server) sendData(addr string, data []byte) {
+	if err := sendData(addr, data); err != nil {
+		log.Printf("%s is not available\n", addr)
+
+		var updatedNodes []string
+		for _, node := range s.knownNodes {
+			if node != addr {
+				updatedNodes = append(updatedNodes, node)
+			}
+		}
+		s.knownNodes = updatedNodes
+	}
+}
+
+func (s *Server) addKnownNode(addr string) {
+	if addr == s.nodeAddress {
+		return
+	}
+	for _, node := range s.knownNodes {
+		if node == addr {
+			return
+		}
+	}
+	s.knownNodes = append(s.knownNodes, addr)
+}
+
+func (s *Server) inTransit(hash []byte) bool {
+	for _, h := range s.blocksInTransit {
+		if bytes.Equal(h, hash) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) removeFromTransit(hash []byte) {
+	var updated [][]byte
+	for _, h := range s.blocksInTransit {
+		if !bytes.Equal(h, hash) {
+			updated = append(updated, h)
+		}
+	}
+	s.blocksInTransit = updated
+}
+
+// 将新区块直接推送给节点，用于没有启动节点服务的命令行进程
+// nodeID 为本地节点的编号，作为消息的来源地址，对方不可达时只记录日志，区块已经保存在本地
+func BroadcastBlock(nodeID, addr string, block *Block) error {
+	data, err := blockMessage(fmt.Sprintf("localhost:%s", nodeID), block)
+	if err != nil {
+		return err
+	}
+	if err := sendData(addr, data); err != nil {
+		log.Printf("%s is not available\n", addr)
+	}
+	return nil
+}
+
+// 将交易发送给节点，由该节点负责打包
+func SendTransaction(nodeID, addr string, tx *Transaction) error {
+	data, err := txMessage(fmt.Sprintf("localhost:%s", nodeID), tx)
+	if err != nil {
+		return err
+	}
+	return sendData(addr, data)
+}
+
+func blockMessage(addrFrom string, block *Block) ([]byte, error) {
+	return newMessage("block", blockMsg{addrFrom, block.SerializeBlock()})
+}
+
+func txMessage(addrFrom string, tx *Transaction) ([]byte, error) {
+	return newMessage("tx", txMsg{addrFrom, tx.Serialize()})
+}
+
+// 消息由固定长度的命令名称和 gob 编码的内容组成
+func newMessage(command string, payload interface{}) ([]byte, error) {
+	data, err := gobEncode(payload)
+	if err != nil {
+		return nil, fmt.Errorf("encode %s message: %w", command, err)
+	}
+	return append(commandToBytes(command), data...), nil
+}
+
+func sendData(addr string, data []byte) error {
+	conn, err := net.Dial(protocol, addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = io.Copy(conn, bytes.NewReader(data))
+	return err
+}
+
+// 命令名称补齐到固定长度
+func commandToBytes(command string) []byte {
+	var bytes [commandLength]byte
+
+	for i, c := range []byte(command) {
+		bytes[i] = c
+	}
+
+	return bytes[:]
+}
+
+func bytesToCommand(bytes []byte) string {
+	var command []byte
+
+	for _, b := range bytes {
+		if b != 0x0 {
+			command = append(command, b)
+		}
+	}
+
+	return string(command)
+}
+
+func gobEncode(data interface{}) ([]byte, error) {
+	var buff bytes.Buffer
+
+	enc := gob.NewEncoder(&buff)
+	if err := enc.Encode(data); err != nil {
+		return nil, err
+	}
+
+	return buff.Bytes(), nil
+}
+
+func decodePayload(data []byte, payload interface{}) error {
+	dec := gob.NewDecoder(bytes.NewReader(data))
+	return dec.Decode(payload)
+}
@@ -0,0 +1,129 @@
+package core
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// 在 localhost 的空闲端口上启动节点，端口同时作为节点编号
+// 测试结束时关闭监听，等待 serve 返回后关闭数据库
+func startTestServer(t *testing.T, ln net.Listener, bc *Blockchain, seedNode string) *Server {
+	t.Helper()
+
+	s := newServer(ln.Addr().String(), "", bc)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.serve(ln, seedNode)
+	}()
+	t.Cleanup(func() {
+		ln.Close()
+		<-done
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		bc.Db.Close()
+	})
+	return s
+}
+
+func listenLocal(t *testing.T) (net.Listener, string) {
+	t.Helper()
+	ln, err := net.Listen(protocol, "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ln, strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+}
+
+func copyFile(t *testing.T, src, dst string) {
+	t.Helper()
+	data, err := os.ReadFile(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(dst, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 只有创建链时的区块的节点连接到链更长的种子节点后，同步到相同的 tip
+// 同步之前种子节点收到一条超长的消息，应该断开连接而不是读入全部数据
+func TestServerSync(t *testing.T) {
+	params := RegTestParams
+	params.DbFile = filepath.Join(t.TempDir(), params.DbFile)
+	alice := newTestWallet(t)
+	bob := newTestWallet(t)
+
+	seedLn, seedID := listenLocal(t)
+	peerLn, peerID := listenLocal(t)
+
+	// 两个节点从同一条链开始
+	seedBC, err := NewBlockchain(&params, testAddress(&params, alice), seedID, ConsensusConfig{Engine: ConsensusPoW})
+	if err != nil {
+		t.Fatal(err)
+	}
+	seedBC.Db.Close()
+	copyFile(t, params.dbFileName(seedID), params.dbFileName(peerID))
+
+	seedBC, err = GetBlockchain(&params, seedID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	utxoSet := UTXOSet{seedBC}
+	tx, err := NewTransaction(alice, testAddress(&params, bob), 4, 0, 0, &utxoSet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mineTestBlock(t, seedBC, tx)
+	mineTestBlock(t, seedBC)
+	tip := mineTestBlock(t, seedBC)
+
+	peerBC, err := GetBlockchain(&params, peerID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seed := startTestServer(t, seedLn, seedBC, "")
+
+	conn, err := net.Dial(protocol, seed.nodeAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oversized := append(commandToBytes("version"), make([]byte, 2*maxMessageSize)...)
+	if _, err := io.Copy(conn, bytes.NewReader(oversized)); err == nil {
+		t.Fatal("seed node read an oversized message to the end")
+	}
+	conn.Close()
+
+	peer := startTestServer(t, peerLn, peerBC, seed.nodeAddress)
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		peer.mu.Lock()
+		last := peer.bc.getLastHash()
+		peer.mu.Unlock()
+		if bytes.Equal(last, tip.Hash) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("peer tip is %x, want %x", last, tip.Hash)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	peer.mu.Lock()
+	defer peer.mu.Unlock()
+	outputs, err := (UTXOSet{peer.bc}).FindUTXO(NewP2PKHScript(HashPubKey(bob.PublicKey)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(outputs) != 1 || outputs[0].Value != 4 {
+		t.Fatalf("bob's outputs on the peer = %+v, want one output of 4", outputs)
+	}
+}
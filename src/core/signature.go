@@ -0,0 +1,103 @@
+package core
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"math/big"
+)
+
+// 交易签名为固定 64 字节的 r||s，r 和 s 各占 32 字节，不足时在前面补0
+// 同一个签名 (r, s) 和 (r, N-s) 都能通过 ECDSA 验证，只接受 s 不大于 N/2 的低 S 形式，
+// 这样第三方无法在不使签名失效的情况下改变签名的字节
+const signatureLength = 64
+
+// 公钥为固定 64 字节的 X||Y
+const publicKeyLength = 64
+
+// 早期版本的钱包用 append(X.Bytes(), Y.Bytes()...) 保存公钥，X 或 Y 有前导0字节时不足64字节
+// 这些钱包的地址是对短公钥计算的，补齐会改变地址，为了让锁定到这些地址的输出仍然可以花费，验证签名时也接受短公钥
+// X 和 Y 同时有两个以上前导0字节的概率可以忽略，更短的公钥不接受
+const minPublicKeyLength = publicKeyLength - 2
+
+var halfOrder = new(big.Int).Rsh(elliptic.P256().Params().N, 1)
+
+// 公钥的固定长度编码，X 和 Y 各占 32 字节
+func marshalPubKey(pub *ecdsa.PublicKey) []byte {
+	pubKey := make([]byte, publicKeyLength)
+	pub.X.FillBytes(pubKey[:32])
+	pub.Y.FillBytes(pubKey[32:])
+	return pubKey
+}
+
+// 早期版本的钱包保存的公钥，X 或 Y 有前导0字节时比 marshalPubKey 的结果短
+func legacyPubKey(pub *ecdsa.PublicKey) []byte {
+	return append(pub.X.Bytes(), pub.Y.Bytes()...)
+}
+
+// 对 hash 签名，返回低 S 形式的固定长度签名
+func signHash(privKey *ecdsa.PrivateKey, hash []byte) ([]byte, error) {
+	r, s, err := ecdsa.Sign(rand.Reader, privKey, hash)
+	if err != nil {
+		return nil, err
+	}
+	if s.Cmp(halfOrder) > 0 {
+		s.Sub(privKey.Curve.Params().N, s)
+	}
+
+	signature := make([]byte, signatureLength)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+	return signature, nil
+}
+
+// 解析公钥，公钥必须是曲线上的点
+// 短公钥必须正好是 append(X.Bytes(), Y.Bytes()...)，按 X 每一种可能的长度拆分，只接受唯一落在曲线上的拆分方式
+func parsePubKey(pubKey []byte) (*ecdsa.PublicKey, bool) {
+	curve := elliptic.P256()
+	if len(pubKey) == publicKeyLength {
+		x := new(big.Int).SetBytes(pubKey[:32])
+		y := new(big.Int).SetBytes(pubKey[32:])
+		if !curve.IsOnCurve(x, y) {
+			return nil, false
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, true
+	}
+	if len(pubKey) < minPublicKeyLength || len(pubKey) > publicKeyLength {
+		return nil, false
+	}
+
+	var found *ecdsa.PublicKey
+	for xLen := len(pubKey) - 32; xLen <= 32; xLen++ {
+		x := new(big.Int).SetBytes(pubKey[:xLen])
+		y := new(big.Int).SetBytes(pubKey[xLen:])
+		if !bytes.Equal(append(x.Bytes(), y.Bytes()...), pubKey) || !curve.IsOnCurve(x, y) {
+			continue
+		}
+		if found != nil {
+			return nil, false
+		}
+		found = &ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+	}
+	return found, found != nil
+}
+
+// 验证签名，签名的长度必须固定，s 必须是低 S 形式，公钥的格式见 parsePubKey
+func verifySignature(pubKey, hash, signature []byte) bool {
+	if len(signature) != signatureLength {
+		return false
+	}
+	rawPubKey, ok := parsePubKey(pubKey)
+	if !ok {
+		return false
+	}
+
+	r := new(big.Int).SetBytes(signature[:32])
+	s := new(big.Int).SetBytes(signature[32:])
+	if r.Sign() == 0 || s.Sign() == 0 || s.Cmp(halfOrder) > 0 {
+		return false
+	}
+
+	return ecdsa.Verify(rawPubKey, hash, r, s)
+}
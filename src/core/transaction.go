@@ -1,39 +1,52 @@
 package core
 
 import (
-	"bytes"
 	"crypto/ecdsa"
-	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha256"
-	"encoding/gob"
 	"encoding/hex"
+	"errors"
 	"fmt"
-	"log"
-	"math/big"
+	"io/ioutil"
+	"strings"
 )
 
+// 可花费的余额不足以支付转账金额
+var ErrInsufficientFunds = errors.New("insufficient funds")
+
 // 交易信息
 type Transaction struct {
-	ID   []byte     // 交易ID
-	Vin  []TXInput  // 交易输入
-	Vout []TXOutput // 交易输出
+	ID       []byte     // 交易ID
+	Vin      []TXInput  // 交易输入
+	Vout     []TXOutput // 交易输出
+	LockTime int64      // 交易最早可以打包的区块高度或时间，0 表示不锁定，见 locktime.go
 }
 
 // 发送货币，将这个操作创建成一个交易，放到一个块里
 // 然后有人挖出这个块，放到链上，这个人会活动这个交易对应的奖励
 // from to可看做转账钱包地址
-func NewTransaction(wallet *Wallet, to string, amount int, UTXOSet *UTXOSet) *Transaction {
+// to 必须是当前网络的地址
+// lockTime 为交易的锁定时间，sequence 为每个输入的相对锁定区块数，都为0时不锁定
+func NewTransaction(wallet *Wallet, to string, amount int, lockTime int64, sequence uint32, UTXOSet *UTXOSet) (*Transaction, error) {
 
 	var inputs []TXInput
 	var outputs []TXOutput
 
+	// to 可以是公钥hash地址，也可以是多签等脚本hash地址
+	toScript, err := UTXOSet.Blockchain.Params.AddressScript(to)
+	if err != nil {
+		return nil, err
+	}
+
 	// acc：此次消费可以用来花费的数量  validOutputs：此次消费可以用来花费的输出
-	pubKeyHash := HashPubKey(wallet.PublicKey)
-	acc, validOutputs := UTXOSet.FindSpendableOutputs(pubKeyHash, amount)
+	lockScript := NewP2PKHScript(HashPubKey(wallet.PublicKey))
+	acc, validOutputs, err := UTXOSet.FindSpendableOutputs(lockScript, amount)
+	if err != nil {
+		return nil, err
+	}
 
 	if acc < amount {
-		log.Panic("ERROR:not enough amount")
+		return nil, fmt.Errorf("%w: need %d, have %d", ErrInsufficientFunds, amount, acc)
 	}
 
 	// 迭代可花费的输出集合，将所之前剩余的输出都花费掉，多余的通过找零的方式处理  key:交易ID  value:输出集合
@@ -42,75 +55,147 @@ func NewTransaction(wallet *Wallet, to string, amount int, UTXOSet *UTXOSet) *Tr
 
 		// 之前交易的输出（即剩下的余额），可作为这次交易的输入
 		for _, out := range outs {
-			input := NewTxin(txID, out, wallet.PublicKey)
+			input := NewTxin(txID, out)
+			input.Sequence = sequence
 			inputs = append(inputs, input)
 		}
 	}
 
 	// 输出1：这是实际转移给接受者地址的输出
-	from := fmt.Sprintf("%s", wallet.GetAddress())
-	outputs = append(outputs, *NewTXOutput(amount, to))
+	outputs = append(outputs, TXOutput{amount, toScript})
 	if acc > amount {
-		// 输出2：找零，只有当未花费输出超过新交易所需时产生
-		outputs = append(outputs, *NewTXOutput(acc-amount, from)) // a change
+		// 输出2：找零，只有当未花费输出超过新交易所需时产生，直接锁定到发送方的公钥hash
+		outputs = append(outputs, TXOutput{acc - amount, lockScript}) // a change
 	}
 
 	// 创建交易
-	tx := Transaction{nil, inputs, outputs}
+	tx := Transaction{nil, inputs, outputs, lockTime}
 	// 填充交易ID
 	tx.SetID()
 
-	UTXOSet.Blockchain.SignTransaction(&tx, wallet.PrivateKey)
-	return &tx
+	if err := UTXOSet.Blockchain.SignTransaction(&tx, wallet.PrivateKey); err != nil {
+		return nil, err
+	}
+	return &tx, nil
 }
 
 // 创建奖励交易
 // 奖励交易只有一个输出，输入的Txid 为空数组，Vout 等于 -1
-func NewRewardTX(to, data string) *Transaction {
+// value 为区块奖励加上区块中交易的手续费
+func NewRewardTX(params *ChainParams, to, data string, value int) (*Transaction, error) {
 	if data == "" {
 		randData := make([]byte, 20)
 		_, err := rand.Read(randData)
 		if err != nil {
-			log.Panic(err)
+			return nil, err
 		}
 
 		data = fmt.Sprintf("%x", randData)
 	}
 
 	txin := NewRewardTxin(data)
-	txout := *NewTXOutput(subsidy, to)
-	tx := Transaction{nil, []TXInput{txin}, []TXOutput{txout}}
+	txout, err := NewTXOutput(params, value, to)
+	if err != nil {
+		return nil, err
+	}
+	tx := Transaction{nil, []TXInput{txin}, []TXOutput{*txout}, 0}
 	tx.SetID()
 
-	return &tx
+	return &tx, nil
+}
+
+// 计算交易的手续费，prevTXs 中需要包含所有输入引用的交易
+// 输出总额超过输入总额的交易会凭空产生货币，返回错误
+func (tx *Transaction) Fee(prevTXs map[string]Transaction) (int, error) {
+	in := 0
+	for _, vin := range tx.Vin {
+		prevTx, ok := prevTXs[hex.EncodeToString(vin.Txid)]
+		if !ok || vin.Vout < 0 || vin.Vout >= len(prevTx.Vout) {
+			return 0, fmt.Errorf("input %x:%d is not found", vin.Txid, vin.Vout)
+		}
+		in += prevTx.Vout[vin.Vout].Value
+	}
+
+	out := 0
+	for _, vout := range tx.Vout {
+		if vout.Value < 0 {
+			return 0, fmt.Errorf("transaction %x has negative output", tx.ID)
+		}
+		out += vout.Value
+	}
+
+	if out > in {
+		return 0, fmt.Errorf("transaction %x spends %d but only has %d", tx.ID, out, in)
+	}
+	return in - out, nil
 }
 
 func (tx *Transaction) SetID() {
 	tx.ID = tx.Hash()
 }
 
-// 将序列化结果做hash处理
+// 交易ID：去掉解锁脚本之后的序列化结果的hash
+// 解锁脚本中的签名只用来解锁输入，不参与交易ID的计算，交易签名之后ID不会再变化，改变签名的字节也不会改变交易ID
+// 奖励交易的输入没有签名，ScriptSig 中保存的是附加数据，需要参与计算以区分不同的奖励交易
 func (tx *Transaction) Hash() []byte {
-	var hash [32]byte
-
 	txCopy := *tx
-	txCopy.ID = []byte{}
+	if !tx.IsRewardTx() {
+		txCopy = tx.TrimmedCopy()
+	}
+	txCopy.ID = nil
 
-	hash = sha256.Sum256(txCopy.Serialize())
+	hash := sha256.Sum256(txCopy.Serialize())
 	return hash[:]
 }
 
-// 序列化
+// 交易完整序列化的hash，和交易ID不同，包含 ScriptSig，区块头的 WitnessHash 由它构成
+func (tx *Transaction) WitnessHash() []byte {
+	hash := sha256.Sum256(tx.Serialize())
+	return hash[:]
+}
+
+// 序列化，使用规范的二进制编码，格式见 encoding.go
 func (tx Transaction) Serialize() []byte {
-	var encoded bytes.Buffer
+	var e encoder
+	e.version()
+	tx.encode(&e)
+	return e.buf.Bytes()
+}
 
-	enc := gob.NewEncoder(&encoded)
-	err := enc.Encode(tx)
-	if err != nil {
-		log.Panic(err)
+// 反序列化交易
+func DeserializeTransaction(data []byte) (Transaction, error) {
+	var transaction Transaction
+
+	d := decoder{data: data}
+	d.version()
+	transaction.decode(&d)
+	if err := d.finish(); err != nil {
+		return transaction, fmt.Errorf("decode transaction: %w", err)
 	}
 
-	return encoded.Bytes()
+	return transaction, nil
+}
+
+// 把签名后的交易以十六进制写入文件，用于保存还不能打包的交易，等到可以打包时再用 sendrawtx 提交
+func (tx *Transaction) SaveToFile(file string) error {
+	return ioutil.WriteFile(file, []byte(hex.EncodeToString(tx.Serialize())+"\n"), 0644)
+}
+
+// 从文件读取 SaveToFile 写入的交易
+func LoadTransaction(file string) (*Transaction, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("decode transaction %s: %v", file, err)
+	}
+	tx, err := DeserializeTransaction(raw)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	return &tx, nil
 }
 
 // 是否是奖励交易
@@ -118,28 +203,62 @@ func (tx *Transaction) IsRewardTx() bool {
 	return len(tx.Vin) == 1 && len(tx.Vin[0].Txid) == 0 && tx.Vin[0].Vout == -1
 }
 
-// 签名
-func (tx *Transaction) Sign(privKey ecdsa.PrivateKey, prevTXs map[string]Transaction) {
+// 签名，prevTXs 中需要包含所有输入引用的交易
+// 输入花费的输出都必须锁定到 privKey 对应的公钥hash，每个输入的解锁脚本为 <签名> <公钥>
+// 锁定到早期版本钱包短公钥hash的输出，解锁脚本中使用同样的短公钥
+func (tx *Transaction) Sign(privKey ecdsa.PrivateKey, prevTXs map[string]Transaction) error {
 	if tx.IsRewardTx() {
 		// 没有实际的输入，所以不需要签名
-		return
+		return nil
 	}
 
-	txCopy := tx.TrimmedCopy()
+	pubKeys := [][]byte{marshalPubKey(&privKey.PublicKey), legacyPubKey(&privKey.PublicKey)}
+	for inID := range tx.Vin {
+		prevOut, err := tx.prevOutput(inID, prevTXs)
+		if err != nil {
+			return err
+		}
+		var pubKey []byte
+		for _, key := range pubKeys {
+			if prevOut.IsLockedWithKey(HashPubKey(key)) {
+				pubKey = key
+				break
+			}
+		}
+		if pubKey == nil {
+			return fmt.Errorf("input %d of %x is not locked to the signing key", inID, tx.ID)
+		}
 
-	// 这个副本包含了所有的输入和输出，但是 TXInput.Signature 和 TXIput.PubKey 被设置为 nil
-	for inID, vin := range txCopy.Vin {
-		prevTx := prevTXs[hex.EncodeToString(vin.Txid)]
-		txCopy.Vin[inID].Signature = nil
-		txCopy.Vin[inID].PubKey = prevTx.Vout[vin.Vout].PubKeyHash
-		txCopy.ID = txCopy.Hash()
-		txCopy.Vin[inID].PubKey = nil
+		signature, err := signHash(&privKey, tx.signatureHash(inID, prevOut.ScriptPubKey))
+		if err != nil {
+			return err
+		}
+		tx.Vin[inID].ScriptSig = p2pkhScriptSig(signature, pubKey)
+	}
 
-		r, s, _ := ecdsa.Sign(rand.Reader, &privKey, txCopy.ID)
-		signature := append(r.Bytes(), s.Bytes()...)
+	return nil
+}
 
-		tx.Vin[inID].Signature = signature
+// 第 inID 个输入花费的输出
+func (tx *Transaction) prevOutput(inID int, prevTXs map[string]Transaction) (TXOutput, error) {
+	vin := tx.Vin[inID]
+	prevTx, ok := prevTXs[hex.EncodeToString(vin.Txid)]
+	if !ok || vin.Vout < 0 || vin.Vout >= len(prevTx.Vout) {
+		return TXOutput{}, fmt.Errorf("%w: input %x:%d", ErrTxNotFound, vin.Txid, vin.Vout)
 	}
+	return prevTx.Vout[vin.Vout], nil
+}
+
+// 第 inID 个输入签名的数据
+// 使用交易的副本，所有输入的 ScriptSig 都被设置为 nil，只有被签名的输入的 ScriptSig 设置为 scriptCode，
+// 即执行 OP_CHECKSIG 的锁定脚本
+func (tx *Transaction) signatureHash(inID int, scriptCode []byte) []byte {
+	txCopy := tx.TrimmedCopy()
+	txCopy.ID = nil
+	txCopy.Vin[inID].ScriptSig = scriptCode
+
+	hash := sha256.Sum256(txCopy.Serialize())
+	return hash[:]
 }
 
 //创建一个副本
@@ -148,46 +267,52 @@ func (tx *Transaction) TrimmedCopy() Transaction {
 	var outputs []TXOutput
 
 	for _, vin := range tx.Vin {
-		inputs = append(inputs, NewTxin(vin.Txid, vin.Vout, nil))
+		input := NewTxin(vin.Txid, vin.Vout)
+		input.Sequence = vin.Sequence
+		inputs = append(inputs, input)
 	}
 
 	for _, vout := range tx.Vout {
-		outputs = append(outputs, TXOutput{vout.Value, vout.PubKeyHash})
+		outputs = append(outputs, TXOutput{vout.Value, vout.ScriptPubKey})
 	}
 
-	txCopy := Transaction{tx.ID, inputs, outputs}
+	txCopy := Transaction{tx.ID, inputs, outputs, tx.LockTime}
 
 	return txCopy
 }
 
-func (tx *Transaction) Verify(prevTXs map[string]Transaction) bool {
-	txCopy := tx.TrimmedCopy()
-	curve := elliptic.P256()
+// 执行脚本时检查交易第 inID 个输入的签名
+type txSigChecker struct {
+	tx   *Transaction
+	inID int
+}
+
+// 签名必须是低 S 形式的固定长度签名
+func (c txSigChecker) checkSig(signature, pubKey, scriptCode []byte) bool {
+	return verifySignature(pubKey, c.tx.signatureHash(c.inID, scriptCode), signature)
+}
+
+// 验证所有输入：依次执行解锁脚本和它花费的输出的锁定脚本，脚本失败时返回包装了 ErrScriptFailed 的错误
+func (tx *Transaction) Verify(prevTXs map[string]Transaction) error {
+	prevOuts := make([]TXOutput, len(tx.Vin))
+	for inID := range tx.Vin {
+		prevOut, err := tx.prevOutput(inID, prevTXs)
+		if err != nil {
+			return err
+		}
+		prevOuts[inID] = prevOut
+	}
+
+	return tx.verifyInputs(prevOuts)
+}
 
+// 和 Verify 相同，prevOuts 按顺序为每个输入花费的输出，调用者已经从 UTXO 集中读出时不需要再查找完整的交易
+func (tx *Transaction) verifyInputs(prevOuts []TXOutput) error {
 	for inID, vin := range tx.Vin {
-		prevTx := prevTXs[hex.EncodeToString(vin.Txid)]
-		txCopy.Vin[inID].Signature = nil
-		txCopy.Vin[inID].PubKey = prevTx.Vout[vin.Vout].PubKeyHash
-		txCopy.ID = txCopy.Hash()
-		txCopy.Vin[inID].PubKey = nil
-
-		r := big.Int{}
-		s := big.Int{}
-		sigLen := len(vin.Signature)
-		r.SetBytes(vin.Signature[:(sigLen / 2)])
-		s.SetBytes(vin.Signature[(sigLen / 2):])
-
-		x := big.Int{}
-		y := big.Int{}
-		keyLen := len(vin.PubKey)
-		x.SetBytes(vin.PubKey[:(keyLen / 2)])
-		y.SetBytes(vin.PubKey[(keyLen / 2):])
-
-		rawPubKey := ecdsa.PublicKey{curve, &x, &y}
-		if ecdsa.Verify(&rawPubKey, txCopy.ID, &r, &s) == false {
-			return false
+		if err := verifyScript(vin.ScriptSig, prevOuts[inID].ScriptPubKey, txSigChecker{tx, inID}); err != nil {
+			return fmt.Errorf("input %d: %w", inID, err)
 		}
 	}
 
-	return true
+	return nil
 }
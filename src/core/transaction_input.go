@@ -1,25 +1,16 @@
 package core
 
-import "bytes"
-
 // 交易输入
 type TXInput struct {
 	Txid      []byte // 交易ID
 	Vout      int    // 存储的是该输出在那笔交易中所有输出的索引
-	Signature []byte // 签名
-	PubKey    []byte // 公钥
+	ScriptSig []byte // 解锁脚本，提供满足被花费输出锁定脚本的数据，奖励交易中为任意的附加数据
+	Sequence  uint32 // 相对锁定：被花费的输出确认之后至少再经过多少个区块才能花费，0 表示不锁定
 }
 
-func NewTxin(Txid []byte, Vout int, PubKey []byte) TXInput {
-	return TXInput{Txid, Vout, nil, PubKey}
+func NewTxin(Txid []byte, Vout int) TXInput {
+	return TXInput{Txid, Vout, nil, 0}
 }
 func NewRewardTxin(data string) TXInput {
-	return TXInput{[]byte{}, -1, nil, []byte(data)}
-}
-
-// 检查该地址是否发起了事务
-func (in *TXInput) UsesKey(pubKeyHash []byte) bool {
-	lockingHash := HashPubKey(in.PubKey)
-
-	return bytes.Compare(lockingHash, pubKeyHash) == 0
+	return TXInput{[]byte{}, -1, []byte(data), 0}
 }
@@ -2,62 +2,73 @@ package core
 
 import (
 	"bytes"
-	"encoding/gob"
-	"log"
+	"fmt"
 )
 
+// 货币总量的上限，任何输出的金额以及交易输入、输出、区块奖励的总额都不能超过它
+// 同时保证累加金额时不会溢出
+const MaxMoney = 21000000
+
+// 金额是否在 [0, MaxMoney] 范围内
+func MoneyRange(value int) bool {
+	return value >= 0 && value <= MaxMoney
+}
+
 // 交易输出，本次交易的输出可以看做是余额
 type TXOutput struct {
-	Value      int    // 交易数量
-	PubKeyHash []byte // 公钥hash
+	Value        int    // 交易数量
+	ScriptPubKey []byte // 锁定脚本，规定花费这个输出需要满足的条件
 }
 
-func (out *TXOutput) Lock(address []byte) {
-	pubKeyHash := Base58Decode(address)
-	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-4]
-	out.PubKeyHash = pubKeyHash
+// 把输出锁定到 address，按地址的版本前缀使用公钥hash脚本或脚本hash脚本，地址不属于 params 对应的网络时返回错误
+func (out *TXOutput) Lock(params *ChainParams, address string) error {
+	script, err := params.AddressScript(address)
+	if err != nil {
+		return err
+	}
+	out.ScriptPubKey = script
+	return nil
 }
 
-// 判断这笔交易是否属于我的
+// 判断这笔交易是否属于我的：锁定脚本是锁定到 pubKeyHash 的标准脚本
 func (out *TXOutput) IsLockedWithKey(pubKeyHash []byte) bool {
-	return bytes.Compare(out.PubKeyHash, pubKeyHash) == 0
+	return bytes.Equal(extractPubKeyHash(out.ScriptPubKey), pubKeyHash)
 }
 
 // NewTXOutput create a new TXOutput
-func NewTXOutput(value int, address string) *TXOutput {
+func NewTXOutput(params *ChainParams, value int, address string) (*TXOutput, error) {
 	txo := &TXOutput{value, nil}
-	txo.Lock([]byte(address))
+	if err := txo.Lock(params, address); err != nil {
+		return nil, err
+	}
 
-	return txo
+	return txo, nil
 }
 
-// TXOutputs collects TXOutput
+// TXOutputs collects TXOutput，key 为输出在交易中的索引
 type TXOutputs struct {
-	Outputs []TXOutput
+	Outputs map[int]TXOutput
+	Height  int // 交易所在区块的高度
 }
 
-// SerializeOutputs serializes TXOutputs
-func (outs TXOutputs) SerializeOutputs() []byte {
-	var buff bytes.Buffer
-
-	enc := gob.NewEncoder(&buff)
-	err := enc.Encode(outs)
-	if err != nil {
-		log.Panic(err)
-	}
-
-	return buff.Bytes()
+// 序列化单个输出
+func (out TXOutput) Serialize() []byte {
+	var e encoder
+	e.version()
+	out.encode(&e)
+	return e.buf.Bytes()
 }
 
-// DeserializeOutputs deserializes TXOutputs
-func DeserializeOutputs(data []byte) TXOutputs {
-	var outputs TXOutputs
+// 反序列化单个输出
+func DeserializeOutput(data []byte) (TXOutput, error) {
+	var output TXOutput
 
-	dec := gob.NewDecoder(bytes.NewReader(data))
-	err := dec.Decode(&outputs)
-	if err != nil {
-		log.Panic(err)
+	d := decoder{data: data}
+	d.version()
+	output.decode(&d)
+	if err := d.finish(); err != nil {
+		return output, fmt.Errorf("decode output: %w", err)
 	}
 
-	return outputs
+	return output, nil
 }
@@ -0,0 +1,37 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// 奖励交易按地址的版本前缀选择锁定脚本，其他网络的地址返回 ErrInvalidAddress
+func TestRewardTXAddress(t *testing.T) {
+	wallet := newTestWallet(t)
+	redeemScript, err := NewMultisigScript(1, [][]byte{wallet.PublicKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	params := &RegTestParams
+
+	for _, test := range []struct {
+		address string
+		script  []byte
+	}{
+		{testAddress(params, wallet), NewP2PKHScript(HashPubKey(wallet.PublicKey))},
+		{params.ScriptAddress(redeemScript), NewP2SHScript(HashPubKey(redeemScript))},
+	} {
+		tx, err := NewRewardTX(params, test.address, "", params.Subsidy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(tx.Vout[0].ScriptPubKey, test.script) {
+			t.Fatalf("reward to %s is locked with %x, want %x", test.address, tx.Vout[0].ScriptPubKey, test.script)
+		}
+	}
+
+	if _, err := NewRewardTX(params, testAddress(&MainNetParams, wallet), "", params.Subsidy); !errors.Is(err, ErrInvalidAddress) {
+		t.Fatalf("reward to a mainnet address: err = %v, want ErrInvalidAddress", err)
+	}
+}
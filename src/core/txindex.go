@@ -0,0 +1,124 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/boltdb/bolt"
+)
+
+// 交易索引，key 为交易ID，value 为 所在区块的hash + 4字节大端序的交易在区块中的位置
+// 只索引主链上的交易：区块接入主链时写入，从主链断开时删除
+// 索引是可选的，数据库中没有这个 bucket 时不维护索引，FindTransaction 退回到遍历整条链
+// 已有的数据库通过 reindex-tx 命令建立索引
+const txIndexBucket = "txindex"
+
+// 交易在索引中的位置
+func txIndexValue(blockHash []byte, position int) []byte {
+	value := make([]byte, len(blockHash)+4)
+	copy(value, blockHash)
+	binary.BigEndian.PutUint32(value[len(blockHash):], uint32(position))
+	return value
+}
+
+// 从索引的 value 中解析出区块hash和交易位置
+func parseTxIndexValue(value []byte) ([]byte, int) {
+	hashLen := len(value) - 4
+	return value[:hashLen], int(binary.BigEndian.Uint32(value[hashLen:]))
+}
+
+// 把区块中的交易写入索引，没有启用索引时什么也不做
+func indexBlockTransactions(tx *bolt.Tx, block *Block) error {
+	b := tx.Bucket([]byte(txIndexBucket))
+	if b == nil {
+		return nil
+	}
+
+	for i, transaction := range block.Transactions {
+		if err := b.Put(transaction.ID, txIndexValue(block.Hash, i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 区块从主链断开时删除它的交易的索引
+// 只删除指向这个区块的记录，避免误删同一交易在其他区块中的记录
+func unindexBlockTransactions(tx *bolt.Tx, block *Block) error {
+	b := tx.Bucket([]byte(txIndexBucket))
+	if b == nil {
+		return nil
+	}
+
+	for _, transaction := range block.Transactions {
+		value := b.Get(transaction.ID)
+		if value == nil {
+			continue
+		}
+		if hash, _ := parseTxIndexValue(value); !bytes.Equal(hash, block.Hash) {
+			continue
+		}
+		if err := b.Delete(transaction.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 通过索引查找交易，indexed 为 false 表示没有启用索引，调用方需要自己遍历链
+func lookupTransaction(tx *bolt.Tx, ID []byte) (transaction Transaction, indexed bool, err error) {
+	b := tx.Bucket([]byte(txIndexBucket))
+	if b == nil {
+		return Transaction{}, false, nil
+	}
+
+	value := b.Get(ID)
+	if value == nil {
+		return Transaction{}, true, fmt.Errorf("%w: %x", ErrTxNotFound, ID)
+	}
+	hash, position := parseTxIndexValue(value)
+	block, err := getBlock(tx, hash)
+	if err != nil {
+		return Transaction{}, true, err
+	}
+	if position >= len(block.Transactions) {
+		return Transaction{}, true, fmt.Errorf("txindex of %x points to position %d of block %x with %d transactions", ID, position, hash, len(block.Transactions))
+	}
+	return *block.Transactions[position], true, nil
+}
+
+// 删除已有的交易索引，从 tip 开始遍历主链重新建立，之后索引随区块的连接和断开自动更新
+// 返回索引的交易数量
+func (bc *Blockchain) ReindexTransactions() (int, error) {
+	count := 0
+
+	err := bc.Db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(txIndexBucket)) != nil {
+			if err := tx.DeleteBucket([]byte(txIndexBucket)); err != nil {
+				return err
+			}
+		}
+		if _, err := tx.CreateBucket([]byte(txIndexBucket)); err != nil {
+			return err
+		}
+
+		for hash := tx.Bucket([]byte(blocksBucket)).Get([]byte("last")); len(hash) > 0; {
+			block, err := getBlock(tx, hash)
+			if err != nil {
+				return err
+			}
+			if err := indexBlockTransactions(tx, block); err != nil {
+				return err
+			}
+			count += len(block.Transactions)
+			hash = block.PreHash
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
@@ -1,22 +1,80 @@
 package core
 
 import (
+	"bytes"
+	"encoding/binary"
 	"encoding/hex"
+	"fmt"
 	"log"
 
 	"github.com/boltdb/bolt"
 )
 
+// chainstate 中每个未花费输出单独保存，key 为 交易ID + 4字节大端序的输出索引，value 为序列化的 UTXOEntry
+// 这样输出花费后其他输出的索引不会变化
 const utxoBucket = "chainstate"
 
+// 记录 chainstate 的格式版本，旧版本按交易ID保存输出列表，花费后列表中的位置和 TXInput.Vout 对不上
+// 版本2在每个输出中记录所在区块的高度
+const metaBucket = "meta"
+const chainstateVersionKey = "chainstate_version"
+const chainstateVersion = 2
+
+// chainstate 当前对应的区块hash，位于 meta bucket，和 chainstate 在同一个事务中更新
+// 正常情况下等于 blocks bucket 中的 last
+const chainstateBestKey = "chainstate_best"
+
 // UTXOSet represents UTXO set
 type UTXOSet struct {
 	Blockchain *Blockchain
 }
 
+// chainstate 中的一个未花费输出
+type UTXOEntry struct {
+	Height int      // 输出所在区块的高度，检查输入的相对锁定时使用
+	Out    TXOutput // 输出
+}
+
+// 序列化，格式见 encoding.go
+func (entry UTXOEntry) Serialize() []byte {
+	var e encoder
+	e.version()
+	entry.encode(&e)
+	return e.buf.Bytes()
+}
+
+// 反序列化 chainstate 中的输出
+func DeserializeUTXOEntry(data []byte) (UTXOEntry, error) {
+	var entry UTXOEntry
+
+	d := decoder{data: data}
+	d.version()
+	entry.decode(&d)
+	if err := d.finish(); err != nil {
+		return entry, fmt.Errorf("decode utxo entry: %w", err)
+	}
+
+	return entry, nil
+}
+
+// 输出在 chainstate 中的 key
+func outpointKey(txid []byte, vout int) []byte {
+	key := make([]byte, len(txid)+4)
+	copy(key, txid)
+	binary.BigEndian.PutUint32(key[len(txid):], uint32(vout))
+	return key
+}
+
+// 从 chainstate 的 key 中解析出交易ID和输出索引
+func parseOutpointKey(key []byte) ([]byte, int) {
+	txidLen := len(key) - 4
+	return key[:txidLen], int(binary.BigEndian.Uint32(key[txidLen:]))
+}
+
 // 这个方法对所有的未花费交易进行迭代，并对它的值进行累加。
 //当累加值大于或等于我们想要传送的值时，它就会停止并返回累加值，同时返回的还有通过交易 ID 进行分组的输出索引。
-func (u UTXOSet) FindSpendableOutputs(pubkeyHash []byte, amount int) (int, map[string][]int) {
+// 只使用锁定脚本为 script 的输出
+func (u UTXOSet) FindSpendableOutputs(script []byte, amount int) (int, map[string][]int, error) {
 	unspentOutputs := make(map[string][]int)
 	accumulated := 0
 	db := u.Blockchain.Db
@@ -25,30 +83,32 @@ func (u UTXOSet) FindSpendableOutputs(pubkeyHash []byte, amount int) (int, map[s
 		b := tx.Bucket([]byte(utxoBucket))
 		c := b.Cursor()
 
-		for k, v := c.First(); k != nil; k, v = c.Next() {
-			txID := hex.EncodeToString(k)
-			outs := DeserializeOutputs(v)
+		for k, v := c.First(); k != nil && accumulated < amount; k, v = c.Next() {
+			txid, outIdx := parseOutpointKey(k)
+			entry, err := DeserializeUTXOEntry(v)
+			if err != nil {
+				return err
+			}
 
-			for outIdx, out := range outs.Outputs {
-				// 判断这笔交易是否属于我的&累加值未达到需要花费的值
-				if out.IsLockedWithKey(pubkeyHash) && accumulated < amount {
-					accumulated += out.Value
-					unspentOutputs[txID] = append(unspentOutputs[txID], outIdx)
-				}
+			// 判断这笔输出是否属于我的
+			if bytes.Equal(entry.Out.ScriptPubKey, script) {
+				txID := hex.EncodeToString(txid)
+				accumulated += entry.Out.Value
+				unspentOutputs[txID] = append(unspentOutputs[txID], outIdx)
 			}
 		}
 
 		return nil
 	})
 	if err != nil {
-		log.Panic(err)
+		return 0, nil, err
 	}
 
-	return accumulated, unspentOutputs
+	return accumulated, unspentOutputs, nil
 }
 
-// FindUTXO finds UTXO for a public key hash
-func (u UTXOSet) FindUTXO(pubKeyHash []byte) []TXOutput {
+// FindUTXO finds UTXO locked with the script
+func (u UTXOSet) FindUTXO(script []byte) ([]TXOutput, error) {
 	var UTXOs []TXOutput
 	db := u.Blockchain.Db
 
@@ -56,118 +116,195 @@ func (u UTXOSet) FindUTXO(pubKeyHash []byte) []TXOutput {
 		b := tx.Bucket([]byte(utxoBucket))
 		c := b.Cursor()
 
-		for k, v := c.First(); k != nil; k, v = c.Next() {
-			outs := DeserializeOutputs(v)
+		for _, v := c.First(); v != nil; _, v = c.Next() {
+			entry, err := DeserializeUTXOEntry(v)
+			if err != nil {
+				return err
+			}
 
-			for _, out := range outs.Outputs {
-				if out.IsLockedWithKey(pubKeyHash) {
-					UTXOs = append(UTXOs, out)
-				}
+			if bytes.Equal(entry.Out.ScriptPubKey, script) {
+				UTXOs = append(UTXOs, entry.Out)
 			}
 		}
 
 		return nil
 	})
 	if err != nil {
-		log.Panic(err)
+		return nil, err
 	}
 
-	return UTXOs
+	return UTXOs, nil
+}
+
+// 查找未花费的输出，输出不存在或已被花费时 found 为 false
+func (u UTXOSet) FindOutput(txid []byte, vout int) (entry UTXOEntry, found bool, err error) {
+	err = u.Blockchain.Db.View(func(tx *bolt.Tx) error {
+		outBytes := tx.Bucket([]byte(utxoBucket)).Get(outpointKey(txid, vout))
+		if outBytes == nil {
+			return nil
+		}
+		found = true
+		entry, err = DeserializeUTXOEntry(outBytes)
+		return err
+	})
+
+	return entry, found, err
 }
 
 // Reindex rebuilds the UTXO set
-func (u UTXOSet) Reindex() {
+func (u UTXOSet) Reindex() error {
 	db := u.Blockchain.Db
 	bucketName := []byte(utxoBucket)
 
-	err := db.Update(func(tx *bolt.Tx) error {
+	UTXO, err := u.Blockchain.FindUTXO()
+	if err != nil {
+		return err
+	}
+
+	// 删除旧的 chainstate 和写入新的在同一个事务中完成，失败时保留原来的数据
+	return db.Update(func(tx *bolt.Tx) error {
 		err := tx.DeleteBucket(bucketName)
 		if err != nil && err != bolt.ErrBucketNotFound {
-			log.Panic(err)
+			return err
 		}
 
-		_, err = tx.CreateBucket(bucketName)
+		b, err := tx.CreateBucket(bucketName)
 		if err != nil {
-			log.Panic(err)
+			return err
 		}
 
-		return nil
-	})
-	if err != nil {
-		log.Panic(err)
-	}
-
-	UTXO := u.Blockchain.FindUTXO()
-
-	err = db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket(bucketName)
-
 		for txID, outs := range UTXO {
-			key, err := hex.DecodeString(txID)
+			txid, err := hex.DecodeString(txID)
 			if err != nil {
-				log.Panic(err)
+				return err
 			}
 
-			err = b.Put(key, outs.SerializeOutputs())
-			if err != nil {
-				log.Panic(err)
+			for outIdx, out := range outs.Outputs {
+				if err := b.Put(outpointKey(txid, outIdx), UTXOEntry{outs.Height, out}.Serialize()); err != nil {
+					return err
+				}
 			}
 		}
 
+		// 地址索引、撤销数据和 chainstate 一起重建
+		if err := buildAddrIndex(tx); err != nil {
+			return err
+		}
+		if err := buildUndo(tx); err != nil {
+			return err
+		}
+
+		meta, err := tx.CreateBucketIfNotExists([]byte(metaBucket))
+		if err != nil {
+			return err
+		}
+		if err := meta.Put([]byte(chainstateVersionKey), Int2Hex(chainstateVersion)); err != nil {
+			return err
+		}
+		return meta.Put([]byte(chainstateBestKey), tx.Bucket([]byte(blocksBucket)).Get([]byte("last")))
+	})
+}
+
+// 记录 chainstate 对应的区块
+func setChainstateBest(tx *bolt.Tx, hash []byte) error {
+	meta, err := tx.CreateBucketIfNotExists([]byte(metaBucket))
+	if err != nil {
+		return err
+	}
+	return meta.Put([]byte(chainstateBestKey), hash)
+}
+
+// 检查 chainstate 对应的区块是否是 tip，不是时重建 chainstate
+// 旧版本的数据库没有记录这个区块，同样会重建一次
+func (u UTXOSet) Recover() error {
+	var best, last []byte
+	_ = u.Blockchain.Db.View(func(tx *bolt.Tx) error {
+		if meta := tx.Bucket([]byte(metaBucket)); meta != nil {
+			best = append([]byte{}, meta.Get([]byte(chainstateBestKey))...)
+		}
+		last = append([]byte{}, tx.Bucket([]byte(blocksBucket)).Get([]byte("last"))...)
 		return nil
 	})
+	if bytes.Equal(best, last) {
+		return nil
+	}
+
+	log.Printf("Chainstate is at block %x but the tip is %x, reindexing UTXO set\n", best, last)
+	return u.Reindex()
 }
 
-// Update updates the UTXO set with transactions from the Block
-// The Block is considered to be the tip of a blockchain
-func (u UTXOSet) Update(block *Block) {
+// 把旧格式的 chainstate 迁移到当前格式
+// 旧格式丢失了输出的真实索引或者所在区块的高度，无法直接转换，只能从区块重建；旧的撤销数据同样不可信，由 Reindex 一起重建
+// migratedb 转换的数据库没有 chainstate 和撤销数据，同样在这里重建
+func (u UTXOSet) Migrate() error {
 	db := u.Blockchain.Db
+	var outdated bool
 
-	err := db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(utxoBucket))
+	_ = db.View(func(tx *bolt.Tx) error {
+		meta := tx.Bucket([]byte(metaBucket))
+		outdated = meta == nil || !bytes.Equal(meta.Get([]byte(chainstateVersionKey)), Int2Hex(chainstateVersion)) ||
+			tx.Bucket([]byte(utxoBucket)) == nil
+		return nil
+	})
+	if !outdated {
+		return nil
+	}
+
+	return u.Reindex()
+}
 
-		for _, tx := range block.Transactions {
-			if tx.IsRewardTx() == false {
-				for _, vin := range tx.Vin {
-					updatedOuts := TXOutputs{}
-					outsBytes := b.Get(vin.Txid)
-					outs := DeserializeOutputs(outsBytes)
-
-					for outIdx, out := range outs.Outputs {
-						if outIdx != vin.Vout {
-							updatedOuts.Outputs = append(updatedOuts.Outputs, out)
-						}
-					}
-
-					if len(updatedOuts.Outputs) == 0 {
-						err := b.Delete(vin.Txid)
-						if err != nil {
-							log.Panic(err)
-						}
-					} else {
-						err := b.Put(vin.Txid, updatedOuts.SerializeOutputs())
-						if err != nil {
-							log.Panic(err)
-						}
-					}
+// Update updates the UTXO set with transactions from the Block
+// The Block is considered to be the tip of a blockchain
+// AddBlock 和 ProcessBlock 已经在写入区块的事务中更新了 UTXO 集，不需要再调用它
+func (u UTXOSet) Update(block *Block) error {
+	return u.Blockchain.Db.Update(func(tx *bolt.Tx) error {
+		return u.connectBlock(tx, block)
+	})
+}
 
+// 在数据库事务 tx 中把区块的交易应用到 UTXO 集：删除被花费的输出，加入新产生的输出
+// 被花费的输出记录到撤销数据中，断开区块时用来恢复
+func (u UTXOSet) connectBlock(tx *bolt.Tx, block *Block) error {
+	b := tx.Bucket([]byte(utxoBucket))
+	undo := BlockUndo{}
+
+	for _, transaction := range block.Transactions {
+		if transaction.IsRewardTx() == false {
+			for _, vin := range transaction.Vin {
+				key := outpointKey(vin.Txid, vin.Vout)
+				outBytes := b.Get(key)
+				if outBytes == nil {
+					return fmt.Errorf("%w: transaction %x spends missing output %x:%d", ErrInvalidBlock, transaction.ID, vin.Txid, vin.Vout)
 				}
-			}
 
-			newOutputs := TXOutputs{}
-			for _, out := range tx.Vout {
-				newOutputs.Outputs = append(newOutputs.Outputs, out)
+				entry, err := DeserializeUTXOEntry(outBytes)
+				if err != nil {
+					return err
+				}
+				undo.Spent = append(undo.Spent, SpentOutput{vin.Txid, vin.Vout, entry.Out, entry.Height})
+				if err := b.Delete(key); err != nil {
+					return err
+				}
 			}
+		}
 
-			err := b.Put(tx.ID, newOutputs.SerializeOutputs())
-			if err != nil {
-				log.Panic(err)
+		for outIdx, out := range transaction.Vout {
+			if err := b.Put(outpointKey(transaction.ID, outIdx), UTXOEntry{block.Height, out}.Serialize()); err != nil {
+				return err
 			}
 		}
+	}
 
-		return nil
-	})
+	if err := indexBlockAddresses(tx, block, undo); err != nil {
+		return err
+	}
+
+	ub, err := tx.CreateBucketIfNotExists([]byte(undoBucket))
 	if err != nil {
-		log.Panic(err)
+		return err
+	}
+	if err := ub.Put(block.Hash, undo.Serialize()); err != nil {
+		return err
 	}
+	return setChainstateBest(tx, block.Hash)
 }
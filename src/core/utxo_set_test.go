@@ -0,0 +1,142 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"testing"
+)
+
+// 在临时目录中创建一条 regtest 链，第一个区块的奖励发给返回的钱包
+func newTestChain(t *testing.T) (*Blockchain, *Wallet) {
+	t.Helper()
+
+	params := RegTestParams
+	params.DbFile = filepath.Join(t.TempDir(), params.DbFile)
+	wallet := newTestWallet(t)
+
+	bc, err := NewBlockchain(&params, testAddress(&params, wallet), "", ConsensusConfig{Engine: ConsensusPoW})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { bc.Db.Close() })
+	if err := (UTXOSet{bc}).Reindex(); err != nil {
+		t.Fatal(err)
+	}
+	return bc, wallet
+}
+
+func newTestWallet(t *testing.T) *Wallet {
+	t.Helper()
+	wallet, err := NewWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return wallet
+}
+
+func testAddress(params *ChainParams, wallet *Wallet) string {
+	return string(wallet.GetAddress(params.AddressVersion))
+}
+
+// 把交易打包进接在 tip 之后的区块，奖励发给一个新的地址，区块必须被接受
+func mineTestBlock(t *testing.T, bc *Blockchain, transactions ...*Transaction) *Block {
+	t.Helper()
+
+	block := sealTestBlock(t, bc, transactions...)
+	if _, err := bc.ProcessBlock(block); err != nil {
+		t.Fatal(err)
+	}
+	return block
+}
+
+// 创建并封装接在 tip 之后的区块，不检查其中的交易，也不写入数据库
+func sealTestBlock(t *testing.T, bc *Blockchain, transactions ...*Transaction) *Block {
+	t.Helper()
+
+	reward, err := NewRewardTX(bc.Params, testAddress(bc.Params, newTestWallet(t)), "", bc.Params.Subsidy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	preHash, height, bits, timestamp, err := bc.nextBlockParams()
+	if err != nil {
+		t.Fatal(err)
+	}
+	block := newUnminedBlock(timestamp, append([]*Transaction{reward}, transactions...), preHash, height, bits)
+	if err := bc.Engine.Seal(context.Background(), bc, block); err != nil {
+		t.Fatal(err)
+	}
+	return block
+}
+
+// 先花费交易的第一个输出，之后再花费后面的输出
+// 部分花费之后剩下的输出必须保留原来的索引，否则后一笔交易引用的输出在 UTXO 集中找不到
+func TestUTXOSetPartialSpend(t *testing.T) {
+	bc, alice := newTestChain(t)
+	bob := newTestWallet(t)
+	utxoSet := UTXOSet{bc}
+
+	// 输出0给 bob，输出1是 alice 的找零
+	tx1, err := NewTransaction(alice, testAddress(bc.Params, bob), 3, 0, 0, &utxoSet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tx1.Vout) != 2 {
+		t.Fatalf("expected a payment and a change output, got %d outputs", len(tx1.Vout))
+	}
+	change := tx1.Vout[1].Value
+	mineTestBlock(t, bc, tx1)
+
+	// bob 只花费输出0
+	tx2, err := NewTransaction(bob, testAddress(bc.Params, alice), 3, 0, 0, &utxoSet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mineTestBlock(t, bc, tx2)
+
+	if _, found, err := utxoSet.FindOutput(tx1.ID, 0); err != nil || found {
+		t.Fatalf("output 0 should be spent, found = %v, err = %v", found, err)
+	}
+	entry, found, err := utxoSet.FindOutput(tx1.ID, 1)
+	if err != nil || !found {
+		t.Fatalf("output 1 should be unspent, found = %v, err = %v", found, err)
+	}
+	if entry.Out.Value != change || entry.Height != 2 {
+		t.Fatalf("output 1 = %+v, want value %d at height 2", entry, change)
+	}
+
+	// alice 花费找零和 tx2 的输出，必须引用 tx1 的输出1
+	tx3, err := NewTransaction(alice, testAddress(bc.Params, bob), change+3, 0, 0, &utxoSet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spendsChange := false
+	for _, vin := range tx3.Vin {
+		if bytes.Equal(vin.Txid, tx1.ID) && vin.Vout == 1 {
+			spendsChange = true
+		}
+	}
+	if !spendsChange {
+		t.Fatalf("transaction does not spend %x:1", tx1.ID)
+	}
+	mineTestBlock(t, bc, tx3)
+
+	if _, found, err := utxoSet.FindOutput(tx1.ID, 1); err != nil || found {
+		t.Fatalf("output 1 should be spent, found = %v, err = %v", found, err)
+	}
+	outputs, err := utxoSet.FindUTXO(NewP2PKHScript(HashPubKey(bob.PublicKey)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(outputs) != 1 || outputs[0].Value != change+3 {
+		t.Fatalf("bob's outputs = %+v, want one output of %d", outputs, change+3)
+	}
+
+	// 重建的 UTXO 集和逐个区块更新的结果一致
+	if err := utxoSet.Reindex(); err != nil {
+		t.Fatal(err)
+	}
+	if _, found, err := utxoSet.FindOutput(tx1.ID, 1); err != nil || found {
+		t.Fatalf("output 1 should be spent after reindex, found = %v, err = %v", found, err)
+	}
+}
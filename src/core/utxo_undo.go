@@ -0,0 +1,153 @@
+package core
+
+import (
+	"fmt"
+
+	"github.com/boltdb/bolt"
+)
+
+// 区块的撤销数据，key 为区块hash
+const undoBucket = "undo"
+
+// 被区块中的交易花费掉的输出
+type SpentOutput struct {
+	Txid   []byte   // 输出所在的交易ID
+	Vout   int      // 输出在交易中的索引
+	Out    TXOutput // 被花费的输出
+	Height int      // 输出所在区块的高度
+}
+
+// 连接一个区块时记录的撤销数据，按花费的先后顺序保存
+type BlockUndo struct {
+	Spent []SpentOutput
+}
+
+// 序列化，格式见 encoding.go
+func (undo BlockUndo) Serialize() []byte {
+	var e encoder
+	e.version()
+	undo.encode(&e)
+	return e.buf.Bytes()
+}
+
+func DeserializeBlockUndo(data []byte) (BlockUndo, error) {
+	var undo BlockUndo
+
+	d := decoder{data: data}
+	d.version()
+	undo.decode(&d)
+	if err := d.finish(); err != nil {
+		return undo, fmt.Errorf("decode undo data: %w", err)
+	}
+
+	return undo, nil
+}
+
+// 从创世区块开始按主链重放区块，在内存中维护未花费的输出，依次对每个区块和它的撤销数据调用 fn
+// 不依赖 chainstate 和已有的撤销数据
+func replayMainChain(tx *bolt.Tx, fn func(block *Block, undo BlockUndo) error) error {
+	var mainChain [][]byte
+	for hash := tx.Bucket([]byte(blocksBucket)).Get([]byte("last")); len(hash) > 0; {
+		header, err := getBlockHeader(tx, hash)
+		if err != nil {
+			return err
+		}
+		mainChain = append(mainChain, header.Hash)
+		hash = header.PreHash
+	}
+
+	outputs := make(map[string]UTXOEntry)
+	for i := len(mainChain) - 1; i >= 0; i-- {
+		block, err := getBlock(tx, mainChain[i])
+		if err != nil {
+			return err
+		}
+
+		undo := BlockUndo{}
+		for _, transaction := range block.Transactions {
+			if transaction.IsRewardTx() == false {
+				for _, vin := range transaction.Vin {
+					key := string(outpointKey(vin.Txid, vin.Vout))
+					entry, ok := outputs[key]
+					if !ok {
+						return fmt.Errorf("%w: transaction %x spends missing output %x:%d", ErrInvalidBlock, transaction.ID, vin.Txid, vin.Vout)
+					}
+					undo.Spent = append(undo.Spent, SpentOutput{vin.Txid, vin.Vout, entry.Out, entry.Height})
+					delete(outputs, key)
+				}
+			}
+			for outIdx, out := range transaction.Vout {
+				outputs[string(outpointKey(transaction.ID, outIdx))] = UTXOEntry{block.Height, out}
+			}
+		}
+
+		if err := fn(block, undo); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// 重建主链上所有区块的撤销数据
+// 分叉上的区块不需要撤销数据，重组时它们先连接到主链，连接时写入
+func buildUndo(tx *bolt.Tx) error {
+	err := tx.DeleteBucket([]byte(undoBucket))
+	if err != nil && err != bolt.ErrBucketNotFound {
+		return err
+	}
+	ub, err := tx.CreateBucket([]byte(undoBucket))
+	if err != nil {
+		return err
+	}
+
+	return replayMainChain(tx, func(block *Block, undo BlockUndo) error {
+		return ub.Put(block.Hash, undo.Serialize())
+	})
+}
+
+// Disconnect 撤销区块对 UTXO 集的修改，区块必须是当前 chainstate 对应的最后一个区块
+func (u UTXOSet) Disconnect(block *Block) error {
+	return u.Blockchain.Db.Update(func(tx *bolt.Tx) error {
+		return u.disconnectBlock(tx, block)
+	})
+}
+
+// 在数据库事务 tx 中撤销区块对 UTXO 集的修改
+// 先按与花费相反的顺序把撤销数据中的输出放回去，再删除区块中交易产生的输出
+// 这样区块内交易之间的花费也能正确撤销
+func (u UTXOSet) disconnectBlock(tx *bolt.Tx, block *Block) error {
+	b := tx.Bucket([]byte(utxoBucket))
+	ub := tx.Bucket([]byte(undoBucket))
+	if ub == nil || ub.Get(block.Hash) == nil {
+		return fmt.Errorf("no undo data for block %x", block.Hash)
+	}
+	undo, err := DeserializeBlockUndo(ub.Get(block.Hash))
+	if err != nil {
+		return err
+	}
+
+	for i := len(undo.Spent) - 1; i >= 0; i-- {
+		spent := undo.Spent[i]
+		if err := b.Put(outpointKey(spent.Txid, spent.Vout), UTXOEntry{spent.Height, spent.Out}.Serialize()); err != nil {
+			return err
+		}
+	}
+
+	for _, transaction := range block.Transactions {
+		for outIdx := range transaction.Vout {
+			if err := b.Delete(outpointKey(transaction.ID, outIdx)); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := unindexBlockAddresses(tx, block, undo); err != nil {
+		return err
+	}
+
+	if err := ub.Delete(block.Hash); err != nil {
+		return err
+	}
+	return setChainstateBest(tx, block.PreHash)
+}
@@ -6,78 +6,177 @@ import (
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha256"
+	"encoding/gob"
+	"errors"
+	"fmt"
 	"golang.org/x/crypto/ripemd160"
-	"log"
+	"math/big"
 )
 
-const version = byte(0x00)
 const addressChecksumLen = 4
 
+// 地址格式不正确、校验和不匹配或者不属于当前网络
+var ErrInvalidAddress = errors.New("invalid address")
+
 type Wallet struct {
 	PrivateKey ecdsa.PrivateKey
 	PublicKey  []byte
 }
 
-func NewWallet() *Wallet {
-	private, public := newKeyPair()
+func NewWallet() (*Wallet, error) {
+	private, public, err := newKeyPair()
+	if err != nil {
+		return nil, err
+	}
 	wallet := Wallet{private, public}
 
-	return &wallet
+	return &wallet, nil
+}
+
+// gob 无法编码 ecdsa.PrivateKey 中的曲线实现，钱包文件中只保存私钥的 D 值，加载时重新计算公钥
+// PublicKey 原样保留：早期版本保存的短公钥（见 minPublicKeyLength）决定了钱包的地址，不能补齐
+type walletData struct {
+	D         []byte
+	PublicKey []byte
+}
+
+func (w Wallet) GobEncode() ([]byte, error) {
+	var buff bytes.Buffer
+
+	err := gob.NewEncoder(&buff).Encode(walletData{w.PrivateKey.D.Bytes(), w.PublicKey})
+	return buff.Bytes(), err
+}
+
+func (w *Wallet) GobDecode(data []byte) error {
+	var wd walletData
+
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&wd); err != nil {
+		return err
+	}
+
+	curve := elliptic.P256()
+	private := ecdsa.PrivateKey{D: new(big.Int).SetBytes(wd.D)}
+	private.PublicKey.Curve = curve
+	private.PublicKey.X, private.PublicKey.Y = curve.ScalarBaseMult(wd.D)
+
+	pub, ok := parsePubKey(wd.PublicKey)
+	if !ok || pub.X.Cmp(private.PublicKey.X) != 0 || pub.Y.Cmp(private.PublicKey.Y) != 0 {
+		return fmt.Errorf("public key %x does not match the private key", wd.PublicKey)
+	}
+
+	w.PrivateKey = private
+	w.PublicKey = wd.PublicKey
+	return nil
 }
 
 // ECDSA 基于椭圆曲线的算法工具，使用椭圆生成一个私钥，然后再从私钥生成一个公钥
 // 在基于椭圆曲线的算法中，公钥是曲线上的点。因此，公钥是 X，Y 坐标的组合
-func newKeyPair() (ecdsa.PrivateKey, []byte) {
+func newKeyPair() (ecdsa.PrivateKey, []byte, error) {
 	curve := elliptic.P256()
 	private, err := ecdsa.GenerateKey(curve, rand.Reader)
 	if err != nil {
-		log.Panic(err)
+		return ecdsa.PrivateKey{}, nil, err
 	}
-	pubKey := append(private.PublicKey.X.Bytes(), private.PublicKey.Y.Bytes()...)
+	pubKey := marshalPubKey(&private.PublicKey)
 
-	return *private, pubKey
+	return *private, pubKey, nil
 }
 
 // 将一个公钥转换成一个 Base58 地址，得到一个真是的地址，需要以下步骤：
 //	1. 使用 RIPEMD160(SHA256(PubKey)) 哈希算法，取公钥并对其哈希两次
-//	2.给哈希加上地址生成算法版本的前缀
+//	2.给哈希加上地址生成算法版本的前缀，版本由链参数决定
 //	3.对于第二步生成的结果，使用 SHA256(SHA256(payload)) 再哈希，计算校验和
 //	4.将校验和附加到 version+PubKeyHash 的组合中
 //	5.使用 Base58 对 version+PubKeyHash+checksum 组合进行编码
-func (w Wallet) GetAddress() []byte {
-	pubKeyHash := HashPubKey(w.PublicKey)
+func (w Wallet) GetAddress(version byte) []byte {
+	return encodeAddress(version, HashPubKey(w.PublicKey))
+}
 
-	versionedPayload := append([]byte{version}, pubKeyHash...)
+// 编码地址：version + hash + checksum
+func encodeAddress(version byte, hash []byte) []byte {
+	versionedPayload := append([]byte{version}, hash...)
 	checksum := checksum(versionedPayload)
 
 	fullPayload := append(versionedPayload, checksum...)
-	address := Base58Encode(fullPayload)
-
-	return address
+	return Base58Encode(fullPayload)
 }
 
 func HashPubKey(pubKey []byte) []byte {
 	publicSHA256 := sha256.Sum256(pubKey)
 
 	RIPEMD160Hasher := ripemd160.New()
-	_, err := RIPEMD160Hasher.Write(publicSHA256[:])
-	if err != nil {
-		log.Panic(err)
-	}
+	// hash.Hash 的 Write 不会返回错误
+	_, _ = RIPEMD160Hasher.Write(publicSHA256[:])
 	publicRIPEMD160 := RIPEMD160Hasher.Sum(nil)
 
 	return publicRIPEMD160
 }
 
 // ValidateAddress check if address if valid
-func ValidateAddress(address string) bool {
-	pubKeyHash := Base58Decode([]byte(address))
-	actualChecksum := pubKeyHash[len(pubKeyHash)-addressChecksumLen:]
-	version := pubKeyHash[0]
-	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-addressChecksumLen]
+// 除了校验和，地址的版本前缀也必须是当前网络的，防止把币转到其他网络的地址
+func (p *ChainParams) ValidateAddress(address string) bool {
+	_, err := p.DecodeAddress(address)
+	return err == nil
+}
+
+// 校验地址并返回其中的公钥hash，地址无效或者不属于当前网络时返回 ErrInvalidAddress
+func (p *ChainParams) DecodeAddress(address string) ([]byte, error) {
+	version, pubKeyHash, err := decodeAddress(address)
+	if err != nil {
+		return nil, err
+	}
+	if version != p.AddressVersion {
+		return nil, fmt.Errorf("%w: %s is not a %s address", ErrInvalidAddress, address, p.Name)
+	}
+	return pubKeyHash, nil
+}
+
+// 赎回脚本对应的 P2SH 地址
+func (p *ChainParams) ScriptAddress(redeemScript []byte) string {
+	return string(encodeAddress(p.ScriptAddressVersion, HashPubKey(redeemScript)))
+}
+
+// 锁定脚本对应的地址，只有公钥hash和脚本hash的标准脚本有地址，其他脚本返回空字符串
+func (p *ChainParams) OutputAddress(script []byte) string {
+	if hash := extractPubKeyHash(script); hash != nil {
+		return string(encodeAddress(p.AddressVersion, hash))
+	}
+	if hash := extractScriptHash(script); hash != nil {
+		return string(encodeAddress(p.ScriptAddressVersion, hash))
+	}
+	return ""
+}
+
+// 地址对应的锁定脚本，支持公钥hash地址和脚本hash地址，地址无效或者不属于当前网络时返回 ErrInvalidAddress
+func (p *ChainParams) AddressScript(address string) ([]byte, error) {
+	version, hash, err := decodeAddress(address)
+	if err != nil {
+		return nil, err
+	}
+	switch version {
+	case p.AddressVersion:
+		return NewP2PKHScript(hash), nil
+	case p.ScriptAddressVersion:
+		return NewP2SHScript(hash), nil
+	}
+	return nil, fmt.Errorf("%w: %s is not a %s address", ErrInvalidAddress, address, p.Name)
+}
+
+// 解码地址：version + PubKeyHash + checksum
+func decodeAddress(address string) (byte, []byte, error) {
+	payload, err := Base58Decode([]byte(address))
+	if err != nil || len(payload) <= 1+addressChecksumLen {
+		return 0, nil, fmt.Errorf("%w: %q", ErrInvalidAddress, address)
+	}
+	actualChecksum := payload[len(payload)-addressChecksumLen:]
+	version := payload[0]
+	pubKeyHash := payload[1 : len(payload)-addressChecksumLen]
 	targetChecksum := checksum(append([]byte{version}, pubKeyHash...))
+	if !bytes.Equal(actualChecksum, targetChecksum) {
+		return 0, nil, fmt.Errorf("%w: %s has a bad checksum", ErrInvalidAddress, address)
+	}
 
-	return bytes.Compare(actualChecksum, targetChecksum) == 0
+	return version, pubKeyHash, nil
 }
 
 // Checksum generates a checksum for a public key
@@ -2,39 +2,53 @@ package core
 
 import (
 	"bytes"
-	"crypto/elliptic"
 	"encoding/gob"
+	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"os"
 )
 
-const walletFile = "wallet.dat"
+// 钱包文件中没有这个地址
+var ErrWalletNotFound = errors.New("wallet not found")
 
 // Wallets stores a collection of wallets
 type Wallets struct {
 	Wallets map[string]*Wallet
+	// 本地创建的多签地址的赎回脚本，key 为地址
+	Scripts map[string][]byte
+	nodeID  string
+	// 钱包文件和地址前缀由链参数决定
+	params *ChainParams
 }
 
 // NewWallets creates Wallets and fills it from a file if it exists
-func NewWallets() (*Wallets, error) {
+func NewWallets(params *ChainParams, nodeID string) (*Wallets, error) {
 	wallets := Wallets{}
 	wallets.Wallets = make(map[string]*Wallet)
+	wallets.Scripts = make(map[string][]byte)
+	wallets.nodeID = nodeID
+	wallets.params = params
 
-	err := wallets.LoadFromFile()
+	// 钱包文件还不存在时返回空的钱包集合
+	if err := wallets.LoadFromFile(); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
 
-	return &wallets, err
+	return &wallets, nil
 }
 
 // CreateWallet adds a Wallet to Wallets
-func (ws *Wallets) CreateWallet() string {
-	wallet := NewWallet()
-	address := fmt.Sprintf("%s", wallet.GetAddress())
+func (ws *Wallets) CreateWallet() (string, error) {
+	wallet, err := NewWallet()
+	if err != nil {
+		return "", err
+	}
+	address := fmt.Sprintf("%s", wallet.GetAddress(ws.params.AddressVersion))
 
 	ws.Wallets[address] = wallet
 
-	return address
+	return address, nil
 }
 
 // GetAddresses returns an array of addresses stored in the wallet file
@@ -49,49 +63,62 @@ func (ws *Wallets) GetAddresses() []string {
 }
 
 // GetWallet returns a Wallet by its address
-func (ws Wallets) GetWallet(address string) Wallet {
-	return *ws.Wallets[address]
+func (ws Wallets) GetWallet(address string) (*Wallet, error) {
+	wallet, ok := ws.Wallets[address]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrWalletNotFound, address)
+	}
+	return wallet, nil
 }
 
-// LoadFromFile loads wallets from the file
-func (ws *Wallets) LoadFromFile() error {
-	if _, err := os.Stat(walletFile); os.IsNotExist(err) {
-		return err
+// 保存多签地址的赎回脚本，返回地址
+func (ws *Wallets) AddScript(redeemScript []byte) string {
+	address := ws.params.ScriptAddress(redeemScript)
+	ws.Scripts[address] = redeemScript
+	return address
+}
+
+// 获取多签地址的赎回脚本
+func (ws Wallets) GetScript(address string) ([]byte, error) {
+	script, ok := ws.Scripts[address]
+	if !ok {
+		return nil, fmt.Errorf("%w: no redeem script for %s", ErrWalletNotFound, address)
 	}
+	return script, nil
+}
 
+// LoadFromFile loads wallets from the file
+func (ws *Wallets) LoadFromFile() error {
+	walletFile := ws.params.walletFileName(ws.nodeID)
 	fileContent, err := ioutil.ReadFile(walletFile)
 	if err != nil {
-		log.Panic(err)
+		return err
 	}
 
 	var wallets Wallets
-	gob.Register(elliptic.P256())
 	decoder := gob.NewDecoder(bytes.NewReader(fileContent))
-	err = decoder.Decode(&wallets)
-	if err != nil {
-		log.Panic(err)
+	if err := decoder.Decode(&wallets); err != nil {
+		return fmt.Errorf("decode wallet file %s: %w", walletFile, err)
 	}
 
 	ws.Wallets = wallets.Wallets
+	// 旧版本的钱包文件没有赎回脚本
+	if wallets.Scripts != nil {
+		ws.Scripts = wallets.Scripts
+	}
 
 	return nil
 }
 
 // SaveToFile saves wallets to a file
-func (ws Wallets) SaveToFile() {
+func (ws Wallets) SaveToFile() error {
 	var content bytes.Buffer
-	walletFile := fmt.Sprintf(walletFile)
-
-	gob.Register(elliptic.P256())
+	walletFile := ws.params.walletFileName(ws.nodeID)
 
 	encoder := gob.NewEncoder(&content)
-	err := encoder.Encode(ws)
-	if err != nil {
-		log.Panic(err)
+	if err := encoder.Encode(ws); err != nil {
+		return err
 	}
 
-	err = ioutil.WriteFile(walletFile, content.Bytes(), 0644)
-	if err != nil {
-		log.Panic(err)
-	}
+	return ioutil.WriteFile(walletFile, content.Bytes(), 0644)
 }
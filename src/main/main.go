@@ -14,6 +14,15 @@ func main() {
 	// go run .\src\main\main.go transfer -from 1PfpqyEvx7R1551YE75pzc8jCajfnPkLK1 -to 1GG73iS7GhRxPyksADckHLZtQdNuUpAN8o -amount 3
 	// go run .\src\main\main.go balance -address 1GG73iS7GhRxPyksADckHLZtQdNuUpAN8o
 	// go run .\src\main\main.go printchain
+	//
+	// 多节点运行：通过环境变量 NODE_ID 指定节点（同时决定监听端口和数据文件），所有节点需要使用同一个创世区块
+	// set NODE_ID=3000 & go run .\src\main\main.go createchain -address 1PfpqyEvx7R1551YE75pzc8jCajfnPkLK1
+	// copy blockchain_3000.db blockchain_3001.db
+	// set NODE_ID=3000 & go run .\src\main\main.go startnode -miner 1PfpqyEvx7R1551YE75pzc8jCajfnPkLK1
+	// set NODE_ID=3001 & go run .\src\main\main.go startnode -seed localhost:3000
+	//
+	// 通过环境变量 NETWORK 选择网络（mainnet、testnet、regtest 或链参数 JSON 文件），不同网络的数据库、钱包和地址互相独立
+	// set NETWORK=regtest & go run .\src\main\main.go createwallet
 	cli := core.CLI{}
 	cli.Run()
 }